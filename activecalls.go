@@ -0,0 +1,214 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mdigger/log"
+)
+
+// Время, после которого звонок без новых событий считается завершенным, если
+// событие о его окончании так и не было получено: для звонков, ожидающих
+// ответа, и для установленных или удерживаемых звонков.
+var (
+	ActiveCallAlertingTTL = time.Minute * 5
+	ActiveCallTTL         = time.Hour * 12
+)
+
+// Состояния текущего звонка.
+const (
+	CallStateAlerting   = "alerting"   // входящий звонок ожидает ответа
+	CallStateOriginated = "originated" // исходящий звонок ожидает ответа
+	CallStateConnected  = "connected"  // разговор
+	CallStateHeld       = "held"       // звонок удерживается
+)
+
+// ActiveCall описывает текущий звонок пользователя и его состояние,
+// собранное из событий монитора звонков.
+type ActiveCall struct {
+	CallID        int64  `json:"callId"`
+	DeviceID      string `json:"deviceId"`
+	GlobalCallID  string `json:"globalCallId,omitempty"`
+	State         string `json:"state"`
+	Direction     string `json:"direction,omitempty"` // incoming или outgoing
+	CallingDevice string `json:"callingDevice,omitempty"`
+	CalledDevice  string `json:"calledDevice,omitempty"`
+	DisplayName   string `json:"displayName,omitempty"` // имя собеседника
+	CmdsAllowed   uint32 `json:"cmdsAllowed,omitempty"`
+	Started       int64  `json:"started"`             // время первого события
+	Connected     int64  `json:"connected,omitempty"` // время соединения
+	Updated       int64  `json:"updated"`             // время последнего события
+}
+
+// stale возвращает true, если по звонку слишком давно не было событий.
+func (call *ActiveCall) stale(now int64) bool {
+	var ttl = ActiveCallTTL
+	if call.State == CallStateAlerting || call.State == CallStateOriginated {
+		ttl = ActiveCallAlertingTTL
+	}
+	return now-call.Updated > int64(ttl/time.Second)
+}
+
+// activeCalls описывает список текущих звонков соединения.
+type activeCalls struct {
+	calls map[int64]*ActiveCall
+	mu    sync.Mutex
+}
+
+// updateCall изменяет информацию о текущем звонке. Если звонка еще нет в
+// списке, то он добавляется. Функция изменения вызывается при
+// заблокированном списке.
+func (c *MXConn) updateCall(callID int64, update func(call *ActiveCall)) {
+	var active = &c.active
+	var now = time.Now().Unix()
+	active.mu.Lock()
+	if active.calls == nil {
+		active.calls = make(map[int64]*ActiveCall)
+	}
+	c.evictCalls(now)
+	var call = active.calls[callID]
+	if call == nil {
+		call = &ActiveCall{CallID: callID, Started: now}
+		active.calls[callID] = call
+	}
+	update(call)
+	call.Updated = now
+	active.mu.Unlock()
+}
+
+// removeCall удаляет звонок из списка текущих.
+func (c *MXConn) removeCall(callID int64) {
+	c.active.mu.Lock()
+	delete(c.active.calls, callID)
+	c.active.mu.Unlock()
+}
+
+// evictCalls удаляет звонки, по которым слишком давно не было событий.
+// Должна вызываться при заблокированном списке.
+func (c *MXConn) evictCalls(now int64) {
+	for id, call := range c.active.calls {
+		if call.stale(now) {
+			delete(c.active.calls, id)
+			c.Calls.Delete(id)
+			log.Debug("stale call removed", "login", c.Login, "id", id,
+				"state", call.State)
+		}
+	}
+}
+
+// ActiveCalls возвращает копию списка текущих звонков, упорядоченного по
+// времени начала звонка.
+func (c *MXConn) ActiveCalls() []*ActiveCall {
+	var active = &c.active
+	active.mu.Lock()
+	c.evictCalls(time.Now().Unix())
+	var list = make([]*ActiveCall, 0, len(active.calls))
+	for _, call := range active.calls {
+		var item = *call
+		list = append(list, &item)
+	}
+	active.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Started == list[j].Started {
+			return list[i].CallID < list[j].CallID
+		}
+		return list[i].Started < list[j].Started
+	})
+	return list
+}
+
+// ActiveCall возвращает копию информации о текущем звонке с указанным
+// идентификатором.
+func (c *MXConn) ActiveCall(callID int64) (*ActiveCall, bool) {
+	var active = &c.active
+	active.mu.Lock()
+	defer active.mu.Unlock()
+	c.evictCalls(time.Now().Unix())
+	var call, ok = active.calls[callID]
+	if !ok {
+		return nil, false
+	}
+	var item = *call
+	return &item, true
+}
+
+// callDelivered изменяет состояние звонка по событию о входящем звонке.
+func (c *MXConn) callDelivered(event *DeliveredEvent) {
+	c.updateCall(event.CallID, func(call *ActiveCall) {
+		call.DeviceID = event.DeviceID
+		call.GlobalCallID = event.GlobalCallID
+		call.CallingDevice = event.CallingDevice
+		call.CalledDevice = event.CalledDevice
+		call.Direction = "incoming"
+		if call.State == "" {
+			call.State = CallStateAlerting
+		}
+	})
+}
+
+// callOriginated изменяет состояние звонка по событию об исходящем звонке.
+func (c *MXConn) callOriginated(event *OriginatedEvent) {
+	c.updateCall(event.CallID, func(call *ActiveCall) {
+		call.DeviceID = event.DeviceID
+		call.CallingDevice = event.CallingDevice
+		call.CalledDevice = event.CalledDevice
+		call.CmdsAllowed = event.CmdsAllowed
+		call.Direction = "outgoing"
+		if call.State == "" {
+			call.State = CallStateOriginated
+		}
+	})
+}
+
+// callEstablished изменяет состояние звонка по событию об установленном
+// соединении.
+func (c *MXConn) callEstablished(event *EstablishedEvent) {
+	c.updateCall(event.CallID, func(call *ActiveCall) {
+		call.DeviceID = event.DeviceID
+		call.GlobalCallID = event.GlobalCallID
+		call.CallingDevice = event.CallingDevice
+		call.CalledDevice = event.CalledDevice
+		call.CmdsAllowed = event.CmdsAllowed
+		if call.Direction == "" {
+			if event.CallingDevice == c.Ext {
+				call.Direction = "outgoing"
+			} else {
+				call.Direction = "incoming"
+			}
+		}
+		// имя собеседника зависит от направления звонка
+		if call.Direction == "outgoing" {
+			call.DisplayName = event.AnsweringDisplayName
+		} else {
+			call.DisplayName = event.CallingDisplayName
+		}
+		call.State = CallStateConnected
+		call.Connected = time.Now().Unix()
+	})
+}
+
+// callHeld изменяет состояние звонка по событию об удержании звонка.
+func (c *MXConn) callHeld(event *HeldEvent) {
+	c.updateCall(event.CallID, func(call *ActiveCall) {
+		if call.DeviceID == "" {
+			call.DeviceID = event.DeviceID
+		}
+		call.CmdsAllowed = event.CmdsAllowed
+		call.State = CallStateHeld
+	})
+}
+
+// callRetrieved изменяет состояние звонка по событию о снятии с удержания.
+func (c *MXConn) callRetrieved(event *RetrievedEvent) {
+	c.updateCall(event.CallID, func(call *ActiveCall) {
+		if call.DeviceID == "" {
+			call.DeviceID = event.DeviceID
+		}
+		call.CmdsAllowed = event.CmdsAllowed
+		call.State = CallStateConnected
+		if call.Connected == 0 {
+			call.Connected = time.Now().Unix()
+		}
+	})
+}
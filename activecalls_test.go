@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// activeCalls возвращает список текущих звонков пользователя.
+func (s *testService) activeCalls() []*ActiveCall {
+	s.t.Helper()
+	var result = new(struct {
+		Calls []*ActiveCall `json:"calls"`
+	})
+	s.request("GET", "/calls/active", nil, http.StatusOK, result)
+	return result.Calls
+}
+
+func TestActiveCalls(t *testing.T) {
+	var s = newTestService(t)
+	s.login()
+	var events = s.events()
+	if calls := s.activeCalls(); len(calls) != 0 {
+		t.Fatalf("active calls = %d, want 0", len(calls))
+	}
+
+	var incoming = s.mx.Delivered("test", "79031234567")
+	nextEvent(t, events, "Delivered")
+	var calls = s.activeCalls()
+	if len(calls) != 1 {
+		t.Fatalf("active calls = %d, want 1", len(calls))
+	}
+	if call := calls[0]; call.CallID != incoming ||
+		call.State != CallStateAlerting || call.Direction != "incoming" ||
+		call.CallingDevice != "79031234567" || call.Started == 0 {
+		t.Errorf("incoming call = %+v", call)
+	}
+
+	s.mx.Established("test", incoming, "79031234567")
+	nextEvent(t, events, "Established")
+	if call := s.activeCalls()[0]; call.State != CallStateConnected ||
+		call.Direction != "incoming" || call.Connected == 0 {
+		t.Errorf("established call = %+v", call)
+	}
+
+	var path = "/calls/" + strconv.FormatInt(incoming, 10)
+	s.request("PUT", path+"/hold", nil, http.StatusOK, nil)
+	nextEvent(t, events, "HeldEvent")
+	if call := s.activeCalls()[0]; call.State != CallStateHeld {
+		t.Errorf("held call state = %q", call.State)
+	}
+	s.request("PUT", path+"/unhold", nil, http.StatusOK, nil)
+	nextEvent(t, events, "RetrievedEvent")
+	if call := s.activeCalls()[0]; call.State != CallStateConnected {
+		t.Errorf("retrieved call state = %q", call.State)
+	}
+
+	var outgoing = incoming + 100
+	s.mx.Originated("test", outgoing, "3096")
+	nextEvent(t, events, "Originated")
+	calls = s.activeCalls()
+	if len(calls) != 2 {
+		t.Fatalf("active calls = %d, want 2", len(calls))
+	}
+	var call = calls[1]
+	if calls[0].CallID == outgoing {
+		call = calls[0]
+	}
+	if call.CallID != outgoing || call.State != CallStateOriginated ||
+		call.Direction != "outgoing" || call.CalledDevice != "3096" {
+		t.Errorf("outgoing call = %+v", call)
+	}
+
+	s.mx.Cleared("test", incoming)
+	nextEvent(t, events, "ConnectionCleared")
+	s.mx.Cleared("test", outgoing)
+	nextEvent(t, events, "ConnectionCleared")
+	if calls := s.activeCalls(); len(calls) != 0 {
+		t.Errorf("active calls after clear = %+v", calls)
+	}
+}
+
+func TestActiveCallsStale(t *testing.T) {
+	var conn = &MXConn{Login: "test"}
+	var now = time.Now().Unix()
+	var alertingTTL = int64(ActiveCallAlertingTTL / time.Second)
+	var activeTTL = int64(ActiveCallTTL / time.Second)
+	conn.active.calls = map[int64]*ActiveCall{
+		1: {CallID: 1, State: CallStateAlerting, Updated: now - alertingTTL - 1},
+		2: {CallID: 2, State: CallStateAlerting, Updated: now},
+		3: {CallID: 3, State: CallStateConnected, Updated: now - alertingTTL - 1},
+		4: {CallID: 4, State: CallStateHeld, Updated: now - activeTTL - 1},
+		5: {CallID: 5, State: CallStateOriginated, Updated: now - alertingTTL - 1},
+	}
+	conn.Calls.Store(int64(1), new(DeliveredEvent))
+	var calls = conn.ActiveCalls()
+	if len(calls) != 2 || calls[0].CallID != 2 || calls[1].CallID != 3 {
+		t.Errorf("active calls = %+v", calls)
+	}
+	if _, ok := conn.Calls.Load(int64(1)); ok {
+		t.Error("stale call info not removed")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdigger/log"
+)
+
+// AddressBookTTL задает время, в течение которого адресная книга отдается из
+// кеша соединения без повторного запроса к серверу MX.
+var AddressBookTTL = time.Minute * 5
+
+// ContactsMaxLimit задает максимальное количество контактов в ответе при
+// постраничной отдаче.
+const ContactsMaxLimit = 1000
+
+// addressBook описывает адресную книгу, сохраненную в соединении.
+type addressBook struct {
+	contacts []*Contact // отсортированный список контактов
+	etag     string     // хеш содержимого
+	updated  time.Time  // время получения с сервера MX
+	mu       sync.Mutex
+}
+
+// AddressBook возвращает адресную книгу и хеш ее содержимого. Адресная книга
+// запрашивается с сервера MX только если закешированная копия устарела.
+// Одновременные запросы ожидают получения одной и той же копии.
+func (c *MXConn) AddressBook() ([]*Contact, string, error) {
+	var book = &c.book
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	if book.contacts != nil && time.Since(book.updated) < AddressBookTTL {
+		return book.contacts, book.etag, nil
+	}
+	contacts, err := c.Contacts()
+	if err != nil {
+		return nil, "", err
+	}
+	// при одинаковых номерах порядок определяется идентификатором, чтобы
+	// курсор постраничной отдачи был однозначным
+	sort.SliceStable(contacts, func(i, j int) bool {
+		if contacts[i].Ext == contacts[j].Ext {
+			return contacts[i].JID < contacts[j].JID
+		}
+		return contacts[i].Ext < contacts[j].Ext
+	})
+	data, err := json.Marshal(contacts)
+	if err != nil {
+		return nil, "", err
+	}
+	var hash = sha256.Sum256(data)
+	var etag = hex.EncodeToString(hash[:16])
+	// при изменении адресной книги повторяем подписку на присутствие, чтобы
+	// получать изменения присутствия новых контактов; первая подписка
+	// выполняется при подключении
+	if book.contacts != nil && book.etag != etag {
+		if err := c.PresenceSubscribe(contacts); err != nil {
+			log.Error("presence resubscribe error", "login", c.Login,
+				"error", err)
+		}
+	}
+	book.contacts = contacts
+	book.etag = etag
+	book.updated = time.Now()
+	return book.contacts, book.etag, nil
+}
+
+// contactMatch возвращает true, если контакт содержит все слова поискового
+// запроса. Сравнение выполняется без учета регистра; для телефонных номеров
+// слова, состоящие из цифр, сравниваются без учета разделителей.
+func contactMatch(contact *Contact, terms []string) bool {
+	var text = strings.ToLower(strings.Join([]string{
+		contact.FirstName, contact.LastName, contact.Ext, contact.HomePhone,
+		contact.CellPhone, contact.Email, contact.DID,
+	}, "\n"))
+	var digits = strings.Join([]string{
+		onlyDigits(contact.Ext), onlyDigits(contact.HomePhone),
+		onlyDigits(contact.CellPhone), onlyDigits(contact.DID),
+	}, "\n")
+	for _, term := range terms {
+		if strings.Contains(text, term) {
+			continue
+		}
+		if isPhoneNumber(term) &&
+			strings.Contains(digits, onlyDigits(term)) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// isPhoneNumber возвращает true, если строка похожа на телефонный номер:
+// содержит цифры и, возможно, принятые в номерах разделители.
+func isPhoneNumber(s string) bool {
+	var digits bool
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			digits = true
+		case strings.ContainsRune("+-().", r):
+		default:
+			return false
+		}
+	}
+	return digits
+}
+
+// onlyDigits возвращает строку, содержащую только цифры исходной строки.
+func onlyDigits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// searchTerms разбивает поисковый запрос на слова в нижнем регистре.
+func searchTerms(q string) []string {
+	return strings.Fields(strings.ToLower(q))
+}
+
+// contactCursor возвращает курсор, указывающий на позицию после контакта.
+func contactCursor(contact *Contact) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(
+		contact.Ext + "\x00" + strconv.FormatUint(uint64(contact.JID), 10)))
+}
+
+// errBadCursor возвращается при неверном формате курсора.
+var errBadCursor = errors.New("bad cursor")
+
+// contactsAfter возвращает контакты, находящиеся после позиции курсора.
+// Контакты должны быть отсортированы так же, как в AddressBook.
+func contactsAfter(contacts []*Contact, cursor string) ([]*Contact, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	var parts = strings.SplitN(string(data), "\x00", 2)
+	if len(parts) != 2 {
+		return nil, errBadCursor
+	}
+	jid, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	var ext = parts[0]
+	var i = sort.Search(len(contacts), func(i int) bool {
+		var contact = contacts[i]
+		return contact.Ext > ext ||
+			(contact.Ext == ext && uint64(contact.JID) > jid)
+	})
+	return contacts[i:], nil
+}
+
+// contactFieldNames содержит названия полей контакта, которые можно указать
+// для выборочной отдачи.
+var contactFieldNames = []string{
+	"jid", "firstName", "lastName", "ext", "homePhone", "cellPhone", "email",
+	"homeSystem", "did", "exchangeId",
+}
+
+// parseContactFields разбирает список полей, перечисленных через запятую.
+func parseContactFields(value string) ([]string, error) {
+	var fields = strings.Split(value, ",")
+next:
+	for i, field := range fields {
+		field = strings.TrimSpace(field)
+		for _, name := range contactFieldNames {
+			if field == name {
+				fields[i] = field
+				continue next
+			}
+		}
+		return nil, errors.New("unknown contact field: " + field)
+	}
+	return fields, nil
+}
+
+// selectFields возвращает контакты, содержащие только указанные поля. Пустые
+// значения не отдаются, как и в полном описании контакта.
+func selectFields(contacts []*Contact, fields []string) ([]map[string]json.RawMessage,
+	error) {
+	var result = make([]map[string]json.RawMessage, len(contacts))
+	for i, contact := range contacts {
+		data, err := json.Marshal(contact)
+		if err != nil {
+			return nil, err
+		}
+		var all map[string]json.RawMessage
+		if err = json.Unmarshal(data, &all); err != nil {
+			return nil, err
+		}
+		var selected = make(map[string]json.RawMessage, len(fields))
+		for _, field := range fields {
+			if value, ok := all[field]; ok {
+				selected[field] = value
+			}
+		}
+		result[i] = selected
+	}
+	return result, nil
+}
+
+// contactsETag возвращает ETag ответа со списком контактов, который зависит
+// как от содержимого адресной книги, так и от параметров запроса.
+func contactsETag(version, query string) string {
+	var hash = sha256.Sum256([]byte(version + "\x00" + query))
+	return strconv.Quote("ab-" + hex.EncodeToString(hash[:12]))
+}
+
+// etagMatch возвращает true, если значение заголовка If-None-Match содержит
+// указанный ETag. Слабые ETag сравниваются без учета признака W/.
+func etagMatch(header, etag string) bool {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimPrefix(strings.TrimSpace(value), "W/")
+		if value == "*" || value == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdigger/log"
+	"golang.org/x/net/http2"
+)
+
+// APNTokenTTL задает время использования токена провайдера Apple Push, после
+// которого он создается заново. Apple принимает токены не старше часа и
+// запрещает обновлять их чаще, чем раз в 20 минут.
+var APNTokenTTL = time.Minute * 40
+
+// apnProviderKey описывает ключ для авторизации Apple Push с помощью токена
+// провайдера (JWT, ES256).
+type apnProviderKey struct {
+	keyID   string            // идентификатор ключа
+	teamID  string            // идентификатор команды разработчика
+	key     *ecdsa.PrivateKey // ключ для подписи токенов
+	token   string            // текущий токен провайдера
+	created time.Time         // время создания токена
+	mu      sync.Mutex
+}
+
+// Token возвращает токен провайдера для авторизации запросов к Apple Push.
+// Токен кешируется и создается заново только по истечении APNTokenTTL.
+func (k *apnProviderKey) Token() (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.token != "" && time.Since(k.created) < APNTokenTTL {
+		return k.token, nil
+	}
+	var created = time.Now()
+	header, err := json.Marshal(&struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{
+		Alg: "ES256",
+		Kid: k.keyID,
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(&struct {
+		Issuer string `json:"iss"`
+		Issued int64  `json:"iat"`
+	}{
+		Issuer: k.teamID,
+		Issued: created.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	var unsigned = base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+	var hash = sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, k.key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	// подпись ES256 состоит из значений r и s, дополненных до 32 байт
+	var sign = make([]byte, 64)
+	r.FillBytes(sign[:32])
+	s.FillBytes(sign[32:])
+	k.token = unsigned + "." + base64.RawURLEncoding.EncodeToString(sign)
+	k.created = created
+	log.Debug("apple push provider token", "keyId", k.keyID)
+	return k.token, nil
+}
+
+// Reset сбрасывает закешированный токен провайдера, чтобы при следующем
+// запросе был создан новый.
+func (k *apnProviderKey) Reset() {
+	k.mu.Lock()
+	k.token = ""
+	k.mu.Unlock()
+}
+
+// LoadProviderKey загружает ключ .p8 для авторизации Apple Push с помощью
+// токена провайдера и регистрирует для него указанные темы. Каждая тема
+// регистрируется сразу для рабочего окружения и для sandbox.
+func (p *Push) LoadProviderKey(filename, keyID, teamID string, topics ...string) error {
+	if keyID == "" || teamID == "" {
+		return errors.New("apns key id and team id required")
+	}
+	if len(topics) == 0 {
+		return errors.New("apns key topics not defined")
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New("bad apns key format")
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	ecdsaKey, ok := privateKey.(*ecdsa.PrivateKey)
+	if !ok || ecdsaKey.Curve.Params().BitSize != 256 {
+		return errors.New("apns key is not ES256 private key")
+	}
+	// все ключи используют один общий клиент HTTP/2
+	if p.apnKeyClient == nil {
+		var transport = &http.Transport{
+			IdleConnTimeout:   PushIdleConnTimeout,
+			DisableKeepAlives: false,
+		}
+		if err = http2.ConfigureTransport(transport); err != nil {
+			return err
+		}
+		p.apnKeyClient = &http.Client{
+			Timeout:   PushTimeout,
+			Transport: transport,
+		}
+	}
+	if p.apnKeys == nil {
+		p.apnKeys = make(map[string]*apnProviderKey)
+	}
+	var key = &apnProviderKey{
+		keyID:  keyID,
+		teamID: teamID,
+		key:    ecdsaKey,
+	}
+	for _, topic := range topics {
+		topic = strings.TrimSuffix(topic, "~")
+		p.apnKeys[topic] = key
+		p.apnKeys[topic+"~"] = key
+	}
+	log.Info("apple push key",
+		"file", filename,
+		"keyId", keyID,
+		"team", teamID,
+		"topics", strings.Join(topics, ", "))
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/rest"
+)
+
+// CallLogSyncOverlap задает запас времени при запросе новых записей лога
+// звонков с сервера MX: записи, добавленные на сервере с задержкой, не
+// теряются, а повторно полученные просто заменяют сохраненные.
+var CallLogSyncOverlap = time.Hour
+
+// CallLogMaxLimit задает максимальное количество записей лога звонков в
+// ответе при постраничной отдаче.
+const CallLogMaxLimit = 1000
+
+// CallLogSyncInterval задает минимальный интервал между синхронизациями лога
+// звонков пользователя с сервером MX: более частые запросы отдаются из
+// хранилища без обращения к серверу.
+var CallLogSyncInterval = time.Second * 30
+
+// syncCallLog запрашивает с сервера MX записи лога звонков, появившиеся после
+// последней синхронизации, и сохраняет их в хранилище. При первой
+// синхронизации запрашивается весь лог. Одновременные запросы дожидаются
+// окончания текущей синхронизации и не повторяют ее.
+//
+// Если лог мог быть получен не полностью, то полученные записи сохраняются,
+// но время синхронизации не изменяется: следующая синхронизация запросит те
+// же записи повторно, чтобы не пропустить недостающие.
+func (p *Proxy) syncCallLog(conn *MXConn) error {
+	conn.callLogSyncMu.Lock()
+	defer conn.callLogSyncMu.Unlock()
+	if time.Since(conn.callLogSynced) < CallLogSyncInterval {
+		return nil
+	}
+	var since time.Time
+	if synced := p.store.CallLogSynced(conn.Login); synced > 0 {
+		since = time.Unix(synced, 0).Add(-CallLogSyncOverlap)
+	}
+	calls, err := conn.CallLog(since)
+	var complete = err == nil
+	if err == errCallLogIncomplete {
+		log.Warn("call log may be incomplete", "login", conn.Login,
+			"calls", len(calls))
+	} else if err != nil {
+		return err
+	}
+	if err = p.store.AddCalls(conn.Login, calls); err != nil {
+		return err
+	}
+	if last := p.store.LastCallTime(conn.Login); complete && last > 0 {
+		if err = p.store.SetCallLogSynced(conn.Login, last); err != nil {
+			return err
+		}
+	}
+	conn.callLogSynced = time.Now()
+	return nil
+}
+
+// callLogFilter описывает условия выборки записей из лога звонков.
+type callLogFilter struct {
+	Direction string // направление звонка: incoming или outgoing
+	Missed    *bool  // только пропущенные или только принятые звонки
+	From, To  int64  // интервал времени звонка включительно
+}
+
+// match возвращает true, если запись соответствует условиям выборки.
+func (f *callLogFilter) match(call *CallInfo) bool {
+	if f.Direction != "" && call.Direction != f.Direction {
+		return false
+	}
+	if f.Missed != nil && call.Missed != *f.Missed {
+		return false
+	}
+	var t = call.Time()
+	if f.From != 0 && t < f.From {
+		return false
+	}
+	if f.To != 0 && t > f.To {
+		return false
+	}
+	return true
+}
+
+// errBadTimestamp возвращается при неверном формате времени.
+var errBadTimestamp = errors.New("bad timestamp format")
+
+// parseTimestamp разбирает время, заданное числом секунд или строкой в
+// формате RFC 3339.
+func parseTimestamp(value string) (int64, error) {
+	if t, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Unix(), nil
+	}
+	return 0, errBadTimestamp
+}
+
+// Форматы экспорта лога звонков и их MIME-типы.
+var callLogExportMimetypes = map[string]string{
+	"csv":   "text/csv; charset=utf-8",
+	"jsonl": "application/x-ndjson",
+}
+
+// callLogExportBatch задает количество записей, читаемых из хранилища за один
+// раз при экспорте лога звонков.
+const callLogExportBatch = 500
+
+// callExport описывает запись лога звонков при экспорте.
+type callExport struct {
+	RecordID              int64  `json:"record_id"`
+	Direction             string `json:"direction"`
+	Missed                bool   `json:"missed"`
+	Start                 string `json:"start"`                  // время звонка
+	Connected             string `json:"connected,omitempty"`    // время соединения
+	Disconnected          string `json:"disconnected,omitempty"` // время завершения
+	Duration              int64  `json:"duration"`               // длительность в секундах
+	CallingPartyNo        string `json:"callingPartyNo"`
+	OriginalCalledPartyNo string `json:"originalCalledPartyNo"`
+	Name                  string `json:"name,omitempty"` // имя абонента
+	Extension             string `json:"ext,omitempty"`
+	ServiceName           string `json:"serviceName,omitempty"`
+	GCID                  string `json:"gcid"`
+}
+
+// callExportColumns содержит названия колонок при экспорте в CSV.
+var callExportColumns = []string{
+	"record_id", "direction", "missed", "start", "connected", "disconnected",
+	"duration", "callingPartyNo", "originalCalledPartyNo", "name", "ext",
+	"serviceName", "gcid",
+}
+
+// record возвращает значения колонок для экспорта в CSV.
+func (e *callExport) record() []string {
+	return []string{
+		strconv.FormatInt(e.RecordID, 10), e.Direction,
+		strconv.FormatBool(e.Missed), e.Start, e.Connected, e.Disconnected,
+		strconv.FormatInt(e.Duration, 10), e.CallingPartyNo,
+		e.OriginalCalledPartyNo, e.Name, e.Extension, e.ServiceName, e.GCID,
+	}
+}
+
+// contactNames возвращает имена контактов адресной книги по номерам их
+// телефонов. Номера сравниваются только по цифрам.
+func contactNames(contacts []*Contact) map[string]string {
+	var names = make(map[string]string)
+	for _, contact := range contacts {
+		var name = strings.TrimSpace(contact.FirstName + " " + contact.LastName)
+		if name == "" {
+			continue
+		}
+		for _, number := range []string{contact.Ext, contact.DID,
+			contact.CellPhone, contact.HomePhone} {
+			var digits = onlyDigits(number)
+			if _, ok := names[digits]; digits != "" && !ok {
+				names[digits] = name
+			}
+		}
+	}
+	return names
+}
+
+// newCallExport возвращает запись лога звонков для экспорта. Время
+// отдается в указанной временной зоне и формате, а имя абонента, если оно не
+// указано в записи, определяется по адресной книге.
+func newCallExport(call *CallInfo, names map[string]string,
+	loc *time.Location, layout string) *callExport {
+	var format = func(ts int64) string {
+		if ts == 0 {
+			return ""
+		}
+		return time.Unix(ts, 0).In(loc).Format(layout)
+	}
+	var export = &callExport{
+		RecordID:              call.RecordID,
+		Direction:             call.Direction,
+		Missed:                call.Missed,
+		Start:                 format(call.Time()),
+		Connected:             format(call.ConnectTimestamp),
+		Disconnected:          format(call.DisconnectTimestamp),
+		CallingPartyNo:        call.CallingPartyNo,
+		OriginalCalledPartyNo: call.OriginalCalledPartyNo,
+		Name: strings.TrimSpace(
+			call.FirstName + " " + call.LastName),
+		Extension:   call.Extension,
+		ServiceName: call.ServiceName,
+		GCID:        call.GCID,
+	}
+	if call.ConnectTimestamp != 0 &&
+		call.DisconnectTimestamp > call.ConnectTimestamp {
+		export.Duration = call.DisconnectTimestamp - call.ConnectTimestamp
+	}
+	if export.Name == "" {
+		// номер другого абонента зависит от направления звонка
+		var number = call.CallingPartyNo
+		if call.Direction == "outgoing" {
+			number = call.OriginalCalledPartyNo
+		}
+		export.Name = names[onlyDigits(number)]
+	}
+	return export
+}
+
+// exportCallLog отдает записи лога звонков, сохраненные в хранилище, в
+// формате CSV или JSON Lines. Записи читаются из хранилища частями и
+// отдаются по мере формирования.
+func (p *Proxy) exportCallLog(c *rest.Context, conn *MXConn, format string,
+	after int64, filter *callLogFilter, limit int) error {
+	var loc = time.UTC
+	if tz := c.Query("tz"); tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return c.Error(http.StatusBadRequest, "bad time zone")
+		}
+	}
+	// имена абонентов определяются по адресной книге; если ее не удалось
+	// получить, то экспорт выполняется без них
+	var names map[string]string
+	if contacts, _, err := conn.AddressBook(); err == nil {
+		names = contactNames(contacts)
+	} else {
+		log.Warn("call log export: address book error", "error", err)
+	}
+	c.SetHeader("Content-Type", callLogExportMimetypes[format])
+	c.SetHeader("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", "calls."+format))
+	c.AllowMultiple = true // разрешаем отдавать ответ кусочками
+	var out = bufio.NewWriterSize(responseWriter{c}, 32<<10)
+	var (
+		csvWriter *csv.Writer
+		encoder   *json.Encoder
+		layout    = time.RFC3339
+	)
+	if format == "csv" {
+		csvWriter = csv.NewWriter(out)
+		csvWriter.UseCRLF = true
+		csvWriter.Write(callExportColumns)
+		layout = "2006-01-02 15:04:05" // понятный электронным таблицам
+	} else {
+		encoder = json.NewEncoder(out)
+		encoder.SetEscapeHTML(false)
+	}
+	for count := 0; limit <= 0 || count < limit; {
+		var batch = callLogExportBatch
+		if limit > 0 && limit-count < batch {
+			batch = limit - count
+		}
+		calls, last, more := p.store.Calls(conn.Login, after, filter.match,
+			batch)
+		for _, call := range calls {
+			var export = newCallExport(call, names, loc, layout)
+			if csvWriter != nil {
+				csvWriter.Write(export.record())
+			} else if err := encoder.Encode(export); err != nil {
+				return err
+			}
+		}
+		if csvWriter != nil {
+			csvWriter.Flush()
+			if err := csvWriter.Error(); err != nil {
+				return err
+			}
+		}
+		count += len(calls)
+		after = last
+		if !more {
+			break
+		}
+	}
+	return out.Flush()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mdigger/mxproxy/mxtest"
+)
+
+// callLogPage описывает ответ на запрос лога звонков.
+type callLogPage struct {
+	CallLog   []*CallInfo `json:"callLog"`
+	SyncToken string      `json:"syncToken"`
+	More      bool        `json:"more"`
+}
+
+func testCallLog(from, count int) []*mxtest.CallInfo {
+	var calls = make([]*mxtest.CallInfo, count)
+	for i := range calls {
+		calls[i] = &mxtest.CallInfo{
+			RecordID:         int64(from + i),
+			GCID:             "gcid",
+			ConnectTimestamp: int64(1500000000 + from + i),
+			Direction:        "incoming",
+			CallingPartyNo:   "79031234567",
+		}
+	}
+	return calls
+}
+
+func TestCallLogPaging(t *testing.T) {
+	var s = newTestService(t, "[callLog]\ntimeout = \"200ms\"\nsyncInterval = \"0s\"")
+	s.mx.AddCallLog("test", testCallLog(1, 45)...)
+	s.login()
+	var page = new(callLogPage)
+	var ids []int64
+	for path := "/calls?limit=20"; ; {
+		*page = callLogPage{}
+		s.request("GET", path, nil, http.StatusOK, page)
+		for _, call := range page.CallLog {
+			ids = append(ids, call.RecordID)
+		}
+		if !page.More {
+			break
+		}
+		if len(page.CallLog) != 20 {
+			t.Fatalf("page size = %d, want 20", len(page.CallLog))
+		}
+		path = "/calls?limit=20&syncToken=" + page.SyncToken
+	}
+	if len(ids) != 45 {
+		t.Fatalf("calls = %d, want 45", len(ids))
+	}
+	for i, id := range ids {
+		if id != int64(i+1) {
+			t.Fatalf("call %d: record_id = %d", i, id)
+		}
+	}
+	if page.SyncToken != "45" {
+		t.Errorf("syncToken = %q, want 45", page.SyncToken)
+	}
+	if synced := s.proxy.store.CallLogSynced("test"); synced != 1500000045 {
+		t.Errorf("call log synced = %d", synced)
+	}
+	// новые записи отдаются после синхронизации по syncToken
+	s.mx.AddCallLog("test", testCallLog(46, 2)...)
+	page = new(callLogPage)
+	s.request("GET", "/calls?syncToken=45", nil, http.StatusOK, page)
+	if len(page.CallLog) != 2 || page.CallLog[0].RecordID != 46 ||
+		page.More || page.SyncToken != "47" {
+		t.Errorf("sync page = %+v", page)
+	}
+	s.request("GET", "/calls?limit=0", nil, http.StatusBadRequest, nil)
+	s.request("GET", "/calls?syncToken=bad", nil, http.StatusBadRequest, nil)
+}
+
+func TestCallLogFullBlocks(t *testing.T) {
+	// записей ровно на два блока: окончание лога определяется по таймауту
+	var s = newTestService(t, "[callLog]\ntimeout = \"200ms\"\nsyncInterval = \"0s\"")
+	s.mx.AddCallLog("test", testCallLog(1, CallLogPageSize*2)...)
+	s.login()
+	var page = new(callLogPage)
+	s.request("GET", "/calls", nil, http.StatusOK, page)
+	if len(page.CallLog) != CallLogPageSize*2 {
+		t.Errorf("calls = %d, want %d", len(page.CallLog), CallLogPageSize*2)
+	}
+	// лог мог быть получен не полностью: время синхронизации не изменяется
+	if synced := s.proxy.store.CallLogSynced("test"); synced != 0 {
+		t.Errorf("call log synced = %d, want 0", synced)
+	}
+	// и следующая синхронизация запрашивает лог заново
+	s.mx.AddCallLog("test", testCallLog(CallLogPageSize*2+1, 1)...)
+	page = new(callLogPage)
+	s.request("GET", "/calls", nil, http.StatusOK, page)
+	if len(page.CallLog) != CallLogPageSize*2+1 {
+		t.Errorf("calls = %d, want %d", len(page.CallLog), CallLogPageSize*2+1)
+	}
+	if synced := s.proxy.store.CallLogSynced("test"); synced !=
+		int64(1500000000+CallLogPageSize*2+1) {
+		t.Errorf("call log synced = %d", synced)
+	}
+}
+
+func TestCallLogEmpty(t *testing.T) {
+	// без записей сервер не отдает ни одного блока
+	var s = newTestService(t, "[callLog]\ntimeout = \"200ms\"\nsyncInterval = \"0s\"")
+	s.login()
+	var page = new(callLogPage)
+	s.request("GET", "/calls", nil, http.StatusOK, page)
+	if len(page.CallLog) != 0 || page.More {
+		t.Errorf("empty call log = %+v", page)
+	}
+}
+
+func TestCallLogSyncInterval(t *testing.T) {
+	var s = newTestService(t, "[callLog]\ntimeout = \"200ms\"\nsyncInterval = \"1h\"")
+	s.mx.AddCallLog("test", testCallLog(1, 3)...)
+	s.login()
+	var page = new(callLogPage)
+	s.request("GET", "/calls", nil, http.StatusOK, page)
+	if len(page.CallLog) != 3 {
+		t.Fatalf("calls = %d, want 3", len(page.CallLog))
+	}
+	// повторный запрос отдается из хранилища без обращения к серверу MX
+	s.mx.AddCallLog("test", testCallLog(4, 1)...)
+	page = new(callLogPage)
+	s.request("GET", "/calls", nil, http.StatusOK, page)
+	if len(page.CallLog) != 3 {
+		t.Errorf("calls = %d, want 3", len(page.CallLog))
+	}
+	var requests int
+	for _, name := range s.mx.Received() {
+		if name == "iq/calllog" {
+			requests++
+		}
+	}
+	if requests != 1 {
+		t.Errorf("call log requests = %d, want 1", requests)
+	}
+}
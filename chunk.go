@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/mdigger/log"
@@ -18,12 +25,16 @@ type Chunks struct {
 	Mimetype  string `json:"mimeType"`  // формат данных
 	Name      string `json:"name"`      // название документа
 	MediaType string `json:"mediaType"` // тип записи
+	Size      int64  `json:"size"`      // размер файла или -1, если не известен
 
 	conn   *mx.Conn    // соединение с сервером
 	chunks chan []byte // канал для передачи содержимого файла
+	first  []byte      // содержимое первого куска
+	tee    io.Writer   // копия получаемых данных
 
-	err error // описание ошибки, если она случилась
-	mu  sync.RWMutex
+	err      error // описание ошибки, если она случилась
+	complete bool  // получен последний кусок файла
+	mu       sync.RWMutex
 
 	done chan struct{} // флаг закрытия канала
 	once sync.Once     // закрытии выполняется только единожды
@@ -37,6 +48,14 @@ func (c *Chunks) Err() error {
 	return err
 }
 
+// Complete возвращает true, если был получен последний кусок файла.
+func (c *Chunks) Complete() bool {
+	c.mu.RLock()
+	var complete = c.complete
+	c.mu.RUnlock()
+	return complete
+}
+
 // Cancel отменяет получение содержимого файла и закрывает канал с данными.
 func (c *Chunks) Cancel() (err error) {
 	c.once.Do(func() {
@@ -64,6 +83,7 @@ func (c *Chunks) Chunks() <-chan []byte {
 	go func() {
 		ctxlog := log.With("id", c.ID)
 		var err error
+		var complete bool
 	loop:
 		for {
 			// запрашиваем  следующий кусочек файла
@@ -88,7 +108,8 @@ func (c *Chunks) Chunks() <-chan []byte {
 			// декодируем содержимое
 			var data = make([]byte, base64.StdEncoding.DecodedLen(
 				len(chunk.MediaContent)))
-			n, err := base64.StdEncoding.Decode(data, chunk.MediaContent)
+			var n int
+			n, err = base64.StdEncoding.Decode(data, chunk.MediaContent)
 			if err != nil {
 				break
 			}
@@ -99,6 +120,7 @@ func (c *Chunks) Chunks() <-chan []byte {
 				ctxlog.Trace("voicemail chunk", "chunk",
 					fmt.Sprintf("%02d/%02d", chunk.Number, chunk.Total))
 				if chunk.Number >= c.Total {
+					complete = true
 					break loop // получили все куски данных
 				}
 			case <-c.done: // отмена передачи данных
@@ -110,6 +132,7 @@ func (c *Chunks) Chunks() <-chan []byte {
 		c.mu.Lock()
 		close(c.chunks) // закрываем канал по окончании
 		c.err = err     // сохраняем ошибку
+		c.complete = complete
 		c.mu.Unlock()
 	}()
 	return c.chunks // возвращаем канал
@@ -124,3 +147,155 @@ type vmChunk struct {
 	Name         string       `xml:"documentName"`
 	MediaContent xml.CharData `xml:"mediaContent"`
 }
+
+// voiceMailSize возвращает размер файла голосовой почты, вычисленный по
+// первому куску данных, или -1, если размер определить не удалось. Все куски,
+// кроме последнего, имеют одинаковый размер, поэтому для файлов в формате WAV
+// размер из заголовка RIFF проверяется на соответствие количеству кусков.
+func voiceMailSize(chunk *vmChunk, data []byte) int64 {
+	if chunk.Total <= 1 {
+		return int64(len(data))
+	}
+	if len(data) >= 12 && string(data[:4]) == "RIFF" &&
+		string(data[8:12]) == "WAVE" {
+		var size = int64(binary.LittleEndian.Uint32(data[4:8])) + 8
+		var chunkSize = int64(len(data))
+		if size > chunkSize*int64(chunk.Total-1) &&
+			size <= chunkSize*int64(chunk.Total) {
+			return size
+		}
+	}
+	return -1
+}
+
+// Tee задает получателя копии всех данных файла при его отдаче с помощью
+// WriteRange или ReadAll.
+func (c *Chunks) Tee(w io.Writer) {
+	c.tee = w
+}
+
+// WriteRange отдает клиенту содержимое файла с позиции start по end
+// включительно. Если end меньше нуля, то файл отдается до конца. Куски,
+// находящиеся после запрошенного диапазона, с сервера MX не запрашиваются.
+func (c *Chunks) WriteRange(w interface{ Write(interface{}) error },
+	done <-chan struct{}, start, end int64) error {
+	var offset int64 // позиция начала текущего куска
+	for data := range c.Chunks() {
+		select {
+		case <-done: // пользователь закрыл соединение
+			c.Cancel() // отменяем загрузку данных
+			return context.Canceled
+		default:
+		}
+		if c.tee != nil {
+			c.tee.Write(data)
+		}
+		var from, to = int64(0), int64(len(data))
+		if start > offset {
+			from = start - offset
+		}
+		if end >= 0 && end+1-offset < to {
+			to = end + 1 - offset
+		}
+		offset += int64(len(data))
+		if from < to {
+			// отдаем кусочек данных пользователю
+			if err := w.Write(data[from:to]); err != nil {
+				c.Cancel()
+				return err
+			}
+		}
+		// оставшиеся куски не нужны
+		if end >= 0 && offset > end {
+			if c.Size < 0 || offset < c.Size {
+				c.Cancel()
+			}
+			return nil
+		}
+	}
+	return c.Err() // все данные благополучно отосланы
+}
+
+// Copy записывает содержимое файла целиком в w по мере его получения.
+func (c *Chunks) Copy(w io.Writer, done <-chan struct{}) error {
+	for data := range c.Chunks() {
+		select {
+		case <-done: // пользователь закрыл соединение
+			c.Cancel()
+			return context.Canceled
+		default:
+		}
+		if c.tee != nil {
+			c.tee.Write(data)
+		}
+		if _, err := w.Write(data); err != nil {
+			c.Cancel()
+			return err
+		}
+	}
+	return c.Err()
+}
+
+// ReadAll возвращает содержимое файла целиком.
+func (c *Chunks) ReadAll(done <-chan struct{}) ([]byte, error) {
+	var buf = bytes.NewBuffer(make([]byte, 0, c.Total*len(c.first)))
+	if err := c.Copy(buf, done); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// errRangeNotSatisfiable возвращается, если запрошенный диапазон находится
+// за пределами файла.
+var errRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+// parseRange разбирает значение заголовка Range и возвращает начало и конец
+// (включительно) запрошенного диапазона. Если заголовок не задан, имеет
+// неверный формат или запрашивает несколько диапазонов, то ok равен false и
+// файл должен быть отдан целиком.
+func parseRange(header string, size int64) (start, end int64, ok bool, err error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return 0, 0, false, nil
+	}
+	var spec = strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	if strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	var i = strings.Index(spec, "-")
+	if i < 0 {
+		return 0, 0, false, nil
+	}
+	var first, last = strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	if first == "" {
+		// запрос последних байт файла
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, errRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true, nil
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	if start >= size {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+	end = size - 1
+	if last != "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < start {
+			return 0, 0, false, nil
+		}
+		if n < end {
+			end = n
+		}
+	}
+	return start, end, true, nil
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"encoding/xml"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/mdigger/mx"
 )
@@ -161,3 +164,245 @@ func (c *MXConn) ConferenceCreateFromCall(id, ocid int64) error {
 	}
 	return nil
 }
+
+// ConferenceParticipant описывает участника конференции.
+type ConferenceParticipant struct {
+	ID     string `xml:"partyId" json:"id"`
+	JID    mx.JID `xml:"jid" json:"jid,string,omitempty"`
+	Name   string `xml:"name" json:"name,omitempty"`
+	Number string `xml:"number" json:"number,omitempty"`
+	Owner  bool   `xml:"owner" json:"owner,omitempty"`
+	Muted  bool   `xml:"muted" json:"muted"`
+	Joined int64  `xml:"-" json:"joined,omitempty"` // время подключения
+}
+
+// conferenceState описывает состав участников конференции, собранный из
+// событий сервера MX.
+type conferenceState struct {
+	conf         *Conference                       // описание конференции
+	locked       bool                              // вход в конференцию закрыт
+	participants map[string]*ConferenceParticipant // участники
+	loaded       bool                              // список получен с сервера
+}
+
+// conferenceRoster описывает состав участников конференций соединения.
+type conferenceRoster struct {
+	confs map[string]*conferenceState
+	mu    sync.Mutex
+}
+
+// conference возвращает состояние конференции, создавая его при
+// необходимости. Должна вызываться при заблокированном списке.
+func (r *conferenceRoster) conference(id string) *conferenceState {
+	if r.confs == nil {
+		r.confs = make(map[string]*conferenceState)
+	}
+	var state = r.confs[id]
+	if state == nil {
+		state = &conferenceState{
+			participants: make(map[string]*ConferenceParticipant),
+		}
+		r.confs[id] = state
+	}
+	return state
+}
+
+// conferenceUpdated сохраняет описание созданной или измененной конференции.
+func (c *MXConn) conferenceUpdated(conf *Conference) {
+	var roster = &c.confs
+	roster.mu.Lock()
+	roster.conference(conf.ID).conf = conf
+	roster.mu.Unlock()
+}
+
+// conferenceDeleted удаляет информацию об участниках удаленной конференции.
+func (c *MXConn) conferenceDeleted(id string) {
+	c.confs.mu.Lock()
+	delete(c.confs.confs, id)
+	c.confs.mu.Unlock()
+}
+
+// conferenceParty изменяет информацию об участнике конференции или удаляет
+// ее, если участник покинул конференцию. Возвращает копию информации об
+// участнике.
+func (c *MXConn) conferenceParty(id string, party *ConferenceParticipant,
+	left bool) *ConferenceParticipant {
+	var roster = &c.confs
+	roster.mu.Lock()
+	defer roster.mu.Unlock()
+	var state = roster.conference(id)
+	var current, ok = state.participants[party.ID]
+	if left {
+		delete(state.participants, party.ID)
+	}
+	if !ok {
+		current = party
+		if !left {
+			current.Joined = time.Now().Unix()
+		}
+	} else {
+		var joined = current.Joined
+		*current = *party
+		current.Joined = joined
+	}
+	if !left {
+		state.participants[party.ID] = current
+	}
+	var result = *current
+	return &result
+}
+
+// conferenceLocked изменяет признак закрытия входа в конференцию.
+func (c *MXConn) conferenceLocked(id string, locked bool) {
+	var roster = &c.confs
+	roster.mu.Lock()
+	roster.conference(id).locked = locked
+	roster.mu.Unlock()
+}
+
+// ConferenceParticipants возвращает список участников конференции,
+// упорядоченный по времени подключения, и признак закрытия входа в нее.
+// Если состав конференции еще не известен, то он запрашивается с сервера MX,
+// а в дальнейшем поддерживается по событиям.
+func (c *MXConn) ConferenceParticipants(id string) (
+	[]*ConferenceParticipant, bool, error) {
+	var roster = &c.confs
+	roster.mu.Lock()
+	var loaded = roster.confs[id] != nil && roster.confs[id].loaded
+	roster.mu.Unlock()
+	if !loaded {
+		resp, err := c.SendWithResponse(&struct {
+			XMLName xml.Name `xml:"GetConfParties"`
+			ID      string   `xml:"confId"`
+		}{
+			ID: id,
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		var result = new(struct {
+			Locked  bool                     `xml:"locked"`
+			Parties []*ConferenceParticipant `xml:"party"`
+		})
+		if err = resp.Decode(result); err != nil {
+			return nil, false, err
+		}
+		roster.mu.Lock()
+		var state = roster.conference(id)
+		var now = time.Now().Unix()
+		for _, party := range result.Parties {
+			if current, ok := state.participants[party.ID]; ok {
+				party.Joined = current.Joined
+			} else {
+				party.Joined = now
+			}
+		}
+		state.participants = make(map[string]*ConferenceParticipant,
+			len(result.Parties))
+		for _, party := range result.Parties {
+			state.participants[party.ID] = party
+		}
+		state.locked = result.Locked
+		state.loaded = true
+		roster.mu.Unlock()
+	}
+	roster.mu.Lock()
+	var state = roster.conference(id)
+	var list = make([]*ConferenceParticipant, 0, len(state.participants))
+	for _, party := range state.participants {
+		var item = *party
+		list = append(list, &item)
+	}
+	var locked = state.locked
+	roster.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Joined == list[j].Joined {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].Joined < list[j].Joined
+	})
+	return list, locked, nil
+}
+
+// ConferenceOwned возвращает true, если пользователь является владельцем
+// конференции.
+func (c *MXConn) ConferenceOwned(id string) (bool, error) {
+	c.confs.mu.Lock()
+	if state := c.confs.confs[id]; state != nil && state.conf != nil {
+		var owned = state.conf.OwnerID == c.JID
+		c.confs.mu.Unlock()
+		return owned, nil
+	}
+	c.confs.mu.Unlock()
+	list, err := c.ConferenceList()
+	if err != nil {
+		return false, err
+	}
+	for _, conf := range list {
+		if conf.ID == id {
+			c.conferenceUpdated(conf)
+			return conf.OwnerID == c.JID, nil
+		}
+	}
+	return false, nil
+}
+
+// ConferenceMute выключает или включает микрофон участника конференции.
+func (c *MXConn) ConferenceMute(id, partyID string, mute bool) error {
+	_, err := c.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"MuteConfParty"`
+		ID      string   `xml:"confId"`
+		PartyID string   `xml:"partyId"`
+		Mute    bool     `xml:"mute"`
+	}{
+		ID:      id,
+		PartyID: partyID,
+		Mute:    mute,
+	})
+	return err
+}
+
+// ConferenceKick отключает участника от конференции.
+func (c *MXConn) ConferenceKick(id, partyID string) error {
+	_, err := c.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"DropConfParty"`
+		ID      string   `xml:"confId"`
+		PartyID string   `xml:"partyId"`
+	}{
+		ID:      id,
+		PartyID: partyID,
+	})
+	return err
+}
+
+// ConferenceLock закрывает или открывает вход в конференцию для новых
+// участников.
+func (c *MXConn) ConferenceLock(id string, lock bool) error {
+	_, err := c.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"LockConf"`
+		ID      string   `xml:"confId"`
+		Lock    bool     `xml:"lock"`
+	}{
+		ID:   id,
+		Lock: lock,
+	})
+	return err
+}
+
+// ConferencePartyEvent описывает событие об изменении состава участников
+// конференции.
+type ConferencePartyEvent struct {
+	Type        string                 `xml:"-" json:"type"`
+	ConfID      string                 `xml:"confId" json:"confId"`
+	Participant *ConferenceParticipant `xml:"-" json:"participant"`
+	Timestamp   int64                  `xml:"-" json:"timestamp"`
+}
+
+// ConferenceLockEvent описывает событие о закрытии или открытии входа в
+// конференцию.
+type ConferenceLockEvent struct {
+	Type      string `xml:"-" json:"type"`
+	ConfID    string `xml:"confId" json:"confId"`
+	Locked    bool   `xml:"locked" json:"locked"`
+	Timestamp int64  `xml:"-" json:"timestamp"`
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/mdigger/mxproxy/mxtest"
+)
+
+// rosterResponse описывает ответ на запрос участников конференции.
+type rosterResponse struct {
+	Conference struct {
+		ID           string                   `json:"id"`
+		Locked       bool                     `json:"locked"`
+		Participants []*ConferenceParticipant `json:"participants"`
+	} `json:"conference"`
+}
+
+// participant возвращает описание участника из события конференции.
+func participant(event map[string]interface{}) map[string]interface{} {
+	party, _ := event["participant"].(map[string]interface{})
+	return party
+}
+
+func TestConferenceRoster(t *testing.T) {
+	var webhook, pushed = webhookRecorder(t)
+	var s = newTestService(t, webhook)
+	s.login()
+	var events = s.events()
+	var created = new(struct {
+		Conference *Conference `json:"conference"`
+	})
+	s.request("POST", "/conferences", url.Values{}, http.StatusOK, created)
+	if created.Conference == nil || created.Conference.ID == "" {
+		t.Fatalf("conference = %+v", created.Conference)
+	}
+	var confID = created.Conference.ID
+	var path = "/conferences/" + confID
+	s.mx.JoinConference(confID, &mxtest.ConferenceParty{ID: "1002",
+		JID: 43884852, Number: "3095", Owner: true})
+	nextEvent(t, events, "ConferenceJoined")
+
+	var roster = new(rosterResponse)
+	s.request("GET", path+"/participants", nil, http.StatusOK, roster)
+	if roster.Conference.ID != confID || roster.Conference.Locked ||
+		len(roster.Conference.Participants) != 1 {
+		t.Fatalf("roster = %+v", roster.Conference)
+	}
+	if party := roster.Conference.Participants[0]; party.ID != "1002" ||
+		!party.Owner || party.Joined == 0 {
+		t.Errorf("participant = %+v", party)
+	}
+	s.request("GET", "/conferences/999/participants", nil,
+		http.StatusNotFound, nil)
+
+	// состав участников поддерживается по событиям
+	s.mx.JoinConference(confID, &mxtest.ConferenceParty{ID: "1003",
+		Number: "+15550001234"})
+	var event = nextEvent(t, events, "ConferenceJoined")
+	if event["confId"] != confID {
+		t.Errorf("joined event = %v", event)
+	}
+	if party := participant(event); party["id"] != "1003" ||
+		party["number"] != "+15550001234" {
+		t.Errorf("joined participant = %v", party)
+	}
+	roster = new(rosterResponse)
+	s.request("GET", path+"/participants", nil, http.StatusOK, roster)
+	if len(roster.Conference.Participants) != 2 ||
+		roster.Conference.Participants[1].ID != "1003" {
+		t.Fatalf("participants = %+v", roster.Conference.Participants)
+	}
+
+	// управление участниками
+	s.request("PUT", path+"/participants/1003/mute", nil, http.StatusOK, nil)
+	var party = participant(nextEvent(t, events, "ConferenceParticipant"))
+	if party["id"] != "1003" || party["muted"] != true {
+		t.Errorf("muted participant = %v", party)
+	}
+	if parties := s.mx.ConferenceParties(confID); !parties[1].Muted {
+		t.Errorf("mx parties after mute = %+v", parties)
+	}
+	s.request("PUT", path+"/participants/1003/unmute", nil, http.StatusOK, nil)
+	party = participant(nextEvent(t, events, "ConferenceParticipant"))
+	if party["muted"] != false {
+		t.Errorf("unmuted participant = %v", party)
+	}
+	s.request("PUT", path+"/participants/1004/mute", nil,
+		http.StatusNotFound, nil)
+
+	s.request("PUT", path+"/lock", nil, http.StatusOK, nil)
+	if event := nextEvent(t, events, "ConferenceLock"); event["confId"] != confID ||
+		event["locked"] != true {
+		t.Errorf("lock event = %v", event)
+	}
+	roster = new(rosterResponse)
+	s.request("GET", path+"/participants", nil, http.StatusOK, roster)
+	if !roster.Conference.Locked || !s.mx.ConferenceLocked(confID) {
+		t.Error("conference not locked")
+	}
+	s.request("DELETE", path+"/lock", nil, http.StatusOK, nil)
+	if event := nextEvent(t, events, "ConferenceLock"); event["locked"] != false {
+		t.Errorf("unlock event = %v", event)
+	}
+
+	s.request("DELETE", path+"/participants/1003", nil, http.StatusOK, nil)
+	if event := nextEvent(t, events, "ConferenceLeft"); event["confId"] != confID {
+		t.Errorf("left event = %v", event)
+	}
+	roster = new(rosterResponse)
+	s.request("GET", path+"/participants", nil, http.StatusOK, roster)
+	if len(roster.Conference.Participants) != 1 {
+		t.Errorf("participants after kick = %+v", roster.Conference.Participants)
+	}
+
+	// чужой конференцией управлять нельзя
+	s.mx.ConferenceEvent("test", "ConfAddEvent", &mxtest.Conference{ID: "999",
+		OwnerID: 43884853})
+	s.request("PUT", "/conferences/999/lock", nil, http.StatusForbidden, nil)
+
+	// изменения состава участников не отправляются на устройства и webhook
+	s.mx.Delivered("test", "79031234567")
+	for _, name := range pushedBefore(t, pushed, "Delivered") {
+		switch name {
+		case "ConferenceJoined", "ConferenceLeft", "ConferenceParticipant",
+			"ConferenceLock":
+			t.Errorf("pushed roster event: %s", name)
+		}
+	}
+}
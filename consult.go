@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/xml"
+
+	"github.com/mdigger/rest"
+)
+
+// callConnection описывает соединение звонка в командах CSTA.
+type callConnection struct {
+	CallID   int64  `xml:"callID"`
+	DeviceID string `xml:"deviceID"`
+}
+
+// ConsultationCallResponse описывает ответ сервера MX на запрос
+// консультационного звонка.
+type ConsultationCallResponse struct {
+	CallID   int64  `xml:"initiatedCall>callID" json:"callId"`
+	DeviceID string `xml:"initiatedCall>deviceID" json:"deviceId"`
+}
+
+// ConsultationCall ставит звонок на удержание и устанавливает новый
+// консультационный звонок на указанный номер. Используется для перевода
+// звонка с предварительным разговором с тем, кому звонок переводится.
+func (c *MXConn) ConsultationCall(callID int64, to string) (
+	*ConsultationCallResponse, error) {
+	resp, err := c.SendWithResponse(&struct {
+		XMLName         xml.Name       `xml:"ConsultationCall"`
+		ExistingCall    callConnection `xml:"existingCall"`
+		ConsultedDevice string         `xml:"consultedDevice"`
+	}{
+		ExistingCall:    callConnection{CallID: callID, DeviceID: c.Ext},
+		ConsultedDevice: to,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result = new(ConsultationCallResponse)
+	if err = resp.Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// TransferedEvent описывает событие о переводе звонка.
+type TransferedEvent struct {
+	Type                string `xml:"-" json:"type"`
+	PrimaryCallID       int64  `xml:"primaryOldCall>callID" json:"primaryCallId"`
+	PrimaryDeviceID     string `xml:"primaryOldCall>deviceID" json:"primaryDeviceId"`
+	SecondaryCallID     int64  `xml:"secondaryOldCall>callID" json:"secondaryCallId"`
+	SecondaryDeviceID   string `xml:"secondaryOldCall>deviceID" json:"secondaryDeviceId"`
+	TransferringDevice  string `xml:"transferringDevice>deviceIdentifier" json:"transferringDevice"`
+	TransferredToDevice string `xml:"transferredToDevice>deviceIdentifier" json:"transferredToDevice"`
+	Cause               string `xml:"cause" json:"cause"`
+	Timestamp           int64  `xml:"-" json:"timestamp"`
+}
+
+// TransferCall завершает перевод звонка: соединяет удерживаемый звонок с
+// активным консультационным звонком, а сам пользователь отключается от них.
+func (c *MXConn) TransferCall(heldCallID, activeCallID int64) (
+	*TransferedEvent, error) {
+	resp, err := c.SendAndWait(&struct {
+		XMLName    xml.Name       `xml:"TransferCall"`
+		HeldCall   callConnection `xml:"heldCall"`
+		ActiveCall callConnection `xml:"activeCall"`
+	}{
+		HeldCall:   callConnection{CallID: heldCallID, DeviceID: c.Ext},
+		ActiveCall: callConnection{CallID: activeCallID, DeviceID: c.Ext},
+	}, "TransferedEvent")
+	if err != nil {
+		return nil, err
+	}
+	var transfered = new(TransferedEvent)
+	if resp != nil {
+		if err := resp.Decode(transfered); err != nil {
+			return nil, err
+		}
+		return transfered, nil
+	}
+	return nil, rest.NewError(400, "empty mx response")
+}
+
+// AlternateCall ставит активный звонок на удержание и снимает с удержания
+// другой звонок, позволяя переключаться между ними.
+func (c *MXConn) AlternateCall(heldCallID, activeCallID int64) error {
+	_, err := c.SendWithResponse(&struct {
+		XMLName    xml.Name       `xml:"AlternateCall"`
+		HeldCall   callConnection `xml:"heldCall"`
+		ActiveCall callConnection `xml:"activeCall"`
+	}{
+		HeldCall:   callConnection{CallID: heldCallID, DeviceID: c.Ext},
+		ActiveCall: callConnection{CallID: activeCallID, DeviceID: c.Ext},
+	})
+	return err
+}
+
+// ReconnectCall сбрасывает активный звонок и снимает с удержания другой
+// звонок. Используется для отмены перевода звонка после консультации.
+func (c *MXConn) ReconnectCall(heldCallID, activeCallID int64) error {
+	_, err := c.SendWithResponse(&struct {
+		XMLName    xml.Name       `xml:"ReconnectCall"`
+		HeldCall   callConnection `xml:"heldCall"`
+		ActiveCall callConnection `xml:"activeCall"`
+	}{
+		HeldCall:   callConnection{CallID: heldCallID, DeviceID: c.Ext},
+		ActiveCall: callConnection{CallID: activeCallID, DeviceID: c.Ext},
+	})
+	return err
+}
+
+// otherCall возвращает идентификатор другого текущего звонка пользователя,
+// если кроме указанного звонка есть ровно один. Используется, когда клиент
+// не указал второй звонок для перевода или переключения.
+func (c *MXConn) otherCall(callID int64) (int64, bool) {
+	var other int64
+	var count int
+	for _, call := range c.ActiveCalls() {
+		if call.CallID != callID {
+			other = call.CallID
+			count++
+		}
+	}
+	return other, count == 1
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// callStates возвращает состояния текущих звонков пользователя.
+func (s *testService) callStates() map[int64]string {
+	s.t.Helper()
+	var states = make(map[int64]string)
+	for _, call := range s.activeCalls() {
+		states[call.CallID] = call.State
+	}
+	return states
+}
+
+func TestConsultationTransfer(t *testing.T) {
+	var s = newTestService(t)
+	s.login()
+	var events = s.events()
+	var callID = s.mx.Delivered("test", "79031234567")
+	s.mx.Established("test", callID, "79031234567")
+	nextEvent(t, events, "Established")
+	var path = "/calls/" + strconv.FormatInt(callID, 10)
+
+	s.request("POST", path+"/consult", url.Values{}, http.StatusBadRequest, nil)
+	// без второго звонка переключаться не на что
+	s.request("POST", path+"/alternate", url.Values{}, http.StatusBadRequest, nil)
+
+	// консультационный звонок ставит исходный звонок на удержание
+	var consult = new(struct {
+		Consultation struct {
+			CallID     int64  `json:"callId"`
+			HeldCallID int64  `json:"heldCallId"`
+			To         string `json:"to"`
+		} `json:"consultation"`
+	})
+	s.request("POST", path+"/consult", url.Values{"to": {"3099"}},
+		http.StatusOK, consult)
+	var consultID = consult.Consultation.CallID
+	if consultID == 0 || consultID == callID ||
+		consult.Consultation.HeldCallID != callID ||
+		consult.Consultation.To != "3099" {
+		t.Fatalf("consultation = %+v", consult.Consultation)
+	}
+	nextEvent(t, events, "HeldEvent")
+	s.mx.Originated("test", consultID, "3099")
+	s.mx.Established("test", consultID, "3099")
+	nextEvent(t, events, "Established")
+	if states := s.callStates(); states[callID] != CallStateHeld ||
+		states[consultID] != CallStateConnected {
+		t.Fatalf("call states after consult = %v", states)
+	}
+
+	// активный звонок определяется автоматически
+	var alternate = new(struct {
+		Alternate struct {
+			HeldCallID   int64 `json:"heldCallId"`
+			ActiveCallID int64 `json:"activeCallId"`
+		} `json:"alternate"`
+	})
+	s.request("POST", path+"/alternate", url.Values{}, http.StatusOK, alternate)
+	if alternate.Alternate.HeldCallID != consultID ||
+		alternate.Alternate.ActiveCallID != callID {
+		t.Errorf("alternate = %+v", alternate.Alternate)
+	}
+	nextEvent(t, events, "RetrievedEvent")
+	if states := s.callStates(); states[callID] != CallStateConnected ||
+		states[consultID] != CallStateHeld {
+		t.Fatalf("call states after alternate = %v", states)
+	}
+	// и может быть указан явно
+	var consultPath = "/calls/" + strconv.FormatInt(consultID, 10)
+	s.request("POST", consultPath+"/alternate", url.Values{
+		"activeCallId": {strconv.FormatInt(callID, 10)}}, http.StatusOK, nil)
+	nextEvent(t, events, "RetrievedEvent")
+	if states := s.callStates(); states[callID] != CallStateHeld ||
+		states[consultID] != CallStateConnected {
+		t.Fatalf("call states after second alternate = %v", states)
+	}
+
+	// отмена перевода сбрасывает консультационный звонок
+	s.request("POST", path+"/reconnect", url.Values{}, http.StatusOK, nil)
+	nextEvent(t, events, "RetrievedEvent")
+	if states := s.callStates(); len(states) != 1 ||
+		states[callID] != CallStateConnected {
+		t.Fatalf("call states after reconnect = %v", states)
+	}
+
+	// перевод после повторной консультации
+	consult = new(struct {
+		Consultation struct {
+			CallID     int64  `json:"callId"`
+			HeldCallID int64  `json:"heldCallId"`
+			To         string `json:"to"`
+		} `json:"consultation"`
+	})
+	s.request("POST", path+"/consult", url.Values{"to": {"3099"}},
+		http.StatusOK, consult)
+	consultID = consult.Consultation.CallID
+	nextEvent(t, events, "HeldEvent")
+	s.mx.Originated("test", consultID, "3099")
+	nextEvent(t, events, "Originated")
+	s.request("POST", path+"/transfer/complete", url.Values{
+		"activeCallId": {strconv.FormatInt(callID, 10)}},
+		http.StatusBadRequest, nil)
+	var transfer = new(struct {
+		Transfered *TransferedEvent `json:"transfered"`
+	})
+	s.request("POST", path+"/transfer/complete", url.Values{
+		"activeCallId": {strconv.FormatInt(consultID, 10)}},
+		http.StatusOK, transfer)
+	if event := transfer.Transfered; event == nil || event.Type != "Transfered" ||
+		event.PrimaryCallID != callID || event.SecondaryCallID != consultID ||
+		event.TransferringDevice != "3095" {
+		t.Fatalf("transfered = %+v", transfer.Transfered)
+	}
+	nextEvent(t, events, "Transfered")
+	// пользователь больше не участвует в переведенных звонках
+	if states := s.callStates(); len(states) != 0 {
+		t.Errorf("call states after transfer = %v", states)
+	}
+}
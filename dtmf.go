@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Параметры отправки тоновых сигналов DTMF.
+var (
+	DTMFPause    = time.Second      // пауза, задаваемая символом ','
+	DTMFMaxPause = time.Second * 10 // суммарная длительность пауз
+)
+
+// DTMFMaxLength задает максимальную длину строки с тоновыми сигналами.
+const DTMFMaxLength = 64
+
+// parseDTMF проверяет строку с тоновыми сигналами и разбивает ее на части,
+// которые отправляются с паузой между ними. Допускаются цифры, '*', '#' и
+// 'A'-'D', а символ ',' задает паузу. Пустая часть означает дополнительную
+// паузу.
+func parseDTMF(digits string) ([]string, error) {
+	digits = strings.ToUpper(strings.TrimSpace(digits))
+	if strings.Trim(digits, ",") == "" {
+		return nil, errors.New("digits required")
+	}
+	if len(digits) > DTMFMaxLength {
+		return nil, errors.New("too many digits")
+	}
+	for _, r := range digits {
+		if !strings.ContainsRune("0123456789*#ABCD,", r) {
+			return nil, errors.New("bad digit: " + string(r))
+		}
+	}
+	var parts = strings.Split(digits, ",")
+	if time.Duration(len(parts)-1)*DTMFPause > DTMFMaxPause {
+		return nil, errors.New("pauses too long")
+	}
+	return parts, nil
+}
+
+// GenerateDigits отправляет в установленный звонок тоновые сигналы DTMF.
+func (c *MXConn) GenerateDigits(callID int64, digits string) error {
+	_, err := c.SendWithResponse(&struct {
+		XMLName  xml.Name `xml:"GenerateDigits"`
+		CallID   int64    `xml:"connectionToSendDigits>callID"`
+		DeviceID string   `xml:"connectionToSendDigits>deviceID"`
+		Digits   string   `xml:"charactersToSend"`
+	}{
+		CallID:   callID,
+		DeviceID: c.Ext,
+		Digits:   digits,
+	})
+	return err
+}
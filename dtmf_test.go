@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdigger/mxproxy/mxtest"
+)
+
+func TestParseDTMF(t *testing.T) {
+	for _, test := range []struct {
+		digits string
+		parts  []string
+		err    bool
+	}{
+		{digits: "123#", parts: []string{"123#"}},
+		{digits: " 1a*d ", parts: []string{"1A*D"}},
+		{digits: "1,,2#", parts: []string{"1", "", "2#"}},
+		{digits: ",1", parts: []string{"", "1"}},
+		{digits: "", err: true},
+		{digits: ",,", err: true},
+		{digits: "12e", err: true},
+		{digits: "1 2", err: true},
+		{digits: "1,,,,,,,,,,,2", err: true},
+		{digits: string(make([]byte, DTMFMaxLength+1)), err: true},
+	} {
+		parts, err := parseDTMF(test.digits)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: error expected", test.digits)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.digits, err)
+			continue
+		}
+		if len(parts) != len(test.parts) {
+			t.Errorf("%q: parts = %q, want %q", test.digits, parts, test.parts)
+			continue
+		}
+		for i := range parts {
+			if parts[i] != test.parts[i] {
+				t.Errorf("%q: parts = %q, want %q", test.digits, parts, test.parts)
+				break
+			}
+		}
+	}
+}
+
+func TestSendDigits(t *testing.T) {
+	var pause = DTMFPause
+	DTMFPause = time.Millisecond * 10
+	defer func() { DTMFPause = pause }()
+	var s = newTestService(t)
+	var sent []string
+	var mu sync.Mutex
+	s.mx.Handle("GenerateDigits", func(session *mxtest.Session, req *mxtest.Request) {
+		var cmd = new(struct {
+			Digits string `xml:"charactersToSend"`
+		})
+		req.Decode(cmd)
+		mu.Lock()
+		sent = append(sent, cmd.Digits)
+		mu.Unlock()
+		session.Reply(req, "<GenerateDigitsResponse/>")
+	})
+	s.login()
+	var events = s.events()
+	var callID = s.mx.Delivered("test", "79031234567")
+	nextEvent(t, events, "Delivered")
+	var path = "/calls/" + strconv.FormatInt(callID, 10) + "/dtmf"
+	var digits = url.Values{"digits": {"12,,#"}}
+
+	s.request("POST", "/calls/1/dtmf", digits, http.StatusNotFound, nil)
+	// на звонок еще не ответили
+	s.request("POST", path, digits, http.StatusConflict, nil)
+	s.mx.Established("test", callID, "79031234567")
+	nextEvent(t, events, "Established")
+	s.request("POST", path, url.Values{"digits": {"1x"}},
+		http.StatusBadRequest, nil)
+	var result = new(struct {
+		DTMF struct {
+			CallID int64  `json:"callId"`
+			Digits string `json:"digits"`
+		} `json:"dtmf"`
+	})
+	s.request("POST", path, digits, http.StatusOK, result)
+	if result.DTMF.CallID != callID || result.DTMF.Digits != "12,,#" {
+		t.Errorf("dtmf = %+v", result.DTMF)
+	}
+	mu.Lock()
+	if len(sent) != 2 || sent[0] != "12" || sent[1] != "#" {
+		t.Errorf("sent digits = %q", sent)
+	}
+	sent = nil
+	mu.Unlock()
+	// в удерживаемый звонок сигналы не отправляются
+	s.request("PUT", "/calls/"+strconv.FormatInt(callID, 10)+"/hold", nil,
+		http.StatusOK, nil)
+	nextEvent(t, events, "HeldEvent")
+	s.request("POST", path, digits, http.StatusConflict, nil)
+	mu.Lock()
+	if len(sent) != 0 {
+		t.Errorf("digits sent to held call: %q", sent)
+	}
+	mu.Unlock()
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/rest"
+)
+
+// Параметры потока событий пользователя.
+var (
+	EventsHistorySize = 100              // количество событий для возобновления
+	EventsBufferSize  = 32               // размер буфера событий подписчика
+	EventsKeepAlive   = time.Second * 30 // интервал проверки соединения
+)
+
+// Event описывает событие, отправляемое подписчикам потока.
+type Event struct {
+	ID   uint64          // порядковый номер события
+	Data json.RawMessage // событие в формате JSON
+}
+
+// eventSubscriber описывает подписчика на поток событий пользователя.
+type eventSubscriber struct {
+	events chan *Event // канал для передачи событий
+}
+
+// eventStream описывает поток событий одного пользователя.
+type eventStream struct {
+	seq     uint64                        // номер последнего события
+	history []*Event                      // последние события для возобновления
+	subs    map[*eventSubscriber]struct{} // активные подписчики
+}
+
+// Events осуществляет рассылку событий всем активным подписчикам
+// пользователя: Server-Sent Events и WebSocket.
+type Events struct {
+	streams map[string]*eventStream // потоки событий пользователей
+	mu      sync.Mutex
+}
+
+// NewEvents возвращает инициализированный сервис рассылки событий.
+func NewEvents() *Events {
+	return &Events{streams: make(map[string]*eventStream)}
+}
+
+// Publish отсылает событие всем подписчикам пользователя и сохраняет его в
+// истории для возобновления потока.
+func (e *Events) Publish(login string, obj interface{}) {
+	var data []byte
+	switch obj := obj.(type) {
+	case []byte:
+		data = obj
+	case string:
+		data = []byte(obj)
+	case json.RawMessage:
+		data = []byte(obj)
+	default:
+		var err error
+		if data, err = json.Marshal(obj); err != nil {
+			log.Error("event to json error", "error", err)
+			return
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var stream = e.streams[login]
+	if stream == nil {
+		stream = &eventStream{subs: make(map[*eventSubscriber]struct{})}
+		e.streams[login] = stream
+	}
+	stream.seq++
+	var event = &Event{ID: stream.seq, Data: data}
+	// сохраняем в истории, удаляя самые старые события
+	stream.history = append(stream.history, event)
+	if len(stream.history) > EventsHistorySize {
+		stream.history = stream.history[len(stream.history)-EventsHistorySize:]
+	}
+	for sub := range stream.subs {
+		select {
+		case sub.events <- event:
+		default:
+			// подписчик не успевает забирать события: отключаем его, чтобы он
+			// переподключился и получил пропущенные события из истории
+			delete(stream.subs, sub)
+			close(sub.events)
+			log.Warn("slow event subscriber disconnected", "login", login)
+		}
+	}
+}
+
+// Subscribe регистрирует нового подписчика пользователя и возвращает его
+// вместе со списком событий, пропущенных после события с номером lastID. Если
+// resume не установлен, то пропущенные события не возвращаются.
+func (e *Events) Subscribe(login string, lastID uint64, resume bool) (
+	*eventSubscriber, []*Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var stream = e.streams[login]
+	if stream == nil {
+		stream = &eventStream{subs: make(map[*eventSubscriber]struct{})}
+		e.streams[login] = stream
+	}
+	var sub = &eventSubscriber{events: make(chan *Event, EventsBufferSize)}
+	stream.subs[sub] = struct{}{}
+	if !resume {
+		return sub, nil
+	}
+	// номер больше текущего бывает после перезапуска сервиса: в этом случае
+	// отдаем всю сохраненную историю
+	if lastID > stream.seq {
+		lastID = 0
+	}
+	var missed []*Event
+	for _, event := range stream.history {
+		if event.ID > lastID {
+			missed = append(missed, event)
+		}
+	}
+	return sub, missed
+}
+
+// Unsubscribe удаляет подписчика пользователя.
+func (e *Events) Unsubscribe(login string, sub *eventSubscriber) {
+	e.mu.Lock()
+	if stream := e.streams[login]; stream != nil {
+		if _, ok := stream.subs[sub]; ok {
+			delete(stream.subs, sub)
+			close(sub.events)
+		}
+	}
+	e.mu.Unlock()
+}
+
+// Remove отключает всех подписчиков пользователя и удаляет историю его
+// событий.
+func (e *Events) Remove(login string) {
+	e.mu.Lock()
+	if stream := e.streams[login]; stream != nil {
+		for sub := range stream.subs {
+			close(sub.events)
+		}
+		delete(e.streams, login)
+	}
+	e.mu.Unlock()
+}
+
+// Close отключает всех подписчиков.
+func (e *Events) Close() {
+	e.mu.Lock()
+	for login, stream := range e.streams {
+		for sub := range stream.subs {
+			close(sub.events)
+		}
+		delete(e.streams, login)
+	}
+	e.mu.Unlock()
+}
+
+// Subscribers возвращает количество активных подписчиков пользователя.
+func (e *Events) Subscribers(login string) int {
+	e.mu.Lock()
+	var count int
+	if stream := e.streams[login]; stream != nil {
+		count = len(stream.subs)
+	}
+	e.mu.Unlock()
+	return count
+}
+
+// Events отдает поток событий пользователя в формате Server-Sent Events или
+// через WebSocket, если запрошено изменение протокола.
+func (p *Proxy) Events(c *rest.Context) error {
+	// EventSource в браузере не позволяет задать заголовок авторизации,
+	// поэтому допускаем передачу токена в параметрах запроса
+	if c.Header("Authorization") == "" {
+		if token := c.Query("access_token"); token != "" {
+			c.Request.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	// номер последнего полученного события для возобновления потока
+	var lastEventID = c.Header("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+	var lastID uint64
+	if lastEventID != "" {
+		if lastID, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			return c.Error(http.StatusBadRequest, "bad last event id")
+		}
+	}
+	if strings.EqualFold(c.Header("Upgrade"), "websocket") {
+		return p.eventsWebSocket(c, conn.Login, lastID, lastEventID != "")
+	}
+	// отключаем ограничение времени на отдачу ответа для потока
+	if err = http.NewResponseController(c.Response).
+		SetWriteDeadline(time.Time{}); err != nil {
+		log.Debug("events write deadline", "error", err)
+	}
+	flusher, ok := c.Response.(http.Flusher)
+	if !ok {
+		return c.Error(http.StatusInternalServerError, "streaming unsupported")
+	}
+	c.SetHeader("Content-Type", "text/event-stream")
+	c.SetHeader("Cache-Control", "no-cache")
+	c.SetHeader("X-Accel-Buffering", "no")
+	// разрешаем отдавать ответ кусочками
+	c.AllowMultiple = true
+	sub, missed := p.events.Subscribe(conn.Login, lastID, lastEventID != "")
+	defer p.events.Unsubscribe(conn.Login, sub)
+	c.AddLogField("subscribers", p.events.Subscribers(conn.Login))
+	// задаем интервал переподключения и отдаем пропущенные события
+	if err = c.Write([]byte("retry: 3000\n\n")); err != nil {
+		return err
+	}
+	for _, event := range missed {
+		if err = c.Write(sseEvent(event)); err != nil {
+			return err
+		}
+	}
+	flusher.Flush()
+	var (
+		done      = c.Request.Context().Done()
+		keepAlive = time.NewTicker(EventsKeepAlive)
+	)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-done: // пользователь закрыл соединение
+			return nil
+		case event, ok := <-sub.events:
+			if !ok {
+				return nil // подписка отменена
+			}
+			if err = c.Write(sseEvent(event)); err != nil {
+				return err
+			}
+		case <-keepAlive.C:
+			if err = c.Write([]byte(": ping\n\n")); err != nil {
+				return err
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// sseEvent возвращает событие в формате Server-Sent Events.
+func sseEvent(event *Event) []byte {
+	return []byte(fmt.Sprintf("id: %d\ndata: %s\n\n", event.ID, event.Data))
+}
+
+// eventsWebSocket отдает поток событий пользователя через WebSocket.
+func (p *Proxy) eventsWebSocket(c *rest.Context, login string, lastID uint64,
+	resume bool) error {
+	ws, err := wsUpgrade(c.Response, c.Request)
+	if err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	defer ws.Close()
+	sub, missed := p.events.Subscribe(login, lastID, resume)
+	defer p.events.Unsubscribe(login, sub)
+	ctxlog := log.With("login", login)
+	ctxlog.Debug("websocket events connected")
+	defer ctxlog.Debug("websocket events disconnected")
+	// читаем сообщения клиента, чтобы отвечать на служебные запросы и
+	// отслеживать закрытие соединения
+	var closed = make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	var send = func(event *Event) error {
+		data, err := json.Marshal(&struct {
+			ID   string          `json:"id"`
+			Data json.RawMessage `json:"data"`
+		}{
+			ID:   strconv.FormatUint(event.ID, 10),
+			Data: event.Data,
+		})
+		if err != nil {
+			return err
+		}
+		return ws.WriteMessage(wsText, data)
+	}
+	for _, event := range missed {
+		if err = send(event); err != nil {
+			return nil
+		}
+	}
+	var keepAlive = time.NewTicker(EventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-closed: // клиент закрыл соединение
+			return nil
+		case event, ok := <-sub.events:
+			if !ok {
+				ws.WriteMessage(wsClose, nil)
+				return nil // подписка отменена
+			}
+			if err = send(event); err != nil {
+				return nil
+			}
+		case <-keepAlive.C:
+			if err = ws.WriteMessage(wsPing, nil); err != nil {
+				return nil
+			}
+		}
+	}
+}
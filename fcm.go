@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	app "github.com/mdigger/app-info"
+	"github.com/mdigger/log"
+)
+
+// Адреса сервисов Firebase Cloud Messaging. Могут быть переопределены в
+// конфигурации, например, для проверки с локальной заменой сервиса.
+var (
+	FCMURL      = "https://fcm.googleapis.com" // адрес отправки сообщений
+	FCMTokenURL = ""                           // адрес получения токенов
+	fcmScope    = "https://www.googleapis.com/auth/firebase.messaging"
+	fcmTokenURL = "https://oauth2.googleapis.com/token" // адрес по умолчанию
+)
+
+// fcmAccount описывает сервисный аккаунт Google для отправки сообщений через
+// Firebase Cloud Messaging HTTP v1 API.
+type fcmAccount struct {
+	projectID   string          // идентификатор проекта
+	clientEmail string          // идентификатор сервисного аккаунта
+	key         *rsa.PrivateKey // ключ для подписи запроса токена
+	tokenURL    string          // адрес получения токенов
+	token       string          // текущий токен доступа OAuth2
+	expires     time.Time       // время окончания действия токена
+	mu          sync.Mutex
+}
+
+// LoadFCMAccount загружает описание сервисного аккаунта Google из файла JSON.
+func LoadFCMAccount(filename string) (*fcmAccount, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config = new(struct {
+		Type        string `json:"type"`
+		ProjectID   string `json:"project_id"`
+		PrivateKey  string `json:"private_key"`
+		ClientEmail string `json:"client_email"`
+		TokenURI    string `json:"token_uri"`
+	})
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if config.Type != "service_account" || config.ProjectID == "" ||
+		config.ClientEmail == "" {
+		return nil, errors.New("bad google service account file")
+	}
+	block, _ := pem.Decode([]byte(config.PrivateKey))
+	if block == nil {
+		return nil, errors.New("bad google service account private key")
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := privateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("google service account key is not RSA key")
+	}
+	// адрес получения токенов из конфигурации имеет приоритет
+	var tokenURL = FCMTokenURL
+	if tokenURL == "" {
+		tokenURL = config.TokenURI
+	}
+	if tokenURL == "" {
+		tokenURL = fcmTokenURL
+	}
+	return &fcmAccount{
+		projectID:   config.ProjectID,
+		clientEmail: config.ClientEmail,
+		key:         rsaKey,
+		tokenURL:    tokenURL,
+	}, nil
+}
+
+// Token возвращает токен доступа OAuth2 для отправки сообщений. Токен
+// кешируется до окончания срока его действия.
+func (a *fcmAccount) Token() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// обновляем токен заранее, за минуту до окончания его действия
+	if a.token != "" && time.Now().Add(time.Minute).Before(a.expires) {
+		return a.token, nil
+	}
+	assertion, err := a.assertion()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", a.tokenURL, strings.NewReader(
+		url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", app.Agent)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := fcmClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("google oauth2 token error: " + resp.Status)
+	}
+	var result = new(struct {
+		Token   string `json:"access_token"`
+		Expires int64  `json:"expires_in"`
+	})
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return "", err
+	}
+	if result.Token == "" {
+		return "", errors.New("google oauth2 empty token")
+	}
+	a.token = result.Token
+	a.expires = time.Now().Add(time.Duration(result.Expires) * time.Second)
+	log.Debug("google oauth2 token", "project", a.projectID,
+		"expires", a.expires.Format(time.RFC3339))
+	return a.token, nil
+}
+
+// Reset сбрасывает закешированный токен доступа.
+func (a *fcmAccount) Reset() {
+	a.mu.Lock()
+	a.token = ""
+	a.mu.Unlock()
+}
+
+// assertion возвращает подписанный JWT для запроса токена доступа.
+func (a *fcmAccount) assertion() (string, error) {
+	var now = time.Now()
+	header, err := json.Marshal(&struct {
+		Alg string `json:"alg"`
+		Typ string `json:"typ"`
+	}{
+		Alg: "RS256",
+		Typ: "JWT",
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(&struct {
+		Issuer   string `json:"iss"`
+		Scope    string `json:"scope"`
+		Audience string `json:"aud"`
+		Issued   int64  `json:"iat"`
+		Expires  int64  `json:"exp"`
+	}{
+		Issuer:   a.clientEmail,
+		Scope:    fcmScope,
+		Audience: a.tokenURL,
+		Issued:   now.Unix(),
+		Expires:  now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	var unsigned = base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+	var hash = sha256.Sum256([]byte(unsigned))
+	sign, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sign), nil
+}
+
+// fcmReservedPrefix добавляется к названиям полей данных уведомления,
+// зарезервированным FCM.
+const fcmReservedPrefix = "mx_"
+
+// fcmReservedKey возвращает true, если название поля зарезервировано FCM и не
+// может использоваться в данных сообщения.
+func fcmReservedKey(name string) bool {
+	switch name {
+	case "from", "notification", "message_type":
+		return true
+	}
+	return strings.HasPrefix(name, "google") || strings.HasPrefix(name, "gcm")
+}
+
+// fcmData преобразует данные уведомления в формат, поддерживаемый FCM HTTP v1:
+// все значения должны быть строками, поэтому вложенные объекты и числа
+// передаются в виде JSON. К названиям полей, зарезервированным FCM (например,
+// from), добавляется префикс fcmReservedPrefix.
+func fcmData(obj interface{}) (map[string]string, error) {
+	var data []byte
+	switch obj := obj.(type) {
+	case []byte:
+		data = obj
+	case string:
+		data = []byte(obj)
+	case json.RawMessage:
+		data = []byte(obj)
+	default:
+		var err error
+		if data, err = json.Marshal(obj); err != nil {
+			return nil, err
+		}
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	var result = make(map[string]string, len(fields))
+	for name, value := range fields {
+		if fcmReservedKey(name) {
+			name = fcmReservedPrefix + name
+		}
+		var str string
+		if err := json.Unmarshal(value, &str); err == nil {
+			result[name] = str
+		} else {
+			result[name] = string(value)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"io"
+)
+
+// FLACBlockSize задает количество отсчетов в одном блоке FLAC.
+var FLACBlockSize = 4096
+
+// flacEncoder кодирует 16-битные отсчеты в формат FLAC без потерь. Для
+// сжатия используются фиксированные предсказатели и кодирование остатков
+// кодами Райса с разбиением на части. Контрольная сумма MD5 исходных данных
+// не вычисляется, а при неизвестном количестве отсчетов оно не указывается,
+// что допускается форматом.
+type flacEncoder struct {
+	w        io.Writer
+	channels int
+	rate     int
+	block    [][]int32 // отсчеты текущего блока по каналам
+	frame    uint64    // номер следующего блока
+	bits     bitWriter
+	residual []int32
+}
+
+// newFLACEncoder возвращает кодировщик в формат FLAC и записывает заголовок
+// потока.
+func newFLACEncoder(w io.Writer, channels, rate int, total int64) *flacEncoder {
+	var e = &flacEncoder{
+		w:        w,
+		channels: channels,
+		rate:     rate,
+		block:    make([][]int32, channels),
+	}
+	for ch := range e.block {
+		e.block[ch] = make([]int32, 0, FLACBlockSize)
+	}
+	if total < 0 {
+		total = 0 // количество отсчетов не известно
+	}
+	var b = &e.bits
+	b.buf = append(b.buf[:0], "fLaC"...)
+	b.writeBits(1, 1)   // последний блок метаданных
+	b.writeBits(0, 7)   // STREAMINFO
+	b.writeBits(34, 24) // размер блока
+	b.writeBits(uint64(FLACBlockSize), 16)
+	b.writeBits(uint64(FLACBlockSize), 16)
+	b.writeBits(0, 24) // минимальный размер фрейма не известен
+	b.writeBits(0, 24) // максимальный размер фрейма не известен
+	b.writeBits(uint64(rate), 20)
+	b.writeBits(uint64(channels-1), 3)
+	b.writeBits(16-1, 5)
+	b.writeBits(uint64(total), 36)
+	for i := 0; i < 4; i++ {
+		b.writeBits(0, 32) // MD5 не вычисляется
+	}
+	return e
+}
+
+// WriteSamples добавляет отсчеты и кодирует заполненные блоки.
+func (e *flacEncoder) WriteSamples(samples []int16) error {
+	for i := 0; i+e.channels <= len(samples); i += e.channels {
+		for ch := range e.block {
+			e.block[ch] = append(e.block[ch], int32(samples[i+ch]))
+		}
+		if len(e.block[0]) == FLACBlockSize {
+			if err := e.writeFrame(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close кодирует последний неполный блок.
+func (e *flacEncoder) Close() error {
+	if len(e.block[0]) > 0 {
+		return e.writeFrame()
+	}
+	if len(e.bits.buf) > 0 { // отсчетов не было: только заголовок
+		_, err := e.w.Write(e.bits.buf)
+		e.bits.buf = e.bits.buf[:0]
+		return err
+	}
+	return nil
+}
+
+// Коды частоты дискретизации в заголовке фрейма.
+var flacRateCodes = map[int]uint64{
+	8000: 4, 16000: 5, 22050: 6, 24000: 7, 32000: 8, 44100: 9, 48000: 10,
+}
+
+// writeFrame кодирует текущий блок отсчетов и записывает его.
+func (e *flacEncoder) writeFrame() error {
+	var b = &e.bits
+	var size = len(e.block[0])
+	var start = len(b.buf)  // перед фреймом может быть заголовок потока
+	b.writeBits(0xFFF8, 16) // синхронизация и фиксированный размер блоков
+	b.writeBits(7, 4)       // размер блока задан в конце заголовка
+	b.writeBits(flacRateCodes[e.rate], 4)
+	b.writeBits(uint64(e.channels-1), 4) // независимые каналы
+	b.writeBits(4, 3)                    // 16 бит на отсчет
+	b.writeBits(0, 1)
+	b.writeUTF8(e.frame)
+	b.writeBits(uint64(size-1), 16)
+	b.buf = append(b.buf, crc8(b.buf[start:]))
+	for _, samples := range e.block {
+		e.writeSubframe(samples)
+	}
+	b.align()
+	var crc = crc16(b.buf[start:])
+	b.buf = append(b.buf, byte(crc>>8), byte(crc))
+	_, err := e.w.Write(b.buf)
+	b.buf = b.buf[:0]
+	for ch := range e.block {
+		e.block[ch] = e.block[ch][:0]
+	}
+	e.frame++
+	return err
+}
+
+// writeSubframe кодирует отсчеты одного канала, выбирая наиболее компактный
+// способ.
+func (e *flacEncoder) writeSubframe(samples []int32) {
+	var b = &e.bits
+	// все отсчеты одинаковые
+	var constant = true
+	for _, v := range samples[1:] {
+		if v != samples[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		b.writeBits(0, 8) // CONSTANT
+		b.writeBits(uint64(uint16(samples[0])), 16)
+		return
+	}
+	// выбираем порядок предсказателя с наименьшей суммой остатков
+	var order, best = -1, uint64(0)
+	for o := 0; o <= 4 && o < len(samples); o++ {
+		var sum uint64
+		for _, r := range fixedResidual(samples, o, e.residual[:0]) {
+			sum += uint64(abs32(r))
+		}
+		if order < 0 || sum < best {
+			order, best = o, sum
+		}
+	}
+	e.residual = fixedResidual(samples, order, e.residual[:0])
+	var partitions, params, cost = riceParams(e.residual, len(samples), order)
+	// если сжатие не удалось, то сохраняем отсчеты как есть
+	if cost+uint64(order*16) >= uint64(len(samples)*16) {
+		b.writeBits(1<<1, 8) // VERBATIM
+		for _, v := range samples {
+			b.writeBits(uint64(uint16(v)), 16)
+		}
+		return
+	}
+	b.writeBits(uint64(8|order)<<1, 8) // FIXED
+	for _, v := range samples[:order] {
+		b.writeBits(uint64(uint16(v)), 16)
+	}
+	b.writeBits(0, 2) // параметры Райса по 4 бита
+	b.writeBits(uint64(partitions), 4)
+	var residual = e.residual
+	for i, k := range params {
+		var n = len(samples) >> uint(partitions)
+		if i == 0 {
+			n -= order
+		}
+		b.writeBits(uint64(k), 4)
+		for _, r := range residual[:n] {
+			b.writeRice(zigzag(r), k)
+		}
+		residual = residual[n:]
+	}
+}
+
+// fixedResidual возвращает остатки фиксированного предсказателя указанного
+// порядка.
+func fixedResidual(x []int32, order int, res []int32) []int32 {
+	for i := order; i < len(x); i++ {
+		var r int32
+		switch order {
+		case 0:
+			r = x[i]
+		case 1:
+			r = x[i] - x[i-1]
+		case 2:
+			r = x[i] - 2*x[i-1] + x[i-2]
+		case 3:
+			r = x[i] - 3*x[i-1] + 3*x[i-2] - x[i-3]
+		case 4:
+			r = x[i] - 4*x[i-1] + 6*x[i-2] - 4*x[i-3] + x[i-4]
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// riceParams подбирает порядок разбиения остатков на части и параметры Райса
+// для каждой части. Возвращает порядок разбиения, параметры и размер
+// закодированных остатков в битах.
+func riceParams(residual []int32, size, order int) (int, []uint, uint64) {
+	var (
+		bestOrder  int
+		bestParams []uint
+		bestCost   uint64
+	)
+	for p := 0; p <= 8; p++ {
+		var parts = 1 << uint(p)
+		if size%parts != 0 || size/parts <= order {
+			break
+		}
+		var params = make([]uint, parts)
+		var cost = uint64(4 + 4*parts)
+		var rest = residual
+		for i := range params {
+			var n = size / parts
+			if i == 0 {
+				n -= order
+			}
+			var k, bits = riceParam(rest[:n])
+			params[i] = k
+			cost += bits
+			rest = rest[n:]
+		}
+		if bestParams == nil || cost < bestCost {
+			bestOrder, bestParams, bestCost = p, params, cost
+		}
+	}
+	return bestOrder, bestParams, bestCost
+}
+
+// riceParam возвращает оптимальный параметр Райса для остатков и размер
+// закодированных остатков в битах.
+func riceParam(residual []int32) (uint, uint64) {
+	var bestK uint
+	var best uint64
+	for k := uint(0); k < 15; k++ {
+		var bits = uint64(len(residual)) * uint64(k+1)
+		for _, r := range residual {
+			bits += uint64(zigzag(r) >> k)
+		}
+		if k == 0 || bits < best {
+			bestK, best = k, bits
+		}
+	}
+	return bestK, best
+}
+
+// zigzag отображает знаковое значение в беззнаковое.
+func zigzag(v int32) uint32 {
+	return uint32(v<<1) ^ uint32(v>>31)
+}
+
+// abs32 возвращает модуль значения.
+func abs32(v int32) int32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// bitWriter формирует последовательность бит.
+type bitWriter struct {
+	buf []byte
+	acc uint64 // неполный байт
+	n   uint   // количество бит в acc
+}
+
+// writeBits записывает младшие bits бит значения (не более 32).
+func (b *bitWriter) writeBits(v uint64, bits uint) {
+	b.acc = b.acc<<bits | v&(1<<bits-1)
+	b.n += bits
+	for b.n >= 8 {
+		b.n -= 8
+		b.buf = append(b.buf, byte(b.acc>>b.n))
+	}
+	b.acc &= 1<<b.n - 1
+}
+
+// writeRice записывает значение кодом Райса с параметром k.
+func (b *bitWriter) writeRice(v uint32, k uint) {
+	for q := v >> k; q > 0; {
+		var n = q
+		if n > 32 {
+			n = 32
+		}
+		b.writeBits(0, uint(n))
+		q -= n
+	}
+	b.writeBits(1, 1)
+	b.writeBits(uint64(v), k)
+}
+
+// writeUTF8 записывает номер фрейма в кодировке, аналогичной UTF-8.
+func (b *bitWriter) writeUTF8(v uint64) {
+	if v < 0x80 {
+		b.writeBits(v, 8)
+		return
+	}
+	var n = uint(2) // количество байт
+	for v >= 1<<(5*n+1) {
+		n++
+	}
+	b.writeBits(0xFF00>>n&0xFF|v>>(6*(n-1)), 8)
+	for i := n - 1; i > 0; i-- {
+		b.writeBits(0x80|v>>(6*(i-1))&0x3F, 8)
+	}
+}
+
+// align дополняет последний байт нулевыми битами.
+func (b *bitWriter) align() {
+	if b.n > 0 {
+		b.writeBits(0, 8-b.n)
+	}
+}
+
+// crc8 вычисляет контрольную сумму заголовка фрейма FLAC.
+func crc8(data []byte) byte {
+	var crc byte
+	for _, v := range data {
+		crc ^= v
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// crc16 вычисляет контрольную сумму фрейма FLAC.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, v := range data {
+		crc ^= uint16(v) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
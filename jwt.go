@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/cipher"
 	"encoding/json"
 	"errors"
 	"strconv"
@@ -21,12 +22,18 @@ type JWTGenerator struct {
 	old     sync.Map      // архив ключей
 	conf    *jwt.Config   // конфигурация для создания токена авторизации
 	remover *time.Timer   // удаление старых ключей
+	store   *Store        // хранилище ключей
+	aead    cipher.AEAD   // шифрование ключей в хранилище
 }
 
 // NewJWTGenerator инициализирует генератор авторизационных токенов. signKeyTTL
 // задает время жизни ключа для подписи токенов, после чего он автоматически
-// меняется. А tokenTTL - время жизни токена авторизации.
-func NewJWTGenerator(tokenTTL, signKeyTTL time.Duration) *JWTGenerator {
+// меняется. А tokenTTL - время жизни токена авторизации. Ключи подписи
+// сохраняются в хранилище в зашифрованном с помощью secret виде и загружаются
+// из него при инициализации, поэтому выданные токены остаются действительными
+// после перезапуска сервиса.
+func NewJWTGenerator(tokenTTL, signKeyTTL time.Duration, store *Store,
+	secret []byte) (*JWTGenerator, error) {
 	var jwtConfig = &JWTGenerator{
 		conf: &jwt.Config{
 			// Issuer:   "https://" + host,
@@ -36,6 +43,18 @@ func NewJWTGenerator(tokenTTL, signKeyTTL time.Duration) *JWTGenerator {
 		},
 		ttl: signKeyTTL,
 	}
+	// загружаем сохраненные ключи
+	if store != nil {
+		aead, err := jwtKeyCipher(secret)
+		if err != nil {
+			return nil, err
+		}
+		jwtConfig.store, jwtConfig.aead = store, aead
+		jwtConfig.loadKeys()
+		if jwtConfig.id != "" {
+			log.Info("token sign key loaded", "id", jwtConfig.id)
+		}
+	}
 	// задаем функцию для отдачи текущего ключа для подписи токенов
 	jwtConfig.conf.Key = jwtConfig.getCurrentKey
 	// запускаем удаление старых ключей
@@ -45,13 +64,16 @@ func NewJWTGenerator(tokenTTL, signKeyTTL time.Duration) *JWTGenerator {
 		jwtConfig.old.Range(func(k, _ interface{}) bool {
 			if k.(string) < now {
 				jwtConfig.old.Delete(k)
+				if jwtConfig.store != nil {
+					jwtConfig.store.RemoveJWTKey(k.(string))
+				}
 				log.Debug("removed old token sign key", "id", k.(string))
 			}
 			return true
 		})
 		jwtConfig.remover.Reset(signKeyTTL)
 	})
-	return jwtConfig
+	return jwtConfig, nil
 }
 
 // Close останавливает удаление старых ключей.
@@ -77,6 +99,7 @@ type TokenDescription struct {
 	Type    string  `json:"token_type,omitempty"`
 	Token   string  `json:"access_token"`
 	Expired float64 `json:"expires_in,omitempty"`
+	Refresh string  `json:"refresh_token,omitempty"`
 }
 
 // getCurrentKey возвращает название и текущий ключ для подписи авторизационных
@@ -96,6 +119,10 @@ func (j *JWTGenerator) getCurrentKey() (string, interface{}) {
 		j.id = id
 		j.mu.Unlock()
 		j.old.Store(id, key) // сохраняем в архиве
+		if err := j.saveKey(id, key); err != nil {
+			log.Error("token sign key store error", "error", err)
+		}
+		metricJWTRotations.Inc()
 		log.Debug("generated new token sign key", "id", id)
 	}
 	return id, key
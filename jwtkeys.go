@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/rest"
+)
+
+// jwtKeyCipher возвращает шифр для хранения ключей подписи токенов. Ключ
+// шифрования вычисляется из секретной строки.
+func jwtKeyCipher(secret []byte) (cipher.AEAD, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("empty jwt keys secret")
+	}
+	var key = sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// LoadJWTSecret возвращает секретную строку для шифрования ключей подписи
+// токенов из указанного файла. Если файл не существует, то он создается со
+// случайной секретной строкой.
+func LoadJWTSecret(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		return data, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	data = make([]byte, 32)
+	if _, err = rand.Read(data); err != nil {
+		return nil, err
+	}
+	data = []byte(base64.RawURLEncoding.EncodeToString(data))
+	if err = ioutil.WriteFile(filename, data, 0600); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// encryptKey возвращает зашифрованный ключ подписи токенов.
+func (j *JWTGenerator) encryptKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	data, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var nonce = make([]byte, j.aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return j.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// decryptKey расшифровывает ключ подписи токенов.
+func (j *JWTGenerator) decryptKey(data []byte) (*ecdsa.PrivateKey, error) {
+	var size = j.aead.NonceSize()
+	if len(data) < size {
+		return nil, errors.New("bad encrypted jwt key")
+	}
+	data, err := j.aead.Open(nil, data[:size], data[size:], nil)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseECPrivateKey(data)
+}
+
+// loadKeys загружает из хранилища ключи подписи токенов, которые еще могут
+// использоваться для проверки токенов, и удаляет устаревшие. Ключи, которые
+// не удалось расшифровать (например, после смены секретной строки),
+// пропускаются: подписанные ими токены становятся недействительными, но
+// сервис продолжает работу. Такие ключи удаляются, когда становятся
+// устаревшими.
+func (j *JWTGenerator) loadKeys() {
+	var obsolete = strconv.FormatInt(
+		time.Now().Add(-j.ttl-j.conf.Expires*2).Unix(), 36)
+	for id, data := range j.store.JWTKeys() {
+		if id < obsolete {
+			j.store.RemoveJWTKey(id)
+			continue
+		}
+		key, err := j.decryptKey(data)
+		if err != nil {
+			log.Error("token sign key load error", "id", id, "error", err)
+			continue
+		}
+		j.old.Store(id, key)
+		// последний созданный ключ становится текущим
+		created, err := strconv.ParseInt(id, 36, 64)
+		if err != nil {
+			continue
+		}
+		if t := time.Unix(created, 0); t.After(j.created) {
+			j.id, j.key, j.created = id, key, t
+		}
+	}
+}
+
+// saveKey сохраняет ключ подписи токенов в хранилище.
+func (j *JWTGenerator) saveKey(id string, key interface{}) error {
+	if j.store == nil {
+		return nil
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return errors.New("unsupported jwt key type")
+	}
+	data, err := j.encryptKey(ecKey)
+	if err != nil {
+		return err
+	}
+	return j.store.AddJWTKey(id, data)
+}
+
+// JWK описывает публичный ключ в формате JSON Web Key.
+type JWK struct {
+	Type      string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+	ID        string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+// JWKS возвращает список публичных ключей для проверки токенов.
+func (j *JWTGenerator) JWKS() []*JWK {
+	var keys = make([]*JWK, 0)
+	j.old.Range(func(id, key interface{}) bool {
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return true
+		}
+		keys = append(keys, &JWK{
+			Type:      "EC",
+			Curve:     "P-256",
+			X:         jwkCoordinate(ecKey.X),
+			Y:         jwkCoordinate(ecKey.Y),
+			ID:        id.(string),
+			Use:       "sig",
+			Algorithm: "ES256",
+		})
+		return true
+	})
+	return keys
+}
+
+// jwkCoordinate возвращает координату точки кривой P-256 в формате JWK.
+func jwkCoordinate(n *big.Int) string {
+	var data = make([]byte, 32)
+	n.FillBytes(data)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// JWKS отдает публичные ключи для проверки токенов авторизации.
+func (p *Proxy) JWKS(c *rest.Context) error {
+	c.SetHeader("Cache-Control", "public, max-age=300")
+	return c.Write(rest.JSON{"keys": p.jwtGen.JWKS()})
+}
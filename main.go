@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
@@ -91,6 +92,22 @@ func main() {
 				return c.Write(rest.JSON{"connections": list})
 			},
 		},
+		// состояние переподключения пользователей к серверам MX и
+		// принудительное переподключение одного или всех пользователей
+		"/reconnect": rest.Methods{
+			"GET": func(c *rest.Context) error {
+				return c.Write(rest.JSON{"reconnect": proxy.Breakers()})
+			},
+			"POST": func(c *rest.Context) error {
+				var login = c.Form("login")
+				var list = proxy.Reconnect(login)
+				if login != "" && len(list) == 0 {
+					return rest.ErrNotFound
+				}
+				log.Info("mx user reconnect", "users", len(list))
+				return c.Write(rest.JSON{"reconnect": list})
+			},
+		},
 		// список зарегистрированных приложений для авторизации OAuth2
 		"/apps": rest.Methods{
 			"GET": func(c *rest.Context) error {
@@ -114,6 +131,11 @@ func main() {
 					proxy.conns.Delete(login) // удаляем из списка
 					conn.(*MXConn).Close()    // останавливаем соединение
 				}
+				proxy.removeBreaker(login)             // прерываем переподключение
+				proxy.store.RemoveRefreshTokens(login) // отзываем токены обновления
+				proxy.store.RemoveRecordings(login)    // удаляем список записей
+				proxy.store.RemoveCalls(login)         // удаляем лог звонков
+				proxy.events.Remove(login)             // отключаем подписчиков на события
 				// удаляем из хранилища
 				if err = proxy.store.RemoveUser(login); err != nil {
 					return err
@@ -122,6 +144,22 @@ func main() {
 				return c.Write(rest.JSON{"userLogout": login})
 			},
 		},
+		// выданные токены обновления и их отзыв
+		"/refresh": rest.Methods{
+			"GET": func(c *rest.Context) error {
+				return c.Write(
+					rest.JSON{"refresh": proxy.store.ListRefreshTokens()})
+			},
+			"POST": func(c *rest.Context) error {
+				var login = c.Form("login")
+				if login == "" {
+					return c.Error(http.StatusBadRequest, "login required")
+				}
+				var count = proxy.store.RemoveRefreshTokens(login)
+				log.Info("refresh tokens revoked", "login", login, "count", count)
+				return c.Write(rest.JSON{"revoked": count})
+			},
+		},
 		// список зарегистрированных токенов устройств
 		"/tokens": rest.Methods{
 			"GET": func(c *rest.Context) error {
@@ -129,6 +167,29 @@ func main() {
 					rest.JSON{"tokens": proxy.store.section(bucketTokens)})
 			},
 		},
+		// состояние очереди повторной отправки уведомлений
+		"/queue": rest.Methods{
+			"GET": func(c *rest.Context) error {
+				var stats = proxy.store.QueueStats()
+				var total int
+				for _, count := range stats {
+					total += count
+				}
+				return c.Write(rest.JSON{"queue": rest.JSON{
+					"total":    total,
+					"services": stats,
+				}})
+			},
+		},
+		// метрики сервиса в формате Prometheus
+		"/metrics": rest.Methods{
+			"GET": func(c *rest.Context) error {
+				var buf = new(bytes.Buffer)
+				proxy.WriteMetrics(buf)
+				c.SetHeader("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+				return c.Write(buf.Bytes())
+			},
+		},
 		// "/log": rest.Methods{
 		// 	"GET": rest.File(logFile),
 		// },
@@ -152,64 +213,10 @@ func main() {
 		},
 		Logger: httplogger,
 	}
-	// генерация авторизационных токенов
-	mux.Handle("POST", "/auth", proxy.Login)
-	mux.Handle("GET", "/auth", proxy.LoginInfo)
-	mux.Handle("DELETE", "/auth", proxy.Logout)
-
-	mux.Handle("GET", "/contacts", proxy.Contacts)
-	mux.Handle("GET", "/services", proxy.Services)
-
-	mux.Handle("GET", "/calls", proxy.CallLog)
-	mux.Handle("PATCH", "/calls", proxy.SetMode)
-	mux.Handle("POST", "/calls", proxy.MakeCall)
-	mux.Handle("GET", "/calls/:id", proxy.CallInfo)
-	mux.Handle("PUT", "/calls/:id", proxy.SIPAnswer)
-	mux.Handle("POST", "/calls/:id", proxy.Transfer)
-	mux.Handle("DELETE", "/calls/:id", proxy.ClearConnection)
-	mux.Handle("PATCH", "/calls/:name", proxy.AssignDevice)
-	mux.Handle("PUT", "/calls/:id/hold", proxy.CallHold)
-	mux.Handle("PUT", "/calls/:id/unhold", proxy.CallUnHold)
-	mux.Handle("POST", "/calls/:id/record", proxy.CallRecording)
-	mux.Handle("POST", "/calls/:id/record/stop", proxy.CallRecordingStop)
-	mux.Handle("POST", "/calls/:id/conference", proxy.ConferenceCreateFromCall)
-
-	mux.Handle("GET", "/voicemails", proxy.Voicemails)
-	mux.Handle("GET", "/voicemails/:id", proxy.GetVoiceMailFile)
-	mux.Handle("DELETE", "/voicemails/:id", proxy.DeleteVoicemail)
-	mux.Handle("PATCH", "/voicemails/:id", proxy.PatchVoiceMail)
-
-	mux.Handle("GET", "/conferences", proxy.ConferenceList)
-	mux.Handle("POST", "/conferences", proxy.ConferenceCreate)
-	mux.Handle("PUT", "/conferences/:id", proxy.ConferenceUpdate)
-	mux.Handle("POST", "/conferences/:id", proxy.ConferenceJoin)
-	mux.Handle("DELETE", "/conferences/:id", proxy.ConferenceDelete)
-	mux.Handle("GET", "/conferences/info", proxy.ConferenceInfo)
-
-	mux.Handle("PUT", "/tokens/:type/:topic/:token", proxy.Token)
-	mux.Handle("DELETE", "/tokens/:type/:topic/:token", proxy.Token)
-
-	mux.Handles(rest.Paths{
-		"/debug/log": rest.Methods{
-			"GET": rest.File(logFile),
-		},
-	}, func(c *rest.Context) error {
-		// проверяем авторизацию при обращении к данным
-		clientID, secret, ok := c.BasicAuth()
-		if !ok {
-			c.SetHeader("WWW-Authenticate",
-				fmt.Sprintf("Basic realm=%q", appName+" client application"))
-			return rest.ErrUnauthorized
-		}
-		if appSecret, ok := proxy.appsAuth[clientID]; !ok || appSecret != secret {
-			return rest.ErrForbidden
-		}
-		c.AddLogField("app", clientID)
-		return nil
-	})
+	registerRoutes(mux, proxy)
 	var server = &http.Server{
 		Addr:         *httphost,
-		Handler:      mux,
+		Handler:      MetricsMiddleware(mux),
 		ReadTimeout:  time.Second * 10,
 		WriteTimeout: time.Second * 20,
 		ErrorLog:     httplogger.StdLog(log.ERROR),
@@ -233,3 +240,96 @@ func main() {
 		httplogger.Info("server stopped")
 	}
 }
+
+// registerRoutes регистрирует обработчики запросов к API сервиса.
+func registerRoutes(mux *rest.ServeMux, proxy *Proxy) {
+	// handle регистрирует обработчик запроса с учетом его маршрута в метриках
+	var handle = func(method, path string, handler rest.Handler) {
+		mux.Handle(method, path, metricHandler(path, handler))
+	}
+	// генерация авторизационных токенов
+	handle("POST", "/auth", proxy.Login)
+	handle("GET", "/auth", proxy.LoginInfo)
+	// публичные ключи для проверки токенов авторизации
+	handle("GET", "/.well-known/jwks.json", proxy.JWKS)
+	handle("DELETE", "/auth", proxy.Logout)
+
+	handle("GET", "/events", proxy.Events)
+
+	handle("GET", "/contacts", proxy.Contacts)
+	handle("GET", "/contacts/:jid", proxy.Contact)
+	handle("GET", "/services", proxy.Services)
+
+	handle("GET", "/calls", proxy.CallLog)
+	handle("PATCH", "/calls", proxy.SetMode)
+	handle("POST", "/calls", proxy.MakeCall)
+	handle("GET", "/calls/active", proxy.ActiveCalls)
+	handle("POST", "/calls/pickup", proxy.PickupCall)
+	handle("POST", "/calls/park/:orbit", proxy.UnparkCall)
+	handle("GET", "/calls/:id", proxy.CallInfo)
+	handle("PUT", "/calls/:id", proxy.SIPAnswer)
+	handle("POST", "/calls/:id", proxy.Transfer)
+	handle("DELETE", "/calls/:id", proxy.ClearConnection)
+	handle("PATCH", "/calls/:name", proxy.AssignDevice)
+	handle("PUT", "/calls/:id/hold", proxy.CallHold)
+	handle("PUT", "/calls/:id/unhold", proxy.CallUnHold)
+	handle("POST", "/calls/:id/dtmf", proxy.SendDigits)
+	handle("POST", "/calls/:id/consult", proxy.ConsultationCall)
+	handle("POST", "/calls/:id/transfer/complete", proxy.TransferComplete)
+	handle("POST", "/calls/:id/alternate", proxy.AlternateCall)
+	handle("POST", "/calls/:id/park", proxy.ParkCall)
+	handle("POST", "/calls/:id/reconnect", proxy.ReconnectCall)
+	handle("POST", "/calls/:id/record", proxy.CallRecording)
+	handle("POST", "/calls/:id/record/stop", proxy.CallRecordingStop)
+	handle("POST", "/calls/:id/conference", proxy.ConferenceCreateFromCall)
+
+	handle("GET", "/settings/forwarding", proxy.Forwarding)
+	handle("PUT", "/settings/forwarding", proxy.SetForwarding)
+	handle("GET", "/settings/dnd", proxy.DoNotDisturb)
+	handle("PUT", "/settings/dnd", proxy.SetDoNotDisturb)
+
+	handle("GET", "/presence", proxy.Presence)
+	handle("PUT", "/presence", proxy.SetPresence)
+	handle("POST", "/presence/groups/:id", proxy.AgentLogin)
+	handle("DELETE", "/presence/groups/:id", proxy.AgentLogin)
+
+	handle("GET", "/voicemails", proxy.Voicemails)
+	handle("GET", "/voicemails/:id", proxy.GetVoiceMailFile)
+	handle("DELETE", "/voicemails/:id", proxy.DeleteVoicemail)
+	handle("PATCH", "/voicemails/:id", proxy.PatchVoiceMail)
+
+	handle("GET", "/conferences", proxy.ConferenceList)
+	handle("POST", "/conferences", proxy.ConferenceCreate)
+	handle("PUT", "/conferences/:id", proxy.ConferenceUpdate)
+	handle("POST", "/conferences/:id", proxy.ConferenceJoin)
+	handle("DELETE", "/conferences/:id", proxy.ConferenceDelete)
+	handle("GET", "/conferences/info", proxy.ConferenceInfo)
+	handle("GET", "/conferences/:id/participants", proxy.ConferenceParticipants)
+	handle("DELETE", "/conferences/:id/participants/:party", proxy.ConferenceKick)
+	handle("PUT", "/conferences/:id/participants/:party/mute", proxy.ConferenceMute)
+	handle("PUT", "/conferences/:id/participants/:party/unmute", proxy.ConferenceUnmute)
+	handle("PUT", "/conferences/:id/lock", proxy.ConferenceLock)
+	handle("DELETE", "/conferences/:id/lock", proxy.ConferenceLock)
+
+	handle("PUT", "/tokens/:type/:topic/:token", proxy.Token)
+	handle("DELETE", "/tokens/:type/:topic/:token", proxy.Token)
+
+	mux.Handles(rest.Paths{
+		"/debug/log": rest.Methods{
+			"GET": rest.File(logFile),
+		},
+	}, func(c *rest.Context) error {
+		// проверяем авторизацию при обращении к данным
+		clientID, secret, ok := c.BasicAuth()
+		if !ok {
+			c.SetHeader("WWW-Authenticate",
+				fmt.Sprintf("Basic realm=%q", appName+" client application"))
+			return rest.ErrUnauthorized
+		}
+		if appSecret, ok := proxy.appsAuth[clientID]; !ok || appSecret != secret {
+			return rest.ErrForbidden
+		}
+		c.AddLogField("app", clientID)
+		return nil
+	})
+}
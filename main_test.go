@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdigger/log"
+	"github.com/mdigger/mxproxy/mxtest"
+	"github.com/mdigger/rest"
+)
+
+// testService описывает запущенный для тестирования сервис вместе с
+// имитацией сервера MX и сервера провижининга.
+type testService struct {
+	t     *testing.T
+	mx    *mxtest.Server
+	proxy *Proxy
+	web   *httptest.Server
+	token string // токен авторизации пользователя
+}
+
+// newTestService запускает сервис с пользователем test на имитации сервера
+// MX. Дополнительные строки добавляются в конфигурационный файл.
+func newTestService(t *testing.T, config ...string) *testService {
+	t.Helper()
+	var server = mxtest.NewServer()
+	t.Cleanup(func() { server.Close() })
+	server.AddUser(&mxtest.User{Login: "test", Password: "test",
+		Ext: "3095", JID: 43884852, SoftPhonePwd: "sip"})
+	var provisioning = httptest.NewServer(server.ProvisioningHandler())
+	t.Cleanup(provisioning.Close)
+	var dir = t.TempDir()
+	var configName = filepath.Join(dir, "mxproxy.toml")
+	if err := ioutil.WriteFile(configName, []byte(fmt.Sprintf(
+		"provisioning = %q\n%s\n\n[apps]\ntest = \"secret\"\n",
+		provisioning.URL, strings.Join(config, "\n"))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := InitProxy(configName, filepath.Join(dir, "mxproxy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+	var mux = &rest.ServeMux{Logger: log.New("http")}
+	registerRoutes(mux, proxy)
+	var web = httptest.NewServer(MetricsMiddleware(mux))
+	t.Cleanup(web.Close)
+	return &testService{t: t, mx: server, proxy: proxy, web: web}
+}
+
+// auth запрашивает токен авторизации пользователя и возвращает статус ответа.
+func (s *testService) auth(login, password string) int {
+	s.t.Helper()
+	req, err := http.NewRequest("POST", s.web.URL+"/auth",
+		strings.NewReader(url.Values{
+			"grant_type": {"password"},
+			"username":   {login},
+			"password":   {password},
+		}.Encode()))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	req.SetBasicAuth("test", "secret")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		var token = new(TokenDescription)
+		if err := json.NewDecoder(resp.Body).Decode(token); err != nil {
+			s.t.Fatal(err)
+		}
+		s.token = token.Token
+	}
+	return resp.StatusCode
+}
+
+// login авторизует пользователя test и дожидается запуска монитора звонков.
+func (s *testService) login() {
+	s.t.Helper()
+	if status := s.auth("test", "test"); status != http.StatusOK {
+		s.t.Fatalf("auth status = %d", status)
+	}
+	waitFor(s.t, "call monitor", func() bool {
+		var sessions = s.mx.Sessions("test")
+		return len(sessions) == 1 && sessions[0].Monitored()
+	})
+}
+
+// do выполняет запрос к сервису с токеном авторизации пользователя. Параметры
+// передаются в виде формы.
+func (s *testService) do(method, path string, form url.Values) *http.Response {
+	s.t.Helper()
+	var body = strings.NewReader(form.Encode())
+	req, err := http.NewRequest(method, s.web.URL+path, body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return resp
+}
+
+// request выполняет запрос, проверяет статус ответа и разбирает ответ в
+// формате JSON, если result не nil.
+func (s *testService) request(method, path string, form url.Values,
+	status int, result interface{}) {
+	s.t.Helper()
+	var resp = s.do(method, path, form)
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		data, _ := ioutil.ReadAll(resp.Body)
+		s.t.Fatalf("%s %s: status = %d, want %d: %s",
+			method, path, resp.StatusCode, status, data)
+	}
+	if result == nil {
+		return
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		s.t.Fatalf("%s %s: %v", method, path, err)
+	}
+}
+
+// events подписывается на поток событий пользователя и возвращает канал с
+// полученными событиями.
+func (s *testService) events() <-chan map[string]interface{} {
+	s.t.Helper()
+	var resp = s.do("GET", "/events", nil)
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		s.t.Fatalf("events status = %d", resp.StatusCode)
+	}
+	s.t.Cleanup(func() { resp.Body.Close() })
+	var reader = bufio.NewReader(resp.Body)
+	// дожидаемся начала потока, чтобы не пропустить события
+	if line, err := reader.ReadString('\n'); err != nil ||
+		!strings.HasPrefix(line, "retry:") {
+		s.t.Fatalf("events stream start: %q %v", line, err)
+	}
+	var events = make(chan map[string]interface{}, EventsBufferSize)
+	go func() {
+		defer close(events)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var event map[string]interface{}
+			if json.Unmarshal([]byte(line[len("data: "):]), &event) == nil {
+				events <- event
+			}
+		}
+	}()
+	return events
+}
+
+// nextEvent возвращает следующее событие указанного типа, пропуская события
+// других типов.
+func nextEvent(t *testing.T, events <-chan map[string]interface{},
+	typ string) map[string]interface{} {
+	t.Helper()
+	var timeout = time.After(time.Second * 5)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("events stream closed waiting for %s", typ)
+			}
+			if event["type"] == typ {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for %s event", typ)
+		}
+	}
+}
+
+// webhookRecorder запускает сервер, принимающий уведомления webhook, и
+// возвращает строку конфигурации с его адресом и канал с типами полученных
+// событий.
+func webhookRecorder(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	var types = make(chan string, 100)
+	var server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var event = new(struct {
+				Type string `json:"type"`
+			})
+			if json.NewDecoder(r.Body).Decode(event) == nil {
+				types <- event.Type
+			}
+		}))
+	t.Cleanup(server.Close)
+	return fmt.Sprintf("[webhooks.test]\nsecret = \"secret\"\nurl = %q",
+		server.URL), types
+}
+
+// pushedBefore возвращает типы событий, отправленных на webhook до события
+// указанного типа.
+func pushedBefore(t *testing.T, types <-chan string, typ string) []string {
+	t.Helper()
+	var list []string
+	var timeout = time.After(time.Second * 5)
+	for {
+		select {
+		case name := <-types:
+			if name == typ {
+				return list
+			}
+			list = append(list, name)
+		case <-timeout:
+			t.Fatalf("timeout waiting for %s webhook", typ)
+		}
+	}
+}
+
+// waitFor дожидается выполнения условия.
+func waitFor(t *testing.T, name string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second * 5); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", name)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	var s = newTestService(t)
+	if status := s.auth("test", "bad"); status != http.StatusUnauthorized {
+		t.Errorf("bad password status = %d", status)
+	}
+	s.login()
+	var info = new(struct {
+		MX           string `json:"mx"`
+		Ext          string `json:"ext"`
+		JID          string `json:"jid"`
+		SoftPhonePwd string `json:"softPhonePwd"`
+	})
+	s.request("GET", "/auth", nil, http.StatusOK, info)
+	if info.MX != s.mx.SN || info.Ext != "3095" || info.JID != "43884852" ||
+		info.SoftPhonePwd != "sip" {
+		t.Errorf("login info = %+v", info)
+	}
+	// повторная авторизация использует то же соединение с сервером MX
+	s.login()
+	s.request("DELETE", "/auth", nil, http.StatusOK, nil)
+	waitFor(t, "mx logout", func() bool { return len(s.mx.Sessions("test")) == 0 })
+	s.request("GET", "/auth", nil, http.StatusUnauthorized, nil)
+}
+
+func TestUnauthorized(t *testing.T) {
+	var s = newTestService(t)
+	s.request("GET", "/calls/active", nil, http.StatusUnauthorized, nil)
+	s.token = "bad"
+	s.request("GET", "/events", nil, http.StatusUnauthorized, nil)
+}
+
+func TestMonitorEvents(t *testing.T) {
+	var s = newTestService(t)
+	s.login()
+	var events = s.events()
+	var callID = s.mx.Delivered("test", "79031234567")
+	var event = nextEvent(t, events, "Delivered")
+	if event["callId"] != float64(callID) ||
+		event["callingDevice"] != "79031234567" ||
+		event["calledDevice"] != "3095" {
+		t.Errorf("delivered event = %v", event)
+	}
+	s.mx.Established("test", callID, "79031234567")
+	if event = nextEvent(t, events, "Established"); event["callId"] != float64(callID) {
+		t.Errorf("established event = %v", event)
+	}
+	s.mx.Cleared("test", callID)
+	nextEvent(t, events, "ConnectionCleared")
+}
+
+func TestReconnect(t *testing.T) {
+	var s = newTestService(t, "[reconnect]\nminDelay = \"10ms\"\njitter = 0.0")
+	s.login()
+	var session = s.mx.Sessions("test")[0]
+	if n := s.mx.Disconnect("test"); n != 1 {
+		t.Fatalf("disconnected %d sessions", n)
+	}
+	// после восстановления соединения монитор звонков запускается снова
+	waitFor(t, "reconnect", func() bool {
+		var sessions = s.mx.Sessions("test")
+		return len(sessions) == 1 && sessions[0] != session &&
+			sessions[0].Monitored()
+	})
+	var events = s.events()
+	var callID = s.mx.Delivered("test", "79031234567")
+	if event := nextEvent(t, events, "Delivered"); event["callId"] != float64(callID) {
+		t.Errorf("delivered event = %v", event)
+	}
+}
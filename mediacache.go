@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdigger/log"
+)
+
+// Параметры кеша файлов голосовой почты и записей звонков.
+var (
+	MediaCacheMaxSize int64 = 256 << 20           // максимальный размер кеша
+	MediaCacheMaxAge        = time.Hour * 24 * 30 // время хранения файла
+)
+
+// mediaEntry описывает файл в кеше.
+type mediaEntry struct {
+	key      string    // ключ файла в кеше
+	Login    string    `json:"login"`     // логин пользователя
+	ID       string    `json:"id"`        // идентификатор сообщения
+	Media    string    `json:"mediaType"` // тип записи
+	Name     string    `json:"name"`      // название файла
+	Mimetype string    `json:"mimeType"`  // формат данных
+	Size     int64     `json:"size"`      // размер файла
+	Created  time.Time `json:"created"`   // время сохранения
+	accessed time.Time // время последнего обращения
+}
+
+// MediaCache описывает кеш файлов голосовой почты и записей звонков на диске.
+// Размер кеша и время хранения файлов ограничены: при превышении размера
+// удаляются файлы, к которым дольше всего не обращались.
+type MediaCache struct {
+	dir     string                 // каталог с файлами
+	maxSize int64                  // максимальный размер
+	maxAge  time.Duration          // время хранения
+	entries map[string]*mediaEntry // файлы в кеше
+	size    int64                  // суммарный размер файлов
+	mu      sync.Mutex
+}
+
+// OpenMediaCache открывает кеш в указанном каталоге и загружает информацию о
+// сохраненных в нем файлах. Устаревшие и поврежденные файлы удаляются.
+func OpenMediaCache(dir string, maxSize int64, maxAge time.Duration) (
+	*MediaCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	var cache = &MediaCache{
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		entries: make(map[string]*mediaEntry),
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		var name = file.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(filepath.Join(dir, name)) // незаконченная загрузка
+			continue
+		}
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		var key = strings.TrimSuffix(name, ".json")
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		var entry = new(mediaEntry)
+		if err == nil {
+			err = json.Unmarshal(data, entry)
+		}
+		if err == nil {
+			var info os.FileInfo
+			info, err = os.Stat(cache.filename(key))
+			if err == nil && info.Size() != entry.Size {
+				err = os.ErrInvalid
+			}
+		}
+		if err != nil || time.Since(entry.Created) > maxAge {
+			cache.removeFiles(key)
+			continue
+		}
+		entry.key = key
+		entry.accessed = entry.Created
+		cache.entries[key] = entry
+		cache.size += entry.Size
+	}
+	cache.mu.Lock()
+	cache.evict()
+	cache.mu.Unlock()
+	log.Info("media cache", "dir", dir, "files", len(cache.entries),
+		"size", cache.size)
+	return cache, nil
+}
+
+// mediaKey возвращает ключ файла в кеше. Ключ включает логин пользователя,
+// чтобы файлы разных пользователей не пересекались.
+func mediaKey(login, mediaType, id string) string {
+	if mediaType == "" {
+		mediaType = "VoiceMail"
+	}
+	var hash = sha256.Sum256([]byte(login + "\x00" + mediaType + "\x00" + id))
+	return hex.EncodeToString(hash[:])
+}
+
+// filename возвращает имя файла с содержимым.
+func (m *MediaCache) filename(key string) string {
+	return filepath.Join(m.dir, key+".data")
+}
+
+// removeFiles удаляет файлы с содержимым и описанием.
+func (m *MediaCache) removeFiles(key string) {
+	os.Remove(m.filename(key))
+	os.Remove(filepath.Join(m.dir, key+".json"))
+}
+
+// Open возвращает описание и открытый файл из кеша. Если файла в кеше нет или
+// он устарел, то возвращается nil.
+func (m *MediaCache) Open(login, mediaType, id string) (*mediaEntry, *os.File) {
+	if m == nil {
+		return nil, nil
+	}
+	var key = mediaKey(login, mediaType, id)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	if time.Since(entry.Created) > m.maxAge {
+		m.remove(key)
+		return nil, nil
+	}
+	file, err := os.Open(m.filename(key))
+	if err != nil {
+		m.remove(key)
+		return nil, nil
+	}
+	entry.accessed = time.Now()
+	return entry, file
+}
+
+// Remove удаляет файл из кеша.
+func (m *MediaCache) Remove(login, mediaType, id string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.remove(mediaKey(login, mediaType, id))
+	m.mu.Unlock()
+}
+
+// remove удаляет файл из кеша. Должна вызываться при заблокированном кеше.
+func (m *MediaCache) remove(key string) {
+	if entry, ok := m.entries[key]; ok {
+		m.size -= entry.Size
+		delete(m.entries, key)
+	}
+	m.removeFiles(key)
+}
+
+// evict удаляет устаревшие файлы, а так же файлы, к которым дольше всего не
+// обращались, пока размер кеша превышает допустимый. Должна вызываться при
+// заблокированном кеше.
+func (m *MediaCache) evict() {
+	var list = make([]*mediaEntry, 0, len(m.entries))
+	for key, entry := range m.entries {
+		if time.Since(entry.Created) > m.maxAge {
+			m.remove(key)
+			continue
+		}
+		list = append(list, entry)
+	}
+	if m.size <= m.maxSize {
+		return
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].accessed.Before(list[j].accessed)
+	})
+	for _, entry := range list {
+		if m.size <= m.maxSize {
+			break
+		}
+		m.remove(entry.key)
+	}
+}
+
+// Create возвращает объект для сохранения файла в кеше по мере его
+// получения с сервера MX. Если файл больше максимального размера кеша, то он
+// не сохраняется и возвращается nil.
+func (m *MediaCache) Create(login string, vminfo *Chunks) *mediaWriter {
+	if m == nil || vminfo.Size > m.maxSize {
+		return nil
+	}
+	var key = mediaKey(login, vminfo.MediaType, vminfo.ID)
+	file, err := ioutil.TempFile(m.dir, key+"-*.tmp")
+	if err != nil {
+		log.Error("media cache error", "error", err)
+		return nil
+	}
+	return &mediaWriter{
+		cache:  m,
+		file:   file,
+		chunks: vminfo,
+		entry: &mediaEntry{
+			key:      key,
+			Login:    login,
+			ID:       vminfo.ID,
+			Media:    vminfo.MediaType,
+			Name:     vminfo.Name,
+			Mimetype: vminfo.Mimetype,
+		},
+	}
+}
+
+// mediaWriter сохраняет файл в кеше.
+type mediaWriter struct {
+	cache  *MediaCache
+	file   *os.File
+	chunks *Chunks // получаемый файл
+	entry  *mediaEntry
+	err    error
+}
+
+// errMediaIncomplete возвращается при попытке сохранить в кеше файл,
+// полученный не полностью.
+var errMediaIncomplete = errors.New("media file is incomplete")
+
+// Write записывает очередной кусок файла.
+func (w *mediaWriter) Write(data []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.file.Write(data)
+	w.entry.Size += int64(n)
+	w.err = err
+	return n, err
+}
+
+// Abort прерывает сохранение файла.
+func (w *mediaWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// Commit добавляет полностью полученный файл в кеш. Файл не сохраняется,
+// если последний кусок не был получен или размер файла не совпадает с
+// ожидаемым.
+func (w *mediaWriter) Commit() error {
+	if w.err != nil {
+		w.Abort()
+		return w.err
+	}
+	if !w.chunks.Complete() ||
+		(w.chunks.Size >= 0 && w.entry.Size != w.chunks.Size) {
+		w.Abort()
+		return errMediaIncomplete
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	var m, entry = w.cache, w.entry
+	if entry.Size > m.maxSize {
+		os.Remove(w.file.Name()) // файл слишком большой для кеша
+		return nil
+	}
+	entry.Created = time.Now()
+	entry.accessed = entry.Created
+	data, err := json.Marshal(entry)
+	if err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(entry.key) // удаляем предыдущую версию, если она есть
+	if err = os.Rename(w.file.Name(), m.filename(entry.key)); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(m.dir, entry.key+".json"),
+		data, 0600); err != nil {
+		m.removeFiles(entry.key)
+		return err
+	}
+	m.entries[entry.key] = entry
+	m.size += entry.Size
+	m.evict()
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMediaCacheCommit(t *testing.T) {
+	cache, err := OpenMediaCache(t.TempDir(), 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name     string
+		size     int64 // ожидаемый размер файла
+		complete bool  // получен последний кусок
+		cached   bool
+	}{
+		{name: "complete", size: 4, complete: true, cached: true},
+		{name: "unknown size", size: -1, complete: true, cached: true},
+		{name: "truncated", size: 8, complete: true},
+		{name: "no last chunk", size: 4},
+	} {
+		var chunks = &Chunks{ID: test.name, MediaType: "Voice", Size: test.size,
+			complete: test.complete}
+		var writer = cache.Create("test", chunks)
+		writer.Write([]byte("data"))
+		err := writer.Commit()
+		entry, file := cache.Open("test", "Voice", test.name)
+		if file != nil {
+			file.Close()
+		}
+		if test.cached {
+			if err != nil || entry == nil || entry.Size != 4 {
+				t.Errorf("%s: entry = %+v, error = %v", test.name, entry, err)
+			}
+			continue
+		}
+		if err != errMediaIncomplete || entry != nil {
+			t.Errorf("%s: entry = %+v, error = %v", test.name, entry, err)
+		}
+	}
+}
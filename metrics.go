@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdigger/mx"
+	"github.com/mdigger/rest"
+)
+
+// Метрики сервиса в формате Prometheus.
+var (
+	metricReconnects = newCounter("mxproxy_mx_reconnect_attempts_total",
+		"MX reconnect attempts.", "login")
+	metricReconnectFailures = newCounter("mxproxy_mx_reconnect_failures_total",
+		"MX reconnect failures.", "login")
+	metricHTTPRequests = newCounter("mxproxy_http_requests_total",
+		"HTTP requests.", "route", "method", "status")
+	metricHTTPDuration = newHistogram("mxproxy_http_request_duration_seconds",
+		"HTTP request latency.", "route", "method")
+	metricPushSent = newCounter("mxproxy_push_sent_total",
+		"Push notifications sent.", "provider", "topic", "result")
+	metricTokensRemoved = newCounter("mxproxy_push_tokens_removed_total",
+		"Device tokens removed.", "provider", "reason")
+	metricCSTADuration = newHistogram("mxproxy_csta_command_duration_seconds",
+		"CSTA command round-trip latency.", "command")
+	metricCSTATimeouts = newCounter("mxproxy_csta_command_timeouts_total",
+		"CSTA command timeouts.", "command")
+	metricJWTRotations = newCounter("mxproxy_jwt_key_rotations_total",
+		"JWT sign key rotations.")
+)
+
+// metricBuckets задает границы интервалов гистограмм в секундах.
+var metricBuckets = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// collector описывает метрику, которая умеет выводить свои значения.
+type collector interface {
+	write(w io.Writer)
+}
+
+// зарегистрированные метрики в порядке их создания
+var (
+	collectors  []collector
+	collectorMu sync.Mutex
+)
+
+// metricLabels описывает значения меток метрики.
+type metricLabels struct {
+	names  []string // названия меток
+	values []string // значения меток
+}
+
+// labelEscaper экранирует значение метки по правилам формата Prometheus:
+// экранируются только обратная косая черта, кавычки и перевод строки.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue возвращает значение метки в кавычках в формате Prometheus.
+func labelValue(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+// String возвращает метки в формате Prometheus.
+func (l *metricLabels) String() string {
+	if len(l.names) == 0 {
+		return ""
+	}
+	var pairs = make([]string, len(l.names))
+	for i, name := range l.names {
+		pairs[i] = name + "=" + labelValue(l.values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// counter описывает счетчик с метками.
+type counter struct {
+	name, help string
+	labels     []string
+	values     map[string]float64
+	keys       map[string][]string
+	mu         sync.Mutex
+}
+
+// newCounter создает и регистрирует новый счетчик.
+func newCounter(name, help string, labels ...string) *counter {
+	var c = &counter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+		keys:   make(map[string][]string),
+	}
+	collectorMu.Lock()
+	collectors = append(collectors, c)
+	collectorMu.Unlock()
+	return c
+}
+
+// Inc увеличивает значение счетчика с указанными значениями меток.
+func (c *counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add увеличивает значение счетчика с указанными значениями меток.
+func (c *counter) Add(delta float64, values ...string) {
+	var key = strings.Join(values, "\xff")
+	c.mu.Lock()
+	if _, ok := c.keys[key]; !ok {
+		c.keys[key] = values
+	}
+	c.values[key] += delta
+	c.mu.Unlock()
+}
+
+func (c *counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		var labels = &metricLabels{names: c.labels, values: c.keys[key]}
+		fmt.Fprintf(w, "%s%s %v\n", c.name, labels, c.values[key])
+	}
+}
+
+// histogram описывает гистограмму с метками.
+type histogram struct {
+	name, help string
+	labels     []string
+	values     map[string]*histogramValue
+	keys       map[string][]string
+	mu         sync.Mutex
+}
+
+// histogramValue содержит значения гистограммы для одного набора меток.
+type histogramValue struct {
+	buckets []uint64 // количество значений в интервалах
+	count   uint64   // общее количество значений
+	sum     float64  // сумма значений
+}
+
+// newHistogram создает и регистрирует новую гистограмму.
+func newHistogram(name, help string, labels ...string) *histogram {
+	var h = &histogram{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*histogramValue),
+		keys:   make(map[string][]string),
+	}
+	collectorMu.Lock()
+	collectors = append(collectors, h)
+	collectorMu.Unlock()
+	return h
+}
+
+// Observe добавляет значение в гистограмму с указанными значениями меток.
+func (h *histogram) Observe(value float64, values ...string) {
+	var key = strings.Join(values, "\xff")
+	h.mu.Lock()
+	var v = h.values[key]
+	if v == nil {
+		v = &histogramValue{buckets: make([]uint64, len(metricBuckets))}
+		h.values[key] = v
+		h.keys[key] = values
+	}
+	for i, bound := range metricBuckets {
+		if value <= bound {
+			v.buckets[i]++
+		}
+	}
+	v.count++
+	v.sum += value
+	h.mu.Unlock()
+}
+
+// Since добавляет в гистограмму время, прошедшее с указанного момента.
+func (h *histogram) Since(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *histogram) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var keys = make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var v = h.values[key]
+		var names = append(h.labels[:len(h.labels):len(h.labels)], "le")
+		var values = append(h.keys[key][:len(h.keys[key]):len(h.keys[key])], "")
+		for i, bound := range metricBuckets {
+			values[len(values)-1] = strconv.FormatFloat(bound, 'g', -1, 64)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				&metricLabels{names: names, values: values}, v.buckets[i])
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			&metricLabels{names: names, values: values}, v.count)
+		var labels = &metricLabels{names: h.labels, values: h.keys[key]}
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, labels, v.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, v.count)
+	}
+}
+
+// sortedKeys возвращает отсортированный список ключей.
+func sortedKeys(values map[string]float64) []string {
+	var keys = make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteMetrics выводит все метрики сервиса в формате Prometheus.
+func (p *Proxy) WriteMetrics(w io.Writer) {
+	// текущие значения вычисляем в момент запроса
+	var connections int
+	p.conns.Range(func(_, _ interface{}) bool {
+		connections++
+		return true
+	})
+	fmt.Fprintf(w, "# HELP %[1]s Active MX connections.\n"+
+		"# TYPE %[1]s gauge\n%[1]s %d\n", "mxproxy_mx_connections", connections)
+	fmt.Fprintf(w, "# HELP %[1]s Registered users.\n"+
+		"# TYPE %[1]s gauge\n%[1]s %d\n", "mxproxy_users",
+		p.store.keys(bucketUsers))
+	var breakers = map[string]int{
+		breakerClosed: 0, breakerHalfOpen: 0, breakerOpen: 0}
+	for _, state := range p.Breakers() {
+		breakers[state.State]++
+	}
+	fmt.Fprintf(w, "# HELP %[1]s MX reconnect circuit breaker states.\n"+
+		"# TYPE %[1]s gauge\n", "mxproxy_mx_reconnect_state")
+	for _, state := range []string{breakerClosed, breakerHalfOpen, breakerOpen} {
+		fmt.Fprintf(w, "mxproxy_mx_reconnect_state{state=%s} %d\n",
+			labelValue(state), breakers[state])
+	}
+	var queue = p.store.QueueStats()
+	// пустые очереди тоже отдаются, чтобы метрики не пропадали
+	for _, provider := range []string{"apn", "fcm", "webhook"} {
+		if _, ok := queue[provider]; !ok {
+			queue[provider] = 0
+		}
+	}
+	var providers = make([]string, 0, len(queue))
+	for provider := range queue {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+	fmt.Fprintf(w, "# HELP %[1]s Push notifications in retry queue.\n"+
+		"# TYPE %[1]s gauge\n", "mxproxy_push_queue_depth")
+	for _, provider := range providers {
+		fmt.Fprintf(w, "mxproxy_push_queue_depth{provider=%s} %d\n",
+			labelValue(provider), queue[provider])
+	}
+	collectorMu.Lock()
+	defer collectorMu.Unlock()
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// metricRouteKey используется для передачи информации о маршруте запроса.
+type metricRouteKey struct{}
+
+// metricRoute хранит шаблон маршрута, обработавшего запрос.
+type metricRoute struct {
+	route string
+}
+
+// metricHandler возвращает обработчик запроса, который сохраняет шаблон его
+// маршрута для учета в метриках.
+func metricHandler(route string, handler rest.Handler) rest.Handler {
+	return func(c *rest.Context) error {
+		if r, ok := c.Request.Context().Value(metricRouteKey{}).(*metricRoute); ok {
+			r.route = route
+		}
+		return handler(c)
+	}
+}
+
+// MetricsMiddleware подсчитывает количество и время обработки HTTP запросов
+// с учетом маршрута и статуса ответа.
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start = time.Now()
+		var route = new(metricRoute)
+		r = r.WithContext(context.WithValue(r.Context(), metricRouteKey{}, route))
+		var sw = &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if route.route == "" {
+			route.route = "unknown"
+		}
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		metricHTTPRequests.Inc(route.route, r.Method, strconv.Itoa(sw.status))
+		metricHTTPDuration.Since(start, route.route, r.Method)
+	})
+}
+
+// statusWriter запоминает статус ответа на HTTP запрос.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush поддерживает потоковую отдачу ответа.
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack поддерживает переключение соединения на WebSocket.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// Unwrap возвращает исходный http.ResponseWriter для http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// cstaCommandName возвращает название команды CSTA для учета в метриках.
+func cstaCommandName(cmd interface{}) string {
+	switch cmd := cmd.(type) {
+	case string:
+		// команда задана строкой XML: берем название первого элемента
+		var name = strings.TrimPrefix(strings.TrimSpace(cmd), "<")
+		if i := strings.IndexAny(name, " />"); i >= 0 {
+			name = name[:i]
+		}
+		return name
+	case []byte:
+		return cstaCommandName(string(cmd))
+	}
+	var v = reflect.Indirect(reflect.ValueOf(cmd))
+	if v.Kind() == reflect.Struct {
+		if field, ok := v.Type().FieldByName("XMLName"); ok {
+			var name = strings.Split(field.Tag.Get("xml"), ",")[0]
+			if i := strings.LastIndexByte(name, ' '); i >= 0 {
+				name = name[i+1:]
+			}
+			// для запросов iq добавляем их идентификатор
+			if name == "iq" {
+				if id := v.FieldByName("ID"); id.IsValid() &&
+					id.Kind() == reflect.String {
+					name += ":" + id.String()
+				}
+			}
+			if name != "" {
+				return name
+			}
+		}
+	}
+	return "unknown"
+}
+
+// observeCSTA учитывает в метриках время выполнения команды CSTA.
+func observeCSTA(cmd interface{}, start time.Time, err error) {
+	var name = cstaCommandName(cmd)
+	metricCSTADuration.Since(start, name)
+	if err == mx.ErrTimeout {
+		metricCSTATimeouts.Inc(name)
+	}
+}
+
+// SendWithResponse отсылает команду на сервер MX и возвращает ответ на нее,
+// учитывая время выполнения команды в метриках.
+func (c *MXConn) SendWithResponse(cmd interface{}) (*mx.Response, error) {
+	var start = time.Now()
+	resp, err := c.Conn.SendWithResponse(cmd)
+	observeCSTA(cmd, start, err)
+	return resp, err
+}
+
+// SendAndWait отсылает команду на сервер MX и ожидает событие с указанным
+// названием, учитывая время выполнения команды в метриках.
+func (c *MXConn) SendAndWait(cmd interface{}, name string) (*mx.Response, error) {
+	var start = time.Now()
+	resp, err := c.Conn.SendAndWait(cmd, name)
+	observeCSTA(cmd, start, err)
+	return resp, err
+}
@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestMetricLabels(t *testing.T) {
+	var labels = &metricLabels{
+		names:  []string{"topic", "route"},
+		values: []string{"Тема \"1\"\n\\", "/calls/:id\x01"},
+	}
+	var want = "{topic=\"Тема \\\"1\\\"\\n\\\\\",route=\"/calls/:id\x01\"}"
+	if got := labels.String(); got != want {
+		t.Errorf("labels = %s, want %s", got, want)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/base64"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"mime"
 	"sort"
@@ -26,8 +27,16 @@ type MXConn struct {
 	*MXConfig        // конфигурация для авторизации и подключения
 	*mx.Conn         // соединение с сервером MX
 	// monitorID int64    // идентификатор пользовательского монитора
-	Calls sync.Map // текущие звонки
-	Recs  sync.Map // информация о записанных звонках
+	Calls    sync.Map         // текущие звонки
+	Recs     sync.Map         // информация о записанных звонках
+	book     addressBook      // закешированная адресная книга
+	active   activeCalls      // состояние текущих звонков
+	presence presenceList     // присутствие контактов адресной книги
+	confs    conferenceRoster // участники конференций
+
+	callLogMu     sync.Mutex // блокировка запроса лога звонков
+	callLogSyncMu sync.Mutex // блокировка синхронизации лога звонков
+	callLogSynced time.Time  // время последней синхронизации лога звонков
 }
 
 // MXConnect устанавливает пользовательское соединение с сервером MX и
@@ -79,6 +88,7 @@ func MXConnect(conf *MXConfig) (*MXConn, error) {
 	// }
 
 	return &MXConn{
+		Login:    conf.Login,
 		MXConfig: conf,
 		Conn:     conn,
 		// monitorID: monitor.ID,
@@ -168,8 +178,24 @@ type Contact struct {
 	ExchangeID string `xml:"exchangeId" json:"exchangeId,omitempty"`
 }
 
-// CallLog возвращает информацию о звонках пользователя.
+// Параметры получения лога звонков с сервера MX.
+var (
+	CallLogPageSize = 21               // количество записей в блоке
+	CallLogTimeout  = time.Second * 10 // ожидание очередного блока
+)
+
+// errCallLogIncomplete возвращается, если после полного блока лога звонков
+// следующий блок не был получен: такой лог может быть неполным.
+var errCallLogIncomplete = errors.New("call log may be incomplete")
+
+// CallLog возвращает информацию о звонках пользователя. Одновременно
+// выполняется только один запрос лога звонков для соединения, т.к. ответы на
+// разные запросы не различаются. Если после полного блока следующий блок не
+// был получен, то вместе с полученными записями возвращается ошибка
+// errCallLogIncomplete.
 func (c *MXConn) CallLog(timestamp time.Time) ([]*CallInfo, error) {
+	c.callLogMu.Lock()
+	defer c.callLogMu.Unlock()
 	// формируем и отправляем команду получения лога звонков пользователя
 	var ts int64
 	if timestamp.IsZero() {
@@ -192,6 +218,7 @@ func (c *MXConn) CallLog(timestamp time.Time) ([]*CallInfo, error) {
 
 	// разбор ответов сервера
 	var callLog []*CallInfo
+	var blocks int // количество полученных блоков
 	err := c.HandleWait(func(resp *mx.Response) error {
 		var items = new(struct {
 			LogItems []*CallInfo `xml:"callinfo"`
@@ -199,27 +226,31 @@ func (c *MXConn) CallLog(timestamp time.Time) ([]*CallInfo, error) {
 		if err := resp.Decode(items); err != nil {
 			return err
 		}
-		if callLog == nil {
-			callLog = items.LogItems
-		} else {
-			callLog = append(callLog, items.LogItems...)
-		}
+		callLog = append(callLog, items.LogItems...)
+		blocks++
 		// BUG (d3): единственный способ, который я нашел для отслеживания
 		// окончания лога звонков, это проверять количество звонков в ответе
 		// блока - обычно блоки разбиты по 21.
-		if len(items.LogItems) < 21 {
+		if len(items.LogItems) < CallLogPageSize {
 			return mx.Stop
 		}
 		return nil
-	}, mx.ReadTimeout, "callloginfo")
-	if err != nil && err != mx.ErrTimeout {
+	}, CallLogTimeout, "callloginfo")
+	switch {
+	case err == mx.ErrTimeout && blocks > 0:
+		// завершающий блок не пришел: записей может быть ровно на полные
+		// блоки, а может быть, сервер не отдал оставшиеся
+		err = errCallLogIncomplete
+	case err == mx.ErrTimeout:
+		err = nil // сервер не отдает ни одного блока, если записей нет
+	case err != nil:
 		return nil, err
 	}
 	// сортируем по номеру записи
 	sort.Slice(callLog, func(i, j int) bool {
 		return callLog[i].RecordID < callLog[j].RecordID
 	})
-	return callLog, nil
+	return callLog, err
 }
 
 // CallInfo описывает информацию о записи в логе звонков.
@@ -243,6 +274,15 @@ type CallInfo struct {
 	MonitorType           int64  `xml:"monitorType" json:"monitorType,omitempty"`
 }
 
+// Time возвращает время звонка: время соединения или, если соединения не
+// было, время его завершения.
+func (c *CallInfo) Time() int64 {
+	if c.ConnectTimestamp != 0 {
+		return c.ConnectTimestamp
+	}
+	return c.DisconnectTimestamp
+}
+
 // AssignDevice ассоциирует телефонный номер с именем устройства.
 func (c *MXConn) AssignDevice(name string) error {
 	// отправляем команду для ассоциации устройства по имени
@@ -481,13 +521,17 @@ func (c *MXConn) VoiceMailList( /*mediaType string*/ ) ([]*VoiceMail, error) {
 	return vmails.Mails, nil
 }
 
-// RecordsList возвращает список записанных звонков.
+// RecordsList возвращает список записанных звонков, упорядоченный по времени
+// записи.
 func (c *MXConn) RecordsList() []*VoiceMail {
 	var recs = make([]*VoiceMail, 0)
 	c.Recs.Range(func(_, value interface{}) bool {
 		recs = append(recs, value.(*VoiceMail))
 		return true
 	})
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].Received < recs[j].Received
+	})
 	return recs
 }
 
@@ -593,9 +637,11 @@ func (c *MXConn) VoiceMailFile(id, mediaType string) (*Chunks, error) {
 		Mimetype:  mimetype,    // тип файла
 		Name:      chunk.Name,  // название файла
 		MediaType: mediaType,
-		conn:      c.Conn,              // соединение с сервером
-		chunks:    chunks,              // канал с содержимым файла
-		done:      make(chan struct{}), // канал для закрытия
+		Size:      voiceMailSize(chunk, data), // размер файла
+		conn:      c.Conn,                     // соединение с сервером
+		chunks:    chunks,                     // канал с содержимым файла
+		first:     data,                       // первый кусок
+		done:      make(chan struct{}),        // канал для закрытия
 	}
 	return vminfo, nil
 }
@@ -0,0 +1,181 @@
+package mxtest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"time"
+)
+
+// Event отсылает событие всем сессиям пользователя, запустившим монитор
+// звонков. Событие может быть задано строкой XML или объектом, который
+// преобразуется в XML. Возвращает количество сессий, которым было отправлено
+// событие.
+func (s *Server) Event(login string, event interface{}) int {
+	var count int
+	for _, session := range s.Sessions(login) {
+		if !session.Monitored() {
+			continue
+		}
+		if session.Event(event) == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// Broadcast отсылает событие всем авторизованным сессиям, независимо от
+// запуска монитора звонков.
+func (s *Server) Broadcast(event interface{}) int {
+	s.mu.RLock()
+	var sessions = make([]*Session, 0, len(s.sessions))
+	for session := range s.sessions {
+		if session.User() != nil {
+			sessions = append(sessions, session)
+		}
+	}
+	s.mu.RUnlock()
+	var count int
+	for _, session := range sessions {
+		if session.Event(event) == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// user возвращает пользователя по логину.
+func (s *Server) user(login string) *User {
+	s.mu.RLock()
+	var user = s.users[login]
+	s.mu.RUnlock()
+	return user
+}
+
+// Delivered отсылает пользователю событие о входящем звонке с номера from и
+// возвращает идентификатор звонка.
+func (s *Server) Delivered(login, from string) int64 {
+	var user = s.user(login)
+	if user == nil {
+		return 0
+	}
+	var callID = s.nextID()
+	s.Event(login, fmt.Sprintf(
+		`<DeliveredEvent><monitorCrossRefID>1</monitorCrossRefID>`+
+			`<connection><callID>%[1]d</callID><deviceID>%[2]s</deviceID>`+
+			`<globalCallID>%[1]d-gcid</globalCallID></connection>`+
+			`<alertingDevice><deviceIdentifier>%[2]s</deviceIdentifier></alertingDevice>`+
+			`<callingDevice><deviceIdentifier>%[3]s</deviceIdentifier></callingDevice>`+
+			`<calledDevice><deviceIdentifier>%[2]s</deviceIdentifier></calledDevice>`+
+			`<lastRedirectionDevice><notRequired/></lastRedirectionDevice>`+
+			`<localConnectionInfo>alerting</localConnectionInfo>`+
+			`<cause>newCall</cause></DeliveredEvent>`,
+		callID, escape(user.Ext), escape(from)))
+	return callID
+}
+
+// Established отсылает пользователю событие об установленном соединении.
+func (s *Server) Established(login string, callID int64, from string) {
+	var user = s.user(login)
+	if user == nil {
+		return
+	}
+	s.Event(login, fmt.Sprintf(
+		`<EstablishedEvent>`+
+			`<establishedConnection><callID>%[1]d</callID><deviceID>%[2]s</deviceID>`+
+			`<globalCallID>%[1]d-gcid</globalCallID></establishedConnection>`+
+			`<answeringDevice><deviceIdentifier>%[2]s</deviceIdentifier></answeringDevice>`+
+			`<callingDevice><deviceIdentifier>%[3]s</deviceIdentifier></callingDevice>`+
+			`<calledDevice><deviceIdentifier>%[2]s</deviceIdentifier></calledDevice>`+
+			`<cause>normal</cause></EstablishedEvent>`,
+		callID, escape(user.Ext), escape(from)))
+}
+
+// Originated отсылает пользователю событие об исходящем звонке.
+func (s *Server) Originated(login string, callID int64, to string) {
+	var user = s.user(login)
+	if user == nil {
+		return
+	}
+	s.Event(login, fmt.Sprintf(
+		`<OriginatedEvent>`+
+			`<originatedConnection><callID>%[1]d</callID><deviceID>%[2]s</deviceID></originatedConnection>`+
+			`<callingDevice><deviceIdentifier>%[2]s</deviceIdentifier></callingDevice>`+
+			`<calledDevice><deviceIdentifier>%[3]s</deviceIdentifier></calledDevice>`+
+			`<cause>normal</cause></OriginatedEvent>`,
+		callID, escape(user.Ext), escape(to)))
+}
+
+// Cleared отсылает пользователю событие о завершении звонка.
+func (s *Server) Cleared(login string, callID int64) {
+	var user = s.user(login)
+	if user == nil {
+		return
+	}
+	s.Event(login, fmt.Sprintf(
+		`<ConnectionClearedEvent>`+
+			`<droppedConnection><callID>%[1]d</callID><deviceID>%[2]s</deviceID></droppedConnection>`+
+			`<releasingDevice><deviceIdentifier>%[2]s</deviceIdentifier></releasingDevice>`+
+			`<cause>normalClearing</cause></ConnectionClearedEvent>`,
+		callID, escape(user.Ext)))
+}
+
+// MailIncoming добавляет пользователю голосовое сообщение и отсылает событие
+// о его получении.
+func (s *Server) MailIncoming(login string, mail *Mail) {
+	if mail.Received == 0 {
+		mail.Received = time.Now().Unix()
+	}
+	if mail.OwnerType == "" {
+		mail.OwnerType = "user"
+	}
+	s.AddMail(login, mail)
+	var user = s.user(login)
+	if user == nil {
+		return
+	}
+	var mediaType = mail.MediaType
+	if mediaType == "" {
+		mediaType = "VoiceMail"
+	}
+	s.Event(login, &struct {
+		XMLName    xml.Name `xml:"MailIncomingReadyEvent"`
+		From       string   `xml:"from,attr"`
+		FromName   string   `xml:"fromName,attr"`
+		CallerName string   `xml:"callerName,attr"`
+		To         string   `xml:"to,attr"`
+		OwnerID    uint64   `xml:"ownerId,attr"`
+		OwnerType  string   `xml:"ownerType,attr"`
+		MonitorID  int64    `xml:"monitorCrossRefID"`
+		MailID     string   `xml:"mailId"`
+		Received   int64    `xml:"received"`
+		Duration   uint16   `xml:"duration"`
+		Read       bool     `xml:"read"`
+		Note       string   `xml:"note"`
+		MediaType  string   `xml:"mediaType"`
+	}{
+		From:       mail.From,
+		FromName:   mail.FromName,
+		CallerName: mail.CallerName,
+		To:         mail.To,
+		OwnerID:    user.JID,
+		OwnerType:  mail.OwnerType,
+		MonitorID:  1,
+		MailID:     mail.ID,
+		Received:   mail.Received,
+		Duration:   mail.Duration,
+		Read:       mail.Read,
+		Note:       mail.Note,
+		MediaType:  mediaType,
+	})
+}
+
+// ConferenceEvent отсылает пользователю событие об изменении конференции:
+// ConfAddEvent, ConfUpdEvent или ConfDelEvent.
+func (s *Server) ConferenceEvent(login, name string, conf *Conference) int {
+	var count int
+	for _, session := range s.Sessions(login) {
+		conferenceEvent(session, name, conf)
+		count++
+	}
+	return count
+}
@@ -0,0 +1,1221 @@
+package mxtest
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// User описывает пользователя сервера MX.
+type User struct {
+	Login        string // логин
+	Password     string // пароль
+	Ext          string // внутренний номер
+	JID          uint64 // идентификатор пользователя
+	SoftPhonePwd string // пароль софтфона
+	Token        string // токен для авторизации на сервере провижининга
+}
+
+// Contact описывает запись в адресной книге.
+type Contact struct {
+	XMLName    xml.Name `xml:"abentry"`
+	JID        uint64   `xml:"jid,attr"`
+	FirstName  string   `xml:"firstName"`
+	LastName   string   `xml:"lastName"`
+	Ext        string   `xml:"businessPhone"`
+	HomePhone  string   `xml:"homePhone,omitempty"`
+	CellPhone  string   `xml:"cellPhone,omitempty"`
+	Email      string   `xml:"email,omitempty"`
+	HomeSystem uint64   `xml:"homeSystem,omitempty"`
+	DID        string   `xml:"did,omitempty"`
+	ExchangeID string   `xml:"exchangeId,omitempty"`
+}
+
+// CallInfo описывает запись в логе звонков.
+type CallInfo struct {
+	XMLName               xml.Name `xml:"callinfo"`
+	Missed                bool     `xml:"missed,attr"`
+	Direction             string   `xml:"direction,attr"`
+	RecordID              int64    `xml:"record_id"`
+	GCID                  string   `xml:"gcid"`
+	ConnectTimestamp      int64    `xml:"connectTimestamp"`
+	DisconnectTimestamp   int64    `xml:"disconnectTimestamp"`
+	CallingPartyNo        string   `xml:"callingPartyNo"`
+	OriginalCalledPartyNo string   `xml:"originalCalledPartyNo"`
+	FirstName             string   `xml:"firstName,omitempty"`
+	LastName              string   `xml:"lastName,omitempty"`
+	Extension             string   `xml:"extension,omitempty"`
+	ServiceName           string   `xml:"serviceName,omitempty"`
+	ServiceExtension      string   `xml:"serviceExtension,omitempty"`
+	CallType              int64    `xml:"callType"`
+	LegType               int64    `xml:"legType"`
+	SelfLegType           int64    `xml:"selfLegType"`
+	MonitorType           int64    `xml:"monitorType"`
+}
+
+// Mail описывает голосовое сообщение или запись звонка.
+type Mail struct {
+	XMLName    xml.Name `xml:"mail"`
+	From       string   `xml:"from,attr"`
+	FromName   string   `xml:"fromName,attr,omitempty"`
+	CallerName string   `xml:"callerName,attr,omitempty"`
+	To         string   `xml:"to,attr"`
+	OwnerType  string   `xml:"ownerType,attr"`
+	ID         string   `xml:"mailId"`
+	MediaType  string   `xml:"mediaType,omitempty"`
+	Received   int64    `xml:"received"`
+	Duration   uint16   `xml:"duration"`
+	Read       bool     `xml:"read"`
+	Note       string   `xml:"note,omitempty"`
+	Format     string   `xml:"-"` // формат файла, например, wav
+	Name       string   `xml:"-"` // имя файла
+	Content    []byte   `xml:"-"` // содержимое файла
+}
+
+// Service описывает сервис сервера MX.
+type Service struct {
+	XMLName    xml.Name `xml:"Service"`
+	ID         uint64   `xml:"serviceId"`
+	Name       string   `xml:"serviceName"`
+	Type       string   `xml:"serviceType"`
+	Ext        string   `xml:"extension"`
+	HomeSystem uint64   `xml:"homeSystem,omitempty"`
+}
+
+// Conference описывает конференцию.
+type Conference struct {
+	ID              string `xml:"confId"`
+	OwnerID         uint64 `xml:"ownerId"`
+	Name            string `xml:"name"`
+	AccessID        int64  `xml:"accessId"`
+	Description     string `xml:"description"`
+	Type            string `xml:"type"`
+	StartDate       int64  `xml:"startDate"`
+	Duration        int64  `xml:"duration"`
+	WaitForOwner    bool   `xml:"waitForOwner"`
+	DelOnOwnerLeave bool   `xml:"delOnOwnerLeave"`
+	Ws              string `xml:"ws"`
+	WsType          string `xml:"wsType"`
+}
+
+// Forwarding описывает правило переадресации звонков.
+type Forwarding struct {
+	XMLName   xml.Name `xml:"forwardListItem"`
+	Type      string   `xml:"forwardingType"`
+	Active    bool     `xml:"forwardStatus"`
+	To        string   `xml:"forwardDN,omitempty"`
+	RingCount int      `xml:"ringCount,omitempty"`
+}
+
+// Forwarding возвращает правила переадресации звонков пользователя.
+func (s *Server) Forwarding(login string) []*Forwarding {
+	s.mu.RLock()
+	var list = make([]*Forwarding, 0, len(s.forwarding[login]))
+	for _, rule := range s.forwarding[login] {
+		var item = *rule
+		list = append(list, &item)
+	}
+	s.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Type < list[j].Type })
+	return list
+}
+
+// DoNotDisturb возвращает true, если у пользователя включен режим "не
+// беспокоить".
+func (s *Server) DoNotDisturb(login string) bool {
+	s.mu.RLock()
+	var on = s.dnd[login]
+	s.mu.RUnlock()
+	return on
+}
+
+// Presence описывает состояние присутствия пользователя.
+type Presence struct {
+	XMLName xml.Name `xml:"presence"`
+	JID     uint64   `xml:"jid"`
+	Status  string   `xml:"status"`
+	Note    string   `xml:"note,omitempty"`
+}
+
+// SetPresence изменяет состояние присутствия пользователя с указанным
+// идентификатором и отсылает событие об изменении всем авторизованным
+// сессиям. Возвращает количество сессий, которым было отправлено событие.
+func (s *Server) SetPresence(jid uint64, status, note string) int {
+	s.mu.Lock()
+	s.presence[jid] = &Presence{JID: jid, Status: status, Note: note}
+	s.mu.Unlock()
+	return s.Broadcast(fmt.Sprintf(
+		`<PresenceEvent><jid>%d</jid><status>%s</status><note>%s</note>`+
+			`</PresenceEvent>`, jid, escape(status), escape(note)))
+}
+
+// AgentState возвращает состояние агента пользователя в группах ACD по их
+// внутренним номерам.
+func (s *Server) AgentState(login string) map[string]string {
+	s.mu.RLock()
+	var states = make(map[string]string, len(s.agents[login]))
+	for group, state := range s.agents[login] {
+		states[group] = state
+	}
+	s.mu.RUnlock()
+	return states
+}
+
+// AddUser добавляет пользователя сервера. Если идентификатор пользователя не
+// задан, то он назначается автоматически.
+func (s *Server) AddUser(user *User) {
+	if user.JID == 0 {
+		user.JID = uint64(s.nextID())
+	}
+	s.mu.Lock()
+	s.users[user.Login] = user
+	s.mu.Unlock()
+}
+
+// AddContacts добавляет записи в адресную книгу.
+func (s *Server) AddContacts(contacts ...*Contact) {
+	s.mu.Lock()
+	s.contacts = append(s.contacts, contacts...)
+	s.mu.Unlock()
+}
+
+// AddCallLog добавляет записи в лог звонков пользователя. Если номер записи
+// не задан, то он назначается автоматически.
+func (s *Server) AddCallLog(login string, calls ...*CallInfo) {
+	for _, call := range calls {
+		if call.RecordID == 0 {
+			call.RecordID = s.nextID()
+		}
+	}
+	s.mu.Lock()
+	s.callLog[login] = append(s.callLog[login], calls...)
+	s.mu.Unlock()
+}
+
+// AddMail добавляет голосовое сообщение пользователя. Если идентификатор
+// сообщения не задан, то он назначается автоматически.
+func (s *Server) AddMail(login string, mail *Mail) {
+	if mail.ID == "" {
+		mail.ID = itoa(s.nextID())
+	}
+	if mail.Format == "" {
+		mail.Format = "wav"
+	}
+	if mail.Name == "" {
+		mail.Name = mail.ID + "." + mail.Format
+	}
+	s.mu.Lock()
+	s.mails[login] = append(s.mails[login], mail)
+	s.mu.Unlock()
+}
+
+// Mails возвращает список голосовых сообщений пользователя.
+func (s *Server) Mails(login string) []*Mail {
+	s.mu.RLock()
+	var list = append([]*Mail(nil), s.mails[login]...)
+	s.mu.RUnlock()
+	return list
+}
+
+// AddServices добавляет сервисы сервера.
+func (s *Server) AddServices(services ...*Service) {
+	s.mu.Lock()
+	s.services = append(s.services, services...)
+	s.mu.Unlock()
+}
+
+// Conferences возвращает список конференций.
+func (s *Server) Conferences() []*Conference {
+	s.mu.RLock()
+	var list = make([]*Conference, 0, len(s.conferences))
+	for _, conf := range s.conferences {
+		list = append(list, conf)
+	}
+	s.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// ConferenceParty описывает участника конференции.
+type ConferenceParty struct {
+	ID     string `xml:"partyId"`
+	JID    uint64 `xml:"jid,omitempty"`
+	Name   string `xml:"name,omitempty"`
+	Number string `xml:"number,omitempty"`
+	Owner  bool   `xml:"owner"`
+	Muted  bool   `xml:"muted"`
+}
+
+// JoinConference добавляет участника в конференцию и отсылает всем
+// авторизованным сессиям событие ConfPartyAddEvent. Если идентификатор
+// участника не задан, то он назначается автоматически. Возвращает количество
+// сессий, которым было отправлено событие.
+func (s *Server) JoinConference(confID string, party *ConferenceParty) int {
+	if party.ID == "" {
+		party.ID = itoa(s.nextID())
+	}
+	s.mu.Lock()
+	if s.parties[confID] == nil {
+		s.parties[confID] = make(map[string]*ConferenceParty)
+	}
+	var item = *party
+	s.parties[confID][party.ID] = &item
+	s.mu.Unlock()
+	return s.Broadcast(confPartyEvent("ConfPartyAddEvent", confID, party))
+}
+
+// LeaveConference удаляет участника из конференции и отсылает всем
+// авторизованным сессиям событие ConfPartyDelEvent. Возвращает количество
+// сессий, которым было отправлено событие.
+func (s *Server) LeaveConference(confID, partyID string) int {
+	s.mu.Lock()
+	var party, ok = s.parties[confID][partyID]
+	delete(s.parties[confID], partyID)
+	s.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	return s.Broadcast(confPartyEvent("ConfPartyDelEvent", confID, party))
+}
+
+// ConferenceParties возвращает список участников конференции.
+func (s *Server) ConferenceParties(confID string) []*ConferenceParty {
+	s.mu.RLock()
+	var list = make([]*ConferenceParty, 0, len(s.parties[confID]))
+	for _, party := range s.parties[confID] {
+		var item = *party
+		list = append(list, &item)
+	}
+	s.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// ConferenceLocked возвращает true, если вход в конференцию закрыт.
+func (s *Server) ConferenceLocked(confID string) bool {
+	s.mu.RLock()
+	var locked = s.locked[confID]
+	s.mu.RUnlock()
+	return locked
+}
+
+// mail возвращает голосовое сообщение пользователя по его идентификатору.
+func (s *Server) mail(login, id string) *Mail {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, mail := range s.mails[login] {
+		if mail.ID == id {
+			return mail
+		}
+	}
+	return nil
+}
+
+// Размеры "страниц" адресной книги и лога звонков, которыми их отдает
+// сервер MX.
+const (
+	AddressBookPageSize = 50
+	CallLogPageSize     = 21
+)
+
+// defaultHandlers возвращает обработчики команд по умолчанию.
+func defaultHandlers() map[string]HandlerFunc {
+	return map[string]HandlerFunc{
+		"loginRequest":           handleLogin,
+		"logout":                 nil,
+		"MonitorStart":           handleMonitorStart,
+		"MonitorStop":            reply("MonitorStopResponse"),
+		"iq/addressbook":         handleAddressBook,
+		"iq/calllog":             handleCallLog,
+		"iq/mode":                nil,
+		"AssignDevice":           handleAssignDevice,
+		"MakeCall":               handleMakeCall,
+		"AnswerCall":             reply("AnswerCallResponse"),
+		"SingleStepTransferCall": reply("SingleStepTransferCallResponse"),
+		"ClearConnection": callEvent("ClearConnectionResponse",
+			"ConnectionClearedEvent", "connectionToBeCleared",
+			"droppedConnection", "releasingDevice"),
+		"HoldCall": callEvent("HoldCallResponse", "HeldEvent",
+			"callToBeHeld", "heldConnection", "holdingDevice"),
+		"RetrieveCall": callEvent("RetrieveCallResponse", "RetrievedEvent",
+			"callToBeRetrieved", "retrievedConnection", "retrievingDevice"),
+		"GenerateDigits":      reply("GenerateDigitsResponse"),
+		"ConsultationCall":    handleConsultationCall,
+		"TransferCall":        handleTransferCall,
+		"AlternateCall":       handleAlternateCall,
+		"ReconnectCall":       handleReconnectCall,
+		"GetForwarding":       handleGetForwarding,
+		"SetForwarding":       handleSetForwarding,
+		"GetDoNotDisturb":     handleGetDoNotDisturb,
+		"SetDoNotDisturb":     handleSetDoNotDisturb,
+		"PresenceSubscribe":   handlePresenceSubscribe,
+		"SetPresence":         handleSetPresence,
+		"GetAgentState":       handleGetAgentState,
+		"SetAgentState":       handleSetAgentState,
+		"GroupPickupCall":     handlePickupCall,
+		"DirectedPickupCall":  handlePickupCall,
+		"ParkCall":            handleParkCall,
+		"StartRecording":      reply("StartRecordingResponse"),
+		"StopRecording":       reply("StopRecordingResponse"),
+		"MailGetListIncoming": handleMailList,
+		"MailReceiveIncoming": handleMailReceive,
+		"MailCancelReceive":   reply("MailCancelReceiveResponse"),
+		"MailDeleteIncoming":  handleMailDelete,
+		"MailSetStatus":       handleMailSetStatus,
+		"UpdateVmNote":        handleMailNote,
+		"GetServiceList":      handleServiceList,
+		"CreateConference":    handleConferenceCreate,
+		"UpdateConference":    handleConferenceUpdate,
+		"DeleteConference":    handleConferenceDelete,
+		"GetConfList":         handleConferenceList,
+		"GetConfServerInfo":   handleConferenceServerInfo,
+		"JoinConf":            handleConferenceJoin,
+		"CreateConfFromCalls": reply("CreateConfFromCallsResponse"),
+		"GetConfParties":      handleConferenceParties,
+		"MuteConfParty":       handleConferenceMute,
+		"DropConfParty":       handleConferenceDrop,
+		"LockConf":            handleConferenceLock,
+	}
+}
+
+// reply возвращает обработчик, отвечающий пустым элементом с указанным именем.
+func reply(name string) HandlerFunc {
+	return func(session *Session, req *Request) {
+		session.Reply(req, "<"+name+"/>")
+	}
+}
+
+// passwordHash возвращает хеш пароля в том виде, в котором его передает
+// клиент MX.
+func passwordHash(password string) string {
+	var hash = sha1.Sum([]byte(password))
+	return base64.StdEncoding.EncodeToString(hash[:]) + "\n"
+}
+
+// handleLogin авторизует пользователя. Пароль принимается как в открытом
+// виде, так и в виде хеша.
+func handleLogin(session *Session, req *Request) {
+	var login = new(struct {
+		UserName string `xml:"userName"`
+		Password string `xml:"pwd"`
+	})
+	if err := req.Decode(login); err != nil {
+		session.Reply(req, `<loginFailed Code="1">bad request</loginFailed>`)
+		return
+	}
+	var server = session.server
+	server.mu.RLock()
+	var user = server.users[login.UserName]
+	server.mu.RUnlock()
+	if user == nil || (login.Password != user.Password &&
+		strings.TrimSpace(login.Password) !=
+			strings.TrimSpace(passwordHash(user.Password))) {
+		session.Reply(req, fmt.Sprintf(
+			`<loginFailed Code="2" sn=%q apiversion="5">Invalid user name or password</loginFailed>`,
+			server.SN))
+		return
+	}
+	session.state.Lock()
+	session.user = user
+	session.chunks = make(map[string]int)
+	session.state.Unlock()
+	session.Reply(req, fmt.Sprintf(
+		`<loginResponce Code="0" sn=%q apiversion="5" ext=%q userId="%d" softPhonePwd=%q/>`,
+		server.SN, user.Ext, user.JID, user.SoftPhonePwd))
+}
+
+// handleMonitorStart запускает монитор звонков пользователя.
+func handleMonitorStart(session *Session, req *Request) {
+	session.state.Lock()
+	session.monitored = true
+	session.state.Unlock()
+	session.Reply(req, fmt.Sprintf(
+		`<MonitorStartResponse><monitorCrossRefID>%d</monitorCrossRefID>`+
+			`<actualMonitorMediaClass><voice>true</voice></actualMonitorMediaClass>`+
+			`</MonitorStartResponse>`, session.server.nextID()))
+}
+
+// handleAddressBook отдает "страницу" адресной книги с указанным номером.
+func handleAddressBook(session *Session, req *Request) {
+	var index, _ = strconv.Atoi(req.Attrs["index"])
+	var server = session.server
+	server.mu.RLock()
+	var total = len(server.contacts)
+	var page []*Contact
+	if from := index * AddressBookPageSize; from < total {
+		var to = from + AddressBookPageSize
+		if to > total {
+			to = total
+		}
+		page = server.contacts[from:to]
+	}
+	server.mu.RUnlock()
+	session.Reply(req, &struct {
+		XMLName  xml.Name   `xml:"ablist"`
+		Size     int        `xml:"size,attr"`
+		Index    int        `xml:"index,attr"`
+		Contacts []*Contact `xml:"abentry"`
+	}{
+		Size:     total,
+		Index:    index,
+		Contacts: page,
+	})
+}
+
+// handleCallLog отдает лог звонков пользователя блоками. Последний блок
+// содержит меньше записей, чем размер блока. Если количество записей кратно
+// размеру блока, то завершающий пустой блок отдается только при установленном
+// CallLogEmptyBlock.
+func handleCallLog(session *Session, req *Request) {
+	var timestamp, err = strconv.ParseInt(req.Attrs["timestamp"], 10, 64)
+	if err != nil {
+		timestamp = -1
+	}
+	var server = session.server
+	server.mu.RLock()
+	var calls []*CallInfo
+	for _, call := range server.callLog[session.User().Login] {
+		if timestamp < 0 || call.ConnectTimestamp > timestamp {
+			calls = append(calls, call)
+		}
+	}
+	var emptyBlock = server.CallLogEmptyBlock
+	server.mu.RUnlock()
+	for {
+		var size = len(calls)
+		if size > CallLogPageSize {
+			size = CallLogPageSize
+		}
+		if size == 0 && !emptyBlock {
+			return
+		}
+		session.Reply(req, &struct {
+			XMLName xml.Name    `xml:"callloginfo"`
+			Calls   []*CallInfo `xml:"callinfo"`
+		}{
+			Calls: calls[:size],
+		})
+		calls = calls[size:]
+		if size < CallLogPageSize {
+			return
+		}
+	}
+}
+
+// handleAssignDevice подтверждает ассоциацию устройства.
+func handleAssignDevice(session *Session, req *Request) {
+	var cmd = new(struct {
+		Device string `xml:"deviceID"`
+	})
+	req.Decode(cmd)
+	session.Reply(req, &struct {
+		XMLName xml.Name `xml:"AssignDeviceInfo"`
+		Device  string   `xml:"deviceID"`
+	}{
+		Device: cmd.Device,
+	})
+}
+
+// handleMakeCall отвечает на команду установки соединения.
+func handleMakeCall(session *Session, req *Request) {
+	var cmd = new(struct {
+		From string `xml:"callingDevice"`
+		To   string `xml:"calledDirectoryNumber"`
+	})
+	req.Decode(cmd)
+	session.Reply(req, fmt.Sprintf(
+		`<MakeCallResponse><callingDevice><callID>%d</callID>`+
+			`<deviceID>%s</deviceID></callingDevice>`+
+			`<calledDevice>%s</calledDevice></MakeCallResponse>`,
+		session.server.nextID(), escape(cmd.From), escape(cmd.To)))
+}
+
+// callEvent возвращает обработчик команды управления звонком, который
+// отвечает на команду и отправляет соответствующее событие.
+func callEvent(response, event, cmdElem, eventElem, deviceElem string) HandlerFunc {
+	return func(session *Session, req *Request) {
+		var cmd = new(struct {
+			Elems []struct {
+				XMLName  xml.Name
+				CallID   int64  `xml:"callID"`
+				DeviceID string `xml:"deviceID"`
+			} `xml:",any"`
+		})
+		req.Decode(cmd)
+		var callID int64
+		var deviceID string
+		for _, elem := range cmd.Elems {
+			if elem.XMLName.Local == cmdElem {
+				callID, deviceID = elem.CallID, elem.DeviceID
+			}
+		}
+		session.Reply(req, "<"+response+"/>")
+		callConnectionEvent(session, event, eventElem, deviceElem, callID,
+			deviceID)
+	}
+}
+
+// callConnectionEvent отсылает событие о соединении звонка.
+func callConnectionEvent(session *Session, event, eventElem, deviceElem string,
+	callID int64, deviceID string) {
+	session.Event(fmt.Sprintf(
+		`<%[1]s><%[2]s><callID>%[4]d</callID><deviceID>%[5]s</deviceID></%[2]s>`+
+			`<%[3]s><deviceIdentifier>%[5]s</deviceIdentifier></%[3]s>`+
+			`<cause>normal</cause></%[1]s>`,
+		event, eventElem, deviceElem, callID, escape(deviceID)))
+}
+
+// callConnection описывает соединение звонка в командах.
+type callConnection struct {
+	CallID   int64  `xml:"callID"`
+	DeviceID string `xml:"deviceID"`
+}
+
+// handleConsultationCall ставит звонок на удержание и отвечает
+// идентификатором нового консультационного звонка.
+func handleConsultationCall(session *Session, req *Request) {
+	var cmd = new(struct {
+		Existing callConnection `xml:"existingCall"`
+		To       string         `xml:"consultedDevice"`
+	})
+	req.Decode(cmd)
+	session.Reply(req, fmt.Sprintf(
+		`<ConsultationCallResponse><initiatedCall><callID>%d</callID>`+
+			`<deviceID>%s</deviceID></initiatedCall></ConsultationCallResponse>`,
+		session.server.nextID(), escape(cmd.Existing.DeviceID)))
+	callConnectionEvent(session, "HeldEvent", "heldConnection",
+		"holdingDevice", cmd.Existing.CallID, cmd.Existing.DeviceID)
+}
+
+// callPair разбирает команду с удерживаемым и активным звонками.
+func callPair(req *Request) (held, active callConnection) {
+	var cmd = new(struct {
+		Held   callConnection `xml:"heldCall"`
+		Active callConnection `xml:"activeCall"`
+	})
+	req.Decode(cmd)
+	return cmd.Held, cmd.Active
+}
+
+// handleTransferCall соединяет удерживаемый и активный звонки.
+func handleTransferCall(session *Session, req *Request) {
+	var held, active = callPair(req)
+	session.Reply(req, "<TransferCallResponse/>")
+	session.Event(fmt.Sprintf(
+		`<TransferedEvent><primaryOldCall><callID>%d</callID>`+
+			`<deviceID>%s</deviceID></primaryOldCall>`+
+			`<secondaryOldCall><callID>%d</callID><deviceID>%s</deviceID>`+
+			`</secondaryOldCall><transferringDevice><deviceIdentifier>%s`+
+			`</deviceIdentifier></transferringDevice>`+
+			`<cause>normal</cause></TransferedEvent>`,
+		held.CallID, escape(held.DeviceID), active.CallID,
+		escape(active.DeviceID), escape(held.DeviceID)))
+}
+
+// handleAlternateCall ставит активный звонок на удержание и снимает с
+// удержания другой.
+func handleAlternateCall(session *Session, req *Request) {
+	var held, active = callPair(req)
+	session.Reply(req, "<AlternateCallResponse/>")
+	callConnectionEvent(session, "HeldEvent", "heldConnection",
+		"holdingDevice", active.CallID, active.DeviceID)
+	callConnectionEvent(session, "RetrievedEvent", "retrievedConnection",
+		"retrievingDevice", held.CallID, held.DeviceID)
+}
+
+// handleReconnectCall сбрасывает активный звонок и снимает с удержания
+// другой.
+func handleReconnectCall(session *Session, req *Request) {
+	var held, active = callPair(req)
+	session.Reply(req, "<ReconnectCallResponse/>")
+	callConnectionEvent(session, "ConnectionClearedEvent", "droppedConnection",
+		"releasingDevice", active.CallID, active.DeviceID)
+	callConnectionEvent(session, "RetrievedEvent", "retrievedConnection",
+		"retrievingDevice", held.CallID, held.DeviceID)
+}
+
+// handleGetForwarding отдает правила переадресации звонков пользователя.
+func handleGetForwarding(session *Session, req *Request) {
+	session.Reply(req, &struct {
+		XMLName xml.Name      `xml:"GetForwardingResponse"`
+		List    []*Forwarding `xml:"forwardingList>forwardListItem"`
+	}{
+		List: session.server.Forwarding(session.User().Login),
+	})
+}
+
+// handleSetForwarding изменяет правило переадресации звонков и отсылает
+// событие об изменении.
+func handleSetForwarding(session *Session, req *Request) {
+	var cmd = new(struct {
+		Device    string `xml:"device"`
+		Type      string `xml:"forwardingType"`
+		Active    bool   `xml:"activateForward"`
+		To        string `xml:"forwardDN"`
+		RingCount int    `xml:"ringCount"`
+	})
+	req.Decode(cmd)
+	var server = session.server
+	var login = session.User().Login
+	server.mu.Lock()
+	if server.forwarding[login] == nil {
+		server.forwarding[login] = make(map[string]*Forwarding)
+	}
+	server.forwarding[login][cmd.Type] = &Forwarding{
+		Type:      cmd.Type,
+		Active:    cmd.Active,
+		To:        cmd.To,
+		RingCount: cmd.RingCount,
+	}
+	server.mu.Unlock()
+	session.Reply(req, "<SetForwardingResponse/>")
+	session.Event(fmt.Sprintf(
+		`<ForwardingEvent><device><deviceIdentifier>%s</deviceIdentifier></device>`+
+			`<forwardingType>%s</forwardingType><forwardStatus>%t</forwardStatus>`+
+			`<forwardTo>%s</forwardTo><ringCount>%d</ringCount></ForwardingEvent>`,
+		escape(cmd.Device), escape(cmd.Type), cmd.Active, escape(cmd.To),
+		cmd.RingCount))
+}
+
+// handleGetDoNotDisturb отдает состояние режима "не беспокоить".
+func handleGetDoNotDisturb(session *Session, req *Request) {
+	session.Reply(req, fmt.Sprintf(
+		`<GetDoNotDisturbResponse><doNotDisturbOn>%t</doNotDisturbOn>`+
+			`</GetDoNotDisturbResponse>`,
+		session.server.DoNotDisturb(session.User().Login)))
+}
+
+// handleSetDoNotDisturb изменяет режим "не беспокоить" и отсылает событие об
+// изменении.
+func handleSetDoNotDisturb(session *Session, req *Request) {
+	var cmd = new(struct {
+		Device string `xml:"device"`
+		On     bool   `xml:"doNotDisturbOn"`
+	})
+	req.Decode(cmd)
+	var server = session.server
+	server.mu.Lock()
+	server.dnd[session.User().Login] = cmd.On
+	server.mu.Unlock()
+	session.Reply(req, "<SetDoNotDisturbResponse/>")
+	session.Event(fmt.Sprintf(
+		`<DoNotDisturbEvent><device><deviceIdentifier>%s</deviceIdentifier>`+
+			`</device><doNotDisturbOn>%t</doNotDisturbOn></DoNotDisturbEvent>`,
+		escape(cmd.Device), cmd.On))
+}
+
+// handlePresenceSubscribe отдает состояние присутствия запрошенных
+// пользователей. Пользователи, присутствие которых не задано, не
+// возвращаются.
+func handlePresenceSubscribe(session *Session, req *Request) {
+	var cmd = new(struct {
+		JIDs []uint64 `xml:"jid"`
+	})
+	req.Decode(cmd)
+	var server = session.server
+	var list = make([]*Presence, 0, len(cmd.JIDs))
+	server.mu.RLock()
+	for _, jid := range cmd.JIDs {
+		if presence, ok := server.presence[jid]; ok {
+			var item = *presence
+			list = append(list, &item)
+		}
+	}
+	server.mu.RUnlock()
+	session.Reply(req, &struct {
+		XMLName xml.Name    `xml:"PresenceSubscribeResponse"`
+		List    []*Presence `xml:"presence"`
+	}{
+		List: list,
+	})
+}
+
+// handleSetPresence изменяет присутствие пользователя сессии.
+func handleSetPresence(session *Session, req *Request) {
+	var cmd = new(struct {
+		Status string `xml:"status"`
+		Note   string `xml:"note"`
+	})
+	req.Decode(cmd)
+	session.Reply(req, "<SetPresenceResponse/>")
+	session.server.SetPresence(session.User().JID, cmd.Status, cmd.Note)
+}
+
+// agentStateNames задает соответствие запрашиваемых состояний агента и
+// состояний, возвращаемых сервером, а так же имена событий о них.
+var agentStateNames = map[string][2]string{
+	"ready":            {"agentReady", "AgentReadyEvent"},
+	"notReady":         {"agentNotReady", "AgentNotReadyEvent"},
+	"workingAfterCall": {"agentWorkingAfterCall", "AgentWorkingAfterCallEvent"},
+	"loggedOn":         {"agentNotReady", "AgentLoggedOnEvent"},
+	"loggedOff":        {"", "AgentLoggedOffEvent"},
+}
+
+// handleGetAgentState отдает состояние агента в группах ACD.
+func handleGetAgentState(session *Session, req *Request) {
+	type entry struct {
+		Group string `xml:"acdGroup"`
+		State string `xml:"agentState"`
+	}
+	var states = session.server.AgentState(session.User().Login)
+	var list = make([]entry, 0, len(states))
+	for group, state := range states {
+		list = append(list, entry{Group: group, State: state})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Group < list[j].Group })
+	session.Reply(req, &struct {
+		XMLName xml.Name `xml:"GetAgentStateResponse"`
+		List    []entry  `xml:"agentStateList>agentStateEntry"`
+	}{
+		List: list,
+	})
+}
+
+// handleSetAgentState изменяет состояние агента в указанной группе ACD или во
+// всех группах, в которых он зарегистрирован, и отсылает события об
+// изменении.
+func handleSetAgentState(session *Session, req *Request) {
+	var cmd = new(struct {
+		Device string `xml:"device"`
+		State  string `xml:"requestedAgentState"`
+		Group  string `xml:"acdGroup"`
+	})
+	req.Decode(cmd)
+	names, ok := agentStateNames[cmd.State]
+	if !ok {
+		session.Error(req, "invalidAgentState")
+		return
+	}
+	var server = session.server
+	var login = session.User().Login
+	var groups []string
+	server.mu.Lock()
+	var states = server.agents[login]
+	if states == nil {
+		states = make(map[string]string)
+		server.agents[login] = states
+	}
+	if cmd.Group != "" {
+		groups = append(groups, cmd.Group)
+	} else {
+		for group := range states {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+	}
+	for _, group := range groups {
+		if names[0] == "" {
+			delete(states, group)
+		} else {
+			states[group] = names[0]
+		}
+	}
+	server.mu.Unlock()
+	session.Reply(req, "<SetAgentStateResponse/>")
+	for _, group := range groups {
+		session.Event(fmt.Sprintf(
+			`<%[1]s><agentDevice><deviceIdentifier>%[2]s</deviceIdentifier>`+
+				`</agentDevice><agentID>%[2]s</agentID><acdGroup>`+
+				`<deviceIdentifier>%[3]s</deviceIdentifier></acdGroup></%[1]s>`,
+			names[1], escape(cmd.Device), escape(group)))
+	}
+}
+
+// handlePickupCall отвечает на команду перехвата звонка идентификатором
+// перехваченного звонка.
+func handlePickupCall(session *Session, req *Request) {
+	var cmd = new(struct {
+		Destination string `xml:"newDestination"`
+		Requesting  string `xml:"requestingDevice"`
+	})
+	req.Decode(cmd)
+	var device = cmd.Destination
+	if device == "" {
+		device = cmd.Requesting
+	}
+	session.Reply(req, fmt.Sprintf(
+		`<%[1]sResponse><pickedCall><callID>%[2]d</callID>`+
+			`<deviceID>%[3]s</deviceID></pickedCall></%[1]sResponse>`,
+		req.Name, session.server.nextID(), escape(device)))
+}
+
+// handleParkCall паркует звонок и отправляет событие о его завершении на
+// устройстве пользователя. Если орбита не указана, то она назначается
+// автоматически.
+func handleParkCall(session *Session, req *Request) {
+	var cmd = new(struct {
+		Parking callConnection `xml:"parking"`
+		Orbit   string         `xml:"parkTo"`
+	})
+	req.Decode(cmd)
+	if cmd.Orbit == "" {
+		cmd.Orbit = strconv.FormatInt(session.server.nextID()%100, 10)
+	}
+	session.Reply(req, fmt.Sprintf(
+		`<ParkCallResponse><parkedTo>%s</parkedTo></ParkCallResponse>`,
+		escape(cmd.Orbit)))
+	callConnectionEvent(session, "ConnectionClearedEvent", "droppedConnection",
+		"releasingDevice", cmd.Parking.CallID, cmd.Parking.DeviceID)
+}
+
+// handleMailList отдает список голосовых сообщений пользователя.
+func handleMailList(session *Session, req *Request) {
+	session.Reply(req, &struct {
+		XMLName xml.Name `xml:"MailGetListIncomingResponse"`
+		Mails   []*Mail  `xml:"mail"`
+	}{
+		Mails: session.server.Mails(session.User().Login),
+	})
+}
+
+// handleMailReceive отдает очередной кусок файла голосового сообщения. Команда
+// без элемента nextChunk начинает отдачу файла с начала.
+func handleMailReceive(session *Session, req *Request) {
+	var cmd = new(struct {
+		ID   string  `xml:"faxSessionID"`
+		Next *string `xml:"nextChunk"`
+	})
+	req.Decode(cmd)
+	var mail = session.server.mail(session.User().Login, cmd.ID)
+	if mail == nil {
+		session.Error(req, "invalidObjectIdentifier")
+		return
+	}
+	var size = session.server.ChunkSize
+	if size <= 0 {
+		size = 8 << 10
+	}
+	var total = (len(mail.Content) + size - 1) / size
+	if total == 0 {
+		total = 1
+	}
+	session.state.Lock()
+	var number = 1
+	if cmd.Next != nil {
+		number = session.chunks[cmd.ID] + 1
+	}
+	if number > total {
+		number = total
+	}
+	session.chunks[cmd.ID] = number
+	session.state.Unlock()
+	var from, to = (number - 1) * size, number * size
+	if from > len(mail.Content) {
+		from = len(mail.Content)
+	}
+	if to > len(mail.Content) {
+		to = len(mail.Content)
+	}
+	session.Reply(req, fmt.Sprintf(
+		`<MailReceiveIncomingResponse mailId=%q chunkNumber="%d" totalChunks="%d">`+
+			`<fileFormat>%s</fileFormat><documentName>%s</documentName>`+
+			`<mediaContent>%s</mediaContent></MailReceiveIncomingResponse>`,
+		mail.ID, number, total, escape(mail.Format), escape(mail.Name),
+		base64.StdEncoding.EncodeToString(mail.Content[from:to])))
+}
+
+// handleMailDelete удаляет голосовое сообщение. Удаление несуществующего
+// сообщения не является ошибкой.
+func handleMailDelete(session *Session, req *Request) {
+	var cmd = new(struct {
+		ID string `xml:"mailId"`
+	})
+	req.Decode(cmd)
+	var server = session.server
+	var login = session.User().Login
+	server.mu.Lock()
+	var mails = server.mails[login][:0]
+	for _, mail := range server.mails[login] {
+		if mail.ID != cmd.ID {
+			mails = append(mails, mail)
+		}
+	}
+	server.mails[login] = mails
+	server.mu.Unlock()
+	session.Reply(req, "<MailDeleteIncomingResponse/>")
+}
+
+// handleMailSetStatus изменяет флаг прочтения голосового сообщения.
+func handleMailSetStatus(session *Session, req *Request) {
+	var cmd = new(struct {
+		ID   string `xml:"mailId"`
+		Read bool   `xml:"read"`
+	})
+	req.Decode(cmd)
+	if mail := session.server.mail(session.User().Login, cmd.ID); mail != nil {
+		session.server.mu.Lock()
+		mail.Read = cmd.Read
+		session.server.mu.Unlock()
+	}
+	session.Reply(req, "<MailSetStatusResponse/>")
+}
+
+// handleMailNote изменяет комментарий голосового сообщения.
+func handleMailNote(session *Session, req *Request) {
+	var cmd = new(struct {
+		ID   string `xml:"mailId"`
+		Note string `xml:"note"`
+	})
+	req.Decode(cmd)
+	if mail := session.server.mail(session.User().Login, cmd.ID); mail != nil {
+		session.server.mu.Lock()
+		mail.Note = cmd.Note
+		session.server.mu.Unlock()
+	}
+	session.Reply(req, "<UpdateVmNoteResponse/>")
+}
+
+// handleServiceList отдает список сервисов сервера.
+func handleServiceList(session *Session, req *Request) {
+	var server = session.server
+	server.mu.RLock()
+	var services = append([]*Service(nil), server.services...)
+	server.mu.RUnlock()
+	session.Reply(req, &struct {
+		XMLName  xml.Name   `xml:"GetServiceListResponse"`
+		Services []*Service `xml:"Service"`
+	}{
+		Services: services,
+	})
+}
+
+// conferenceEvent отсылает событие об изменении конференции.
+func conferenceEvent(session *Session, name string, conf *Conference) {
+	session.Event(&struct {
+		XMLName xml.Name
+		*Conference
+	}{
+		XMLName:    xml.Name{Local: name},
+		Conference: conf,
+	})
+}
+
+// handleConferenceCreate создает конференцию.
+func handleConferenceCreate(session *Session, req *Request) {
+	var conf = new(Conference)
+	req.Decode(conf)
+	conf.ID = itoa(session.server.nextID())
+	session.server.mu.Lock()
+	session.server.conferences[conf.ID] = conf
+	session.server.mu.Unlock()
+	session.Reply(req, "<CreateConferenceResponse/>")
+	conferenceEvent(session, "ConfAddEvent", conf)
+}
+
+// handleConferenceUpdate изменяет конференцию.
+func handleConferenceUpdate(session *Session, req *Request) {
+	var conf = new(Conference)
+	req.Decode(conf)
+	var server = session.server
+	server.mu.Lock()
+	_, ok := server.conferences[conf.ID]
+	if ok {
+		server.conferences[conf.ID] = conf
+	}
+	server.mu.Unlock()
+	if !ok {
+		session.Error(req, "invalidObjectIdentifier")
+		return
+	}
+	session.Reply(req, "<UpdateConferenceResponse/>")
+	conferenceEvent(session, "ConfUpdEvent", conf)
+}
+
+// handleConferenceDelete удаляет конференцию.
+func handleConferenceDelete(session *Session, req *Request) {
+	var cmd = new(struct {
+		ID string `xml:"confId"`
+	})
+	req.Decode(cmd)
+	var server = session.server
+	server.mu.Lock()
+	conf, ok := server.conferences[cmd.ID]
+	delete(server.conferences, cmd.ID)
+	delete(server.parties, cmd.ID)
+	delete(server.locked, cmd.ID)
+	server.mu.Unlock()
+	if !ok {
+		session.Error(req, "invalidObjectIdentifier")
+		return
+	}
+	session.Reply(req, "<DeleteConferenceResponse/>")
+	conferenceEvent(session, "ConfDelEvent", conf)
+}
+
+// handleConferenceList отдает список конференций пользователя.
+func handleConferenceList(session *Session, req *Request) {
+	var owner = session.User().JID
+	var list []*Conference
+	for _, conf := range session.server.Conferences() {
+		if conf.OwnerID == owner {
+			list = append(list, conf)
+		}
+	}
+	session.Reply(req, &struct {
+		XMLName     xml.Name      `xml:"GetConfListResponse"`
+		Conferences []*Conference `xml:"conferences>conf"`
+	}{
+		Conferences: list,
+	})
+}
+
+// handleConferenceServerInfo отдает информацию о сервере конференций.
+func handleConferenceServerInfo(session *Session, req *Request) {
+	session.Reply(req, `<GetConfServerInfoResponse>`+
+		`<extension>3900</extension><DID>+15550003900</DID>`+
+		`<inviteSubject>Conference</inviteSubject>`+
+		`<inviteBody>Join conference</inviteBody>`+
+		`<inviteMXmeeting>https://meeting.example.com</inviteMXmeeting>`+
+		`</GetConfServerInfoResponse>`)
+}
+
+// confPartyEvent возвращает событие об изменении участника конференции.
+func confPartyEvent(name, confID string, party *ConferenceParty) interface{} {
+	return &struct {
+		XMLName xml.Name
+		ConfID  string `xml:"confId"`
+		*ConferenceParty
+	}{
+		XMLName:         xml.Name{Local: name},
+		ConfID:          confID,
+		ConferenceParty: party,
+	}
+}
+
+// confOwner проверяет, что конференция существует и пользователь сессии
+// является ее владельцем. При ошибке отсылает ответ с ее описанием.
+func confOwner(session *Session, req *Request, confID string) bool {
+	var server = session.server
+	server.mu.RLock()
+	var conf = server.conferences[confID]
+	server.mu.RUnlock()
+	if conf == nil {
+		session.Error(req, "invalidObjectIdentifier")
+		return false
+	}
+	if conf.OwnerID != session.User().JID {
+		session.Error(req, "privilegeViolationSpecifiedDevice")
+		return false
+	}
+	return true
+}
+
+// handleConferenceParties отдает список участников конференции.
+func handleConferenceParties(session *Session, req *Request) {
+	var cmd = new(struct {
+		ID string `xml:"confId"`
+	})
+	req.Decode(cmd)
+	var server = session.server
+	server.mu.RLock()
+	_, ok := server.conferences[cmd.ID]
+	server.mu.RUnlock()
+	if !ok {
+		session.Error(req, "invalidObjectIdentifier")
+		return
+	}
+	session.Reply(req, &struct {
+		XMLName xml.Name           `xml:"GetConfPartiesResponse"`
+		Locked  bool               `xml:"locked"`
+		Parties []*ConferenceParty `xml:"party"`
+	}{
+		Locked:  server.ConferenceLocked(cmd.ID),
+		Parties: server.ConferenceParties(cmd.ID),
+	})
+}
+
+// handleConferenceJoin присоединяет к конференции, если вход в нее не
+// закрыт.
+func handleConferenceJoin(session *Session, req *Request) {
+	var cmd = new(struct {
+		ID string `xml:"callId"`
+	})
+	req.Decode(cmd)
+	if session.server.ConferenceLocked(cmd.ID) {
+		session.Error(req, "privilegeViolationSpecifiedDevice")
+		return
+	}
+	session.Reply(req, "<JoinConfResponse/>")
+}
+
+// handleConferenceMute выключает или включает микрофон участника
+// конференции.
+func handleConferenceMute(session *Session, req *Request) {
+	var cmd = new(struct {
+		ID      string `xml:"confId"`
+		PartyID string `xml:"partyId"`
+		Mute    bool   `xml:"mute"`
+	})
+	req.Decode(cmd)
+	if !confOwner(session, req, cmd.ID) {
+		return
+	}
+	var server = session.server
+	server.mu.Lock()
+	var party, ok = server.parties[cmd.ID][cmd.PartyID]
+	var item ConferenceParty
+	if ok {
+		party.Muted = cmd.Mute
+		item = *party
+	}
+	server.mu.Unlock()
+	if !ok {
+		session.Error(req, "invalidConnectionID")
+		return
+	}
+	session.Reply(req, "<MuteConfPartyResponse/>")
+	server.Broadcast(confPartyEvent("ConfPartyUpdEvent", cmd.ID, &item))
+}
+
+// handleConferenceDrop отключает участника от конференции.
+func handleConferenceDrop(session *Session, req *Request) {
+	var cmd = new(struct {
+		ID      string `xml:"confId"`
+		PartyID string `xml:"partyId"`
+	})
+	req.Decode(cmd)
+	if !confOwner(session, req, cmd.ID) {
+		return
+	}
+	var server = session.server
+	server.mu.RLock()
+	_, ok := server.parties[cmd.ID][cmd.PartyID]
+	server.mu.RUnlock()
+	if !ok {
+		session.Error(req, "invalidConnectionID")
+		return
+	}
+	session.Reply(req, "<DropConfPartyResponse/>")
+	server.LeaveConference(cmd.ID, cmd.PartyID)
+}
+
+// handleConferenceLock закрывает или открывает вход в конференцию.
+func handleConferenceLock(session *Session, req *Request) {
+	var cmd = new(struct {
+		ID   string `xml:"confId"`
+		Lock bool   `xml:"lock"`
+	})
+	req.Decode(cmd)
+	if !confOwner(session, req, cmd.ID) {
+		return
+	}
+	var server = session.server
+	server.mu.Lock()
+	server.locked[cmd.ID] = cmd.Lock
+	server.mu.Unlock()
+	session.Reply(req, "<LockConfResponse/>")
+	server.Broadcast(fmt.Sprintf(
+		`<ConfLockEvent><confId>%s</confId><locked>%t</locked></ConfLockEvent>`,
+		escape(cmd.ID), cmd.Lock))
+}
+
+// escape возвращает строку, экранированную для вставки в XML.
+func escape(s string) string {
+	var buf strings.Builder
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
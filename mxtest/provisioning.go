@@ -0,0 +1,58 @@
+package mxtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// ProvisioningHandler возвращает обработчик HTTP, имитирующий сервер
+// провижининга: для пользователя, авторизованного по логину и паролю (HTTP
+// Basic) или по токену (Bearer), отдается конфигурация для подключения к
+// данному серверу MX.
+func (s *Server) ProvisioningHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user *User
+		if login, password, ok := r.BasicAuth(); ok {
+			if user = s.user(login); user != nil && user.Password != password {
+				user = nil
+			}
+		} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			var token = strings.TrimPrefix(auth, "Bearer ")
+			s.mu.RLock()
+			for _, u := range s.users {
+				if u.Token != "" && u.Token == token {
+					user = u
+					break
+				}
+			}
+			s.mu.RUnlock()
+		}
+		if user == nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized),
+				http.StatusUnauthorized)
+			return
+		}
+		type mxConfig struct {
+			Login    string `json:"account_name"`
+			Password string `json:"account_pwd"`
+			Host     string `json:"address"`
+			Port     string `json:"csta_port"`
+			SSL      bool   `json:"csta_ssl"`
+			SN       string `json:"sn"`
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(&struct {
+			MX *mxConfig `json:"MX"`
+		}{
+			MX: &mxConfig{
+				Login:    user.Login,
+				Password: user.Password,
+				Host:     s.Host(),
+				Port:     s.Port(),
+				SSL:      s.tls,
+				SN:       s.SN,
+			},
+		})
+	})
+}
@@ -0,0 +1,457 @@
+// Package mxtest реализует имитацию сервера MX для интеграционного
+// тестирования: сервер принимает соединения CSTA, авторизует пользователей,
+// отвечает на команды по заданному сценарию и позволяет отправлять события
+// подключенным пользователям.
+//
+// Сервер запускается на локальном адресе, по аналогии с httptest.Server:
+//
+//	var server = mxtest.NewServer()
+//	defer server.Close()
+//	server.AddUser(&mxtest.User{Login: "test", Password: "test", Ext: "3044"})
+//	conn, err := mx.Connect(server.Addr())
+package mxtest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventID задает идентификатор, с которым сервер MX отправляет события, не
+// являющиеся ответом на команду.
+const EventID = "9999"
+
+// Server описывает имитацию сервера MX.
+type Server struct {
+	// Logger используется для вывода отладочной информации. Если не задан, то
+	// вывод не осуществляется.
+	Logger *log.Logger
+	// ChunkSize задает размер куска файла голосовой почты, отдаваемого
+	// командой MailReceiveIncoming. По умолчанию - 8 Кб.
+	ChunkSize int
+	// SN задает серийный номер сервера MX, возвращаемый при авторизации.
+	SN string
+	// CallLogEmptyBlock задает отдачу завершающего пустого блока лога звонков,
+	// если количество записей кратно размеру блока. По умолчанию такой блок
+	// не отдается, и клиент определяет окончание лога по таймауту.
+	CallLogEmptyBlock bool
+
+	listener    net.Listener
+	tls         bool
+	handlers    map[string]HandlerFunc
+	users       map[string]*User       // пользователи по логину
+	contacts    []*Contact             // адресная книга
+	callLog     map[string][]*CallInfo // лог звонков по логину
+	mails       map[string][]*Mail     // голосовая почта по логину
+	services    []*Service             // сервисы сервера
+	conferences map[string]*Conference
+	parties     map[string]map[string]*ConferenceParty // участники конференций
+	locked      map[string]bool                        // закрытые конференции
+	forwarding  map[string]map[string]*Forwarding      // переадресация по логину
+	dnd         map[string]bool                        // режим "не беспокоить"
+	presence    map[uint64]*Presence                   // присутствие пользователей
+	agents      map[string]map[string]string           // состояние агентов в группах
+	sessions    map[*Session]bool                      // активные сессии
+	received    []string                               // имена полученных команд
+	sequence    int64                                  // счетчик идентификаторов
+	mu          sync.RWMutex
+	wg          sync.WaitGroup
+}
+
+// NewUnstartedServer возвращает новый не запущенный сервер с обработчиками
+// команд по умолчанию.
+func NewUnstartedServer() *Server {
+	var s = &Server{
+		ChunkSize:   8 << 10,
+		SN:          "63022",
+		users:       make(map[string]*User),
+		callLog:     make(map[string][]*CallInfo),
+		mails:       make(map[string][]*Mail),
+		conferences: make(map[string]*Conference),
+		parties:     make(map[string]map[string]*ConferenceParty),
+		locked:      make(map[string]bool),
+		forwarding:  make(map[string]map[string]*Forwarding),
+		dnd:         make(map[string]bool),
+		presence:    make(map[uint64]*Presence),
+		agents:      make(map[string]map[string]string),
+		sessions:    make(map[*Session]bool),
+		sequence:    1000,
+	}
+	s.handlers = defaultHandlers()
+	return s
+}
+
+// NewServer запускает и возвращает новый сервер, принимающий соединения по
+// TLS, как это делает настоящий сервер MX.
+func NewServer() *Server {
+	var s = NewUnstartedServer()
+	s.StartTLS()
+	return s
+}
+
+// Start запускает сервер без шифрования соединений.
+func (s *Server) Start() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("mxtest: failed to listen: %v", err))
+	}
+	s.serve(listener)
+}
+
+// StartTLS запускает сервер, принимающий соединения по TLS с самоподписанным
+// сертификатом.
+func (s *Server) StartTLS() {
+	cert, err := selfSignedCert()
+	if err != nil {
+		panic(fmt.Sprintf("mxtest: failed to create certificate: %v", err))
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		panic(fmt.Sprintf("mxtest: failed to listen: %v", err))
+	}
+	s.tls = true
+	s.serve(listener)
+}
+
+// serve запускает обработку входящих соединений.
+func (s *Server) serve(listener net.Listener) {
+	s.listener = listener
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var session = &Session{
+				server: s,
+				conn:   conn,
+			}
+			s.mu.Lock()
+			s.sessions[session] = true
+			s.mu.Unlock()
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				session.serve()
+				s.mu.Lock()
+				delete(s.sessions, session)
+				s.mu.Unlock()
+			}()
+		}
+	}()
+}
+
+// Addr возвращает адрес сервера в формате host:port.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Host возвращает имя хоста сервера.
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr())
+	return host
+}
+
+// Port возвращает порт сервера.
+func (s *Server) Port() string {
+	_, port, _ := net.SplitHostPort(s.Addr())
+	return port
+}
+
+// Close останавливает сервер, закрывает все соединения и дожидается окончания
+// их обработки.
+func (s *Server) Close() error {
+	var err = s.listener.Close()
+	s.mu.Lock()
+	for session := range s.sessions {
+		session.conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// Handle задает обработчик команды с указанным именем, заменяя обработчик по
+// умолчанию. Для команд iq в качестве имени используется "iq/" и значение
+// атрибута id, например, "iq/addressbook". Если обработчик равен nil, то
+// команда игнорируется.
+func (s *Server) Handle(name string, handler HandlerFunc) {
+	s.mu.Lock()
+	s.handlers[name] = handler
+	s.mu.Unlock()
+}
+
+// Received возвращает список имен всех полученных сервером команд в порядке
+// их получения.
+func (s *Server) Received() []string {
+	s.mu.RLock()
+	var list = append([]string(nil), s.received...)
+	s.mu.RUnlock()
+	return list
+}
+
+// Sessions возвращает список авторизованных сессий пользователя.
+func (s *Server) Sessions(login string) []*Session {
+	var list []*Session
+	s.mu.RLock()
+	for session := range s.sessions {
+		if user := session.User(); user != nil && user.Login == login {
+			list = append(list, session)
+		}
+	}
+	s.mu.RUnlock()
+	return list
+}
+
+// Disconnect разрывает все соединения пользователя, имитируя потерю связи с
+// сервером MX. Возвращает количество разорванных соединений.
+func (s *Server) Disconnect(login string) int {
+	var sessions = s.Sessions(login)
+	for _, session := range sessions {
+		session.Close()
+	}
+	return len(sessions)
+}
+
+// nextID возвращает новый уникальный идентификатор.
+func (s *Server) nextID() int64 {
+	s.mu.Lock()
+	s.sequence++
+	var id = s.sequence
+	s.mu.Unlock()
+	return id
+}
+
+// logf выводит отладочную информацию, если задан Logger.
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
+	}
+}
+
+// Session описывает соединение клиента с сервером.
+type Session struct {
+	server    *Server
+	conn      net.Conn
+	user      *User          // авторизованный пользователь
+	monitored bool           // запущен монитор
+	chunks    map[string]int // номер следующего куска голосовой почты
+	mu        sync.Mutex     // блокировка записи
+	state     sync.RWMutex   // блокировка состояния
+}
+
+// Server возвращает сервер, к которому относится сессия.
+func (s *Session) Server() *Server {
+	return s.server
+}
+
+// User возвращает авторизованного пользователя или nil.
+func (s *Session) User() *User {
+	s.state.RLock()
+	var user = s.user
+	s.state.RUnlock()
+	return user
+}
+
+// Monitored возвращает true, если клиент запустил монитор звонков командой
+// MonitorStart.
+func (s *Session) Monitored() bool {
+	s.state.RLock()
+	var monitored = s.monitored
+	s.state.RUnlock()
+	return monitored
+}
+
+// Close разрывает соединение.
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
+
+// serve читает и обрабатывает команды клиента.
+func (s *Session) serve() {
+	defer s.conn.Close()
+	for {
+		id, data, err := readMessage(s.conn)
+		if err != nil {
+			return
+		}
+		var req = &Request{ID: id, Data: data}
+		if req.Name, req.Attrs, err = parseRoot(data); err != nil {
+			s.server.logf("mxtest: bad command: %v", err)
+			continue
+		}
+		s.server.logf("mxtest: <- %s %s", id, data)
+		var name = req.Name
+		if name == "iq" {
+			name = "iq/" + req.Attrs["id"]
+		}
+		s.server.mu.Lock()
+		s.server.received = append(s.server.received, name)
+		var handler, ok = s.server.handlers[name]
+		s.server.mu.Unlock()
+		// до авторизации обрабатываются только команды авторизации
+		if s.User() == nil && name != "loginRequest" {
+			continue
+		}
+		if !ok || handler == nil {
+			continue
+		}
+		handler(s, req)
+	}
+}
+
+// Reply отсылает ответ на команду.
+func (s *Session) Reply(req *Request, v interface{}) error {
+	return s.write(req.ID, v)
+}
+
+// Error отсылает ошибку CSTA в ответ на команду.
+func (s *Session) Error(req *Request, code string) error {
+	return s.write(req.ID, fmt.Sprintf(
+		`<CSTAErrorCode xmlns="http://www.ecma-international.org/standards/ecma-323/csta/ed3">`+
+			`<operation>%s</operation></CSTAErrorCode>`, code))
+}
+
+// Event отсылает событие клиенту.
+func (s *Session) Event(v interface{}) error {
+	return s.write(EventID, v)
+}
+
+// write отсылает сообщение с указанным идентификатором.
+func (s *Session) write(id string, v interface{}) error {
+	var data []byte
+	switch v := v.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		var err error
+		if data, err = xml.Marshal(v); err != nil {
+			return err
+		}
+	}
+	s.server.logf("mxtest: -> %s %s", id, data)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeMessage(s.conn, id, data)
+}
+
+// Request описывает команду, полученную от клиента.
+type Request struct {
+	ID    string            // идентификатор команды
+	Name  string            // имя корневого элемента
+	Attrs map[string]string // атрибуты корневого элемента
+	Data  []byte            // содержимое команды в формате XML
+}
+
+// Decode декодирует содержимое команды.
+func (r *Request) Decode(v interface{}) error {
+	return xml.Unmarshal(r.Data, v)
+}
+
+// HandlerFunc описывает функцию обработки команды.
+type HandlerFunc func(session *Session, req *Request)
+
+// Формат сообщения CSTA: два нулевых байта, длина сообщения вместе с
+// заголовком (2 байта, big-endian), идентификатор команды из 4 символов и
+// содержимое в формате XML.
+const headerSize = 8
+
+// readMessage читает сообщение из соединения.
+func readMessage(r io.Reader) (id string, data []byte, err error) {
+	var header = make([]byte, headerSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return "", nil, err
+	}
+	var length = int(binary.BigEndian.Uint16(header[2:4]))
+	if length < headerSize {
+		return "", nil, errors.New("mxtest: bad message length")
+	}
+	data = make([]byte, length-headerSize)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return "", nil, err
+	}
+	return string(header[4:]), data, nil
+}
+
+// writeMessage записывает сообщение в соединение.
+func writeMessage(w io.Writer, id string, data []byte) error {
+	if len(id) != 4 {
+		return fmt.Errorf("mxtest: bad message id %q", id)
+	}
+	if len(data)+headerSize > 0xffff {
+		return errors.New("mxtest: message too long")
+	}
+	var buf = make([]byte, headerSize, headerSize+len(data))
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(data)+headerSize))
+	copy(buf[4:], id)
+	_, err := w.Write(append(buf, data...))
+	return err
+}
+
+// parseRoot возвращает имя и атрибуты корневого элемента XML.
+func parseRoot(data []byte) (string, map[string]string, error) {
+	var decoder = xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", nil, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			var attrs = make(map[string]string, len(start.Attr))
+			for _, attr := range start.Attr {
+				attrs[attr.Name.Local] = attr.Value
+			}
+			return start.Name.Local, attrs, nil
+		}
+	}
+}
+
+// selfSignedCert создает самоподписанный сертификат для локального адреса.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	var template = &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{Organization: []string{"MX Test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour * 24),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// itoa возвращает строковое представление числа.
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,384 @@
+package mxtest
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// client описывает тестовое соединение с сервером.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	seq  int
+}
+
+func dial(t *testing.T, server *Server) *client {
+	t.Helper()
+	var conn net.Conn
+	var err error
+	if server.tls {
+		conn, err = tls.Dial("tcp", server.Addr(),
+			&tls.Config{InsecureSkipVerify: true})
+	} else {
+		conn, err = net.Dial("tcp", server.Addr())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &client{t: t, conn: conn}
+}
+
+// send отсылает команду и возвращает ее идентификатор.
+func (c *client) send(cmd string) string {
+	c.t.Helper()
+	c.seq++
+	var id = fmt.Sprintf("%04d", c.seq)
+	if err := writeMessage(c.conn, id, []byte(cmd)); err != nil {
+		c.t.Fatal(err)
+	}
+	return id
+}
+
+// read возвращает следующее сообщение сервера.
+func (c *client) read() (string, string) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	id, data, err := readMessage(c.conn)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return id, string(data)
+}
+
+// expect читает сообщение и проверяет его идентификатор и имя корневого
+// элемента.
+func (c *client) expect(id, name string) string {
+	c.t.Helper()
+	gotID, data := c.read()
+	if gotID != id {
+		c.t.Fatalf("id = %q, want %q: %s", gotID, id, data)
+	}
+	if root, _, err := parseRoot([]byte(data)); err != nil || root != name {
+		c.t.Fatalf("response = %s, want %s", data, name)
+	}
+	return data
+}
+
+func (c *client) login(login, password string) string {
+	c.t.Helper()
+	return c.send(`<loginRequest type="User" platform="iPhone" version="1.0">` +
+		`<userName>` + login + `</userName><pwd>` + password + `</pwd>` +
+		`</loginRequest>`)
+}
+
+func newTestServer(t *testing.T) *Server {
+	var server = NewUnstartedServer()
+	server.Start()
+	t.Cleanup(func() { server.Close() })
+	server.AddUser(&User{Login: "test", Password: "secret", Ext: "3095",
+		JID: 43884852, SoftPhonePwd: "sip"})
+	return server
+}
+
+func TestLogin(t *testing.T) {
+	var server = newTestServer(t)
+	var c = dial(t, server)
+	var data = c.expect(c.login("test", "secret"), "loginResponce")
+	for _, attr := range []string{`Code="0"`, `ext="3095"`,
+		`userId="43884852"`, `softPhonePwd="sip"`, `sn="63022"`} {
+		if !strings.Contains(data, attr) {
+			t.Errorf("login response %s: missing %s", data, attr)
+		}
+	}
+	if sessions := server.Sessions("test"); len(sessions) != 1 {
+		t.Fatalf("sessions = %d, want 1", len(sessions))
+	}
+}
+
+func TestLoginPasswordHash(t *testing.T) {
+	var server = newTestServer(t)
+	var c = dial(t, server)
+	c.expect(c.login("test", passwordHash("secret")), "loginResponce")
+}
+
+func TestLoginFailed(t *testing.T) {
+	var server = newTestServer(t)
+	var c = dial(t, server)
+	var data = c.expect(c.login("test", "bad"), "loginFailed")
+	if !strings.Contains(data, `Code="2"`) {
+		t.Errorf("login failed response: %s", data)
+	}
+	c.expect(c.login("unknown", "secret"), "loginFailed")
+	if sessions := server.Sessions("test"); len(sessions) != 0 {
+		t.Fatalf("sessions = %d, want 0", len(sessions))
+	}
+}
+
+func TestLoginTLS(t *testing.T) {
+	var server = NewServer()
+	defer server.Close()
+	server.AddUser(&User{Login: "test", Password: "secret", Ext: "3095"})
+	var c = dial(t, server)
+	c.expect(c.login("test", "secret"), "loginResponce")
+}
+
+func TestCommandsBeforeLogin(t *testing.T) {
+	var server = newTestServer(t)
+	var c = dial(t, server)
+	// команды до авторизации игнорируются: первым приходит ответ на логин
+	c.send(`<MonitorStart><monitorObject><deviceObject>3095</deviceObject>` +
+		`</monitorObject></MonitorStart>`)
+	c.expect(c.login("test", "secret"), "loginResponce")
+	var received = server.Received()
+	if len(received) != 2 || received[0] != "MonitorStart" ||
+		received[1] != "loginRequest" {
+		t.Errorf("received = %v", received)
+	}
+	if server.Sessions("test")[0].Monitored() {
+		t.Error("monitor started before login")
+	}
+}
+
+func TestMonitorEvents(t *testing.T) {
+	var server = newTestServer(t)
+	var c = dial(t, server)
+	c.expect(c.login("test", "secret"), "loginResponce")
+	// без запущенного монитора события звонков не отсылаются
+	if n := server.Event("test", "<HeldEvent/>"); n != 0 {
+		t.Fatalf("event sent to %d unmonitored sessions", n)
+	}
+	c.expect(c.send(`<MonitorStart><monitorObject><deviceObject>3095`+
+		`</deviceObject></monitorObject></MonitorStart>`), "MonitorStartResponse")
+	if !server.Sessions("test")[0].Monitored() {
+		t.Fatal("monitor not started")
+	}
+	var callID = server.Delivered("test", "79031234567")
+	if callID == 0 {
+		t.Fatal("delivered event not sent")
+	}
+	var data = c.expect(EventID, "DeliveredEvent")
+	for _, elem := range []string{
+		"<callID>" + strconv.FormatInt(callID, 10) + "</callID>",
+		"<deviceIdentifier>79031234567</deviceIdentifier>",
+		"<calledDevice><deviceIdentifier>3095</deviceIdentifier></calledDevice>",
+	} {
+		if !strings.Contains(data, elem) {
+			t.Errorf("delivered event %s: missing %s", data, elem)
+		}
+	}
+	server.Established("test", callID, "79031234567")
+	c.expect(EventID, "EstablishedEvent")
+	server.Cleared("test", callID)
+	c.expect(EventID, "ConnectionClearedEvent")
+	if n := server.Delivered("unknown", "3095"); n != 0 {
+		t.Errorf("delivered to unknown user: %d", n)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	var server = newTestServer(t)
+	server.AddUser(&User{Login: "other", Password: "secret", Ext: "3096"})
+	var c1, c2 = dial(t, server), dial(t, server)
+	c1.expect(c1.login("test", "secret"), "loginResponce")
+	c2.expect(c2.login("other", "secret"), "loginResponce")
+	dial(t, server) // неавторизованная сессия не получает событий
+	if n := server.Broadcast(`<presence from="1"/>`); n != 2 {
+		t.Fatalf("broadcast to %d sessions, want 2", n)
+	}
+	c1.expect(EventID, "presence")
+	c2.expect(EventID, "presence")
+}
+
+func TestHandle(t *testing.T) {
+	var server = newTestServer(t)
+	server.Handle("Custom", func(session *Session, req *Request) {
+		if session.User().Login != "test" || req.Attrs["value"] != "1" {
+			session.Error(req, "invalidParameterValue")
+			return
+		}
+		session.Reply(req, "<CustomResponse/>")
+	})
+	server.Handle("MonitorStart", nil)
+	var c = dial(t, server)
+	c.expect(c.login("test", "secret"), "loginResponce")
+	c.send(`<MonitorStart/>`) // отключенная команда игнорируется
+	c.expect(c.send(`<Custom value="1"/>`), "CustomResponse")
+	var data = c.expect(c.send(`<Custom value="2"/>`), "CSTAErrorCode")
+	if !strings.Contains(data, "invalidParameterValue") {
+		t.Errorf("error response: %s", data)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	var server = newTestServer(t)
+	var c = dial(t, server)
+	c.expect(c.login("test", "secret"), "loginResponce")
+	if n := server.Disconnect("test"); n != 1 {
+		t.Fatalf("disconnected %d sessions, want 1", n)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, _, err := readMessage(c.conn); err == nil {
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestMessageFormat(t *testing.T) {
+	if err := writeMessage(new(strings.Builder), "1", nil); err == nil {
+		t.Error("bad id accepted")
+	}
+	var buf = new(strings.Builder)
+	if err := writeMessage(buf, "0001", []byte("<a/>")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "\x00\x00\x00\x0c0001<a/>"; got != want {
+		t.Fatalf("message = %q, want %q", got, want)
+	}
+	id, data, err := readMessage(strings.NewReader(buf.String()))
+	if err != nil || id != "0001" || string(data) != "<a/>" {
+		t.Fatalf("read = %q %q %v", id, data, err)
+	}
+	if _, _, err := readMessage(strings.NewReader("\x00\x00\x00\x020001")); err == nil {
+		t.Error("bad length accepted")
+	}
+}
+
+// callLogBlocks запрашивает лог звонков и возвращает количество записей в
+// блоках ответа.
+func (c *client) callLogBlocks(timestamp string) []int {
+	c.t.Helper()
+	var id = c.send(`<iq type="get" id="calllog" timestamp="` + timestamp + `"/>`)
+	var list []int
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+		gotID, data, err := readMessage(c.conn)
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				return list
+			}
+			c.t.Fatal(err)
+		}
+		if gotID != id {
+			c.t.Fatalf("id = %q, want %q", gotID, id)
+		}
+		list = append(list, strings.Count(string(data), "<callinfo"))
+	}
+}
+
+func testCalls(count int) []*CallInfo {
+	var calls = make([]*CallInfo, count)
+	for i := range calls {
+		calls[i] = &CallInfo{RecordID: int64(i + 1),
+			ConnectTimestamp: int64(1500000000 + i)}
+	}
+	return calls
+}
+
+func TestCallLog(t *testing.T) {
+	var server = newTestServer(t)
+	server.AddCallLog("test", testCalls(CallLogPageSize*2)...)
+	var c = dial(t, server)
+	c.expect(c.login("test", "secret"), "loginResponce")
+	// записей ровно на два блока: завершающий пустой блок не отдается
+	if got := c.callLogBlocks("-1"); fmt.Sprint(got) != "[21 21]" {
+		t.Errorf("blocks = %v", got)
+	}
+	if got := c.callLogBlocks("1500000030"); fmt.Sprint(got) != "[11]" {
+		t.Errorf("blocks since timestamp = %v", got)
+	}
+	if got := c.callLogBlocks("1600000000"); len(got) != 0 {
+		t.Errorf("blocks without new calls = %v", got)
+	}
+}
+
+func TestCallLogEmptyBlock(t *testing.T) {
+	var server = NewUnstartedServer()
+	server.CallLogEmptyBlock = true
+	server.Start()
+	defer server.Close()
+	server.AddUser(&User{Login: "test", Password: "secret", Ext: "3095"})
+	server.AddCallLog("test", testCalls(CallLogPageSize*2)...)
+	var c = dial(t, server)
+	c.expect(c.login("test", "secret"), "loginResponce")
+	if got := c.callLogBlocks("-1"); fmt.Sprint(got) != "[21 21 0]" {
+		t.Errorf("blocks = %v", got)
+	}
+	if got := c.callLogBlocks("1600000000"); fmt.Sprint(got) != "[0]" {
+		t.Errorf("blocks without new calls = %v", got)
+	}
+}
+
+func TestConferenceRoster(t *testing.T) {
+	var server = newTestServer(t)
+	server.AddUser(&User{Login: "other", Password: "secret", Ext: "3096",
+		JID: 43884853})
+	var c = dial(t, server)
+	c.expect(c.login("test", "secret"), "loginResponce")
+	c.expect(c.send(`<CreateConference><ownerId>43884852</ownerId>`+
+		`<name>test</name></CreateConference>`), "CreateConferenceResponse")
+	c.expect(EventID, "ConfAddEvent")
+	var confs = server.Conferences()
+	if len(confs) != 1 {
+		t.Fatalf("conferences = %d, want 1", len(confs))
+	}
+	var confID = confs[0].ID
+
+	if n := server.JoinConference(confID, &ConferenceParty{ID: "1003",
+		Number: "+15550001234"}); n != 1 {
+		t.Fatalf("join event sent to %d sessions, want 1", n)
+	}
+	c.expect(EventID, "ConfPartyAddEvent")
+	var data = c.expect(c.send(`<GetConfParties><confId>`+confID+
+		`</confId></GetConfParties>`), "GetConfPartiesResponse")
+	if !strings.Contains(data, "<partyId>1003</partyId>") ||
+		!strings.Contains(data, "<locked>false</locked>") {
+		t.Errorf("conference parties: %s", data)
+	}
+
+	c.expect(c.send(`<MuteConfParty><confId>`+confID+`</confId>`+
+		`<partyId>1003</partyId><mute>true</mute></MuteConfParty>`),
+		"MuteConfPartyResponse")
+	c.expect(EventID, "ConfPartyUpdEvent")
+	if parties := server.ConferenceParties(confID); len(parties) != 1 ||
+		!parties[0].Muted {
+		t.Errorf("parties after mute = %+v", parties)
+	}
+	c.expect(c.send(`<MuteConfParty><confId>`+confID+`</confId>`+
+		`<partyId>1004</partyId><mute>true</mute></MuteConfParty>`),
+		"CSTAErrorCode")
+
+	c.expect(c.send(`<LockConf><confId>`+confID+`</confId>`+
+		`<lock>true</lock></LockConf>`), "LockConfResponse")
+	c.expect(EventID, "ConfLockEvent")
+	if !server.ConferenceLocked(confID) {
+		t.Error("conference not locked")
+	}
+	// в закрытую конференцию не войти
+	c.expect(c.send(`<JoinConf><callId>`+confID+`</callId></JoinConf>`),
+		"CSTAErrorCode")
+
+	// управлять конференцией может только владелец
+	var other = dial(t, server)
+	other.expect(other.login("other", "secret"), "loginResponce")
+	data = other.expect(other.send(`<DropConfParty><confId>`+confID+
+		`</confId><partyId>1003</partyId></DropConfParty>`), "CSTAErrorCode")
+	if !strings.Contains(data, "privilegeViolationSpecifiedDevice") {
+		t.Errorf("error response: %s", data)
+	}
+
+	c.expect(c.send(`<DropConfParty><confId>`+confID+`</confId>`+
+		`<partyId>1003</partyId></DropConfParty>`), "DropConfPartyResponse")
+	c.expect(EventID, "ConfPartyDelEvent")
+	other.expect(EventID, "ConfPartyDelEvent")
+	if parties := server.ConferenceParties(confID); len(parties) != 0 {
+		t.Errorf("parties after drop = %+v", parties)
+	}
+	if n := server.LeaveConference(confID, "1003"); n != 0 {
+		t.Errorf("leave event for unknown party sent to %d sessions", n)
+	}
+}
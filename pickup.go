@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/xml"
+)
+
+// PickupResponse описывает ответ сервера MX на перехват звонка.
+type PickupResponse struct {
+	CallID   int64  `xml:"pickedCall>callID" json:"callId,omitempty"`
+	DeviceID string `xml:"pickedCall>deviceID" json:"deviceId,omitempty"`
+}
+
+// GroupPickupCall перехватывает звонок, поступивший в группу перехвата. Если
+// группа не указана, то используется группа перехвата пользователя.
+func (c *MXConn) GroupPickupCall(group, deviceID string) (*PickupResponse, error) {
+	if deviceID != "" {
+		// отправляем команду для ассоциации устройства по имени
+		if err := c.AssignDevice(deviceID); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := c.SendWithResponse(&struct {
+		XMLName     xml.Name `xml:"GroupPickupCall"`
+		Destination string   `xml:"newDestination"`
+		Group       string   `xml:"pickupGroup,omitempty"`
+	}{
+		Destination: c.Ext,
+		Group:       group,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result = new(PickupResponse)
+	if err = resp.Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DirectedPickupCall перехватывает звонок, поступивший на указанный номер.
+// Если идентификатор звонка не указан, то перехватывается звонок, который
+// ожидает ответа на этом номере.
+func (c *MXConn) DirectedPickupCall(callID int64, ext, deviceID string) (
+	*PickupResponse, error) {
+	if deviceID != "" {
+		// отправляем команду для ассоциации устройства по имени
+		if err := c.AssignDevice(deviceID); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := c.SendWithResponse(&struct {
+		XMLName          xml.Name `xml:"DirectedPickupCall"`
+		CallID           int64    `xml:"callToBePickedUp>callID,omitempty"`
+		DeviceID         string   `xml:"callToBePickedUp>deviceID"`
+		RequestingDevice string   `xml:"requestingDevice"`
+	}{
+		CallID:           callID,
+		DeviceID:         ext,
+		RequestingDevice: c.Ext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result = new(PickupResponse)
+	if err = resp.Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ParkCall паркует звонок на указанную орбиту, откуда его может забрать
+// любой пользователь. Если орбита не указана, то она выбирается сервером MX.
+// Возвращает номер орбиты, на которую припаркован звонок.
+func (c *MXConn) ParkCall(callID int64, orbit string) (string, error) {
+	resp, err := c.SendWithResponse(&struct {
+		XMLName  xml.Name `xml:"ParkCall"`
+		CallID   int64    `xml:"parking>callID"`
+		DeviceID string   `xml:"parking>deviceID"`
+		Orbit    string   `xml:"parkTo,omitempty"`
+	}{
+		CallID:   callID,
+		DeviceID: c.Ext,
+		Orbit:    orbit,
+	})
+	if err != nil {
+		return "", err
+	}
+	var result = new(struct {
+		Orbit string `xml:"parkedTo"`
+	})
+	if err = resp.Decode(result); err != nil {
+		return "", err
+	}
+	if result.Orbit == "" {
+		result.Orbit = orbit
+	}
+	return result.Orbit, nil
+}
+
+// UnparkCall забирает звонок, припаркованный на указанной орбите. Звонок
+// перехватывается так же, как звонок, ожидающий ответа на номере орбиты.
+func (c *MXConn) UnparkCall(orbit, deviceID string) (*PickupResponse, error) {
+	return c.DirectedPickupCall(0, orbit, deviceID)
+}
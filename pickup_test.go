@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/mdigger/mxproxy/mxtest"
+)
+
+// pickupResult описывает ответ на запрос перехвата звонка.
+type pickupResult struct {
+	Pickup *PickupResponse `json:"pickup"`
+}
+
+// received возвращает количество полученных сервером MX команд с указанным
+// именем.
+func (s *testService) received(name string) int {
+	var count int
+	for _, item := range s.mx.Received() {
+		if item == name {
+			count++
+		}
+	}
+	return count
+}
+
+func TestPickupCall(t *testing.T) {
+	var s = newTestService(t)
+	s.login()
+
+	// перехват звонка на номер коллеги
+	var result = new(pickupResult)
+	s.request("POST", "/calls/pickup", url.Values{"ext": {"3099"}},
+		http.StatusOK, result)
+	if result.Pickup == nil || result.Pickup.CallID == 0 ||
+		result.Pickup.DeviceID != "3095" {
+		t.Errorf("directed pickup = %+v", result.Pickup)
+	}
+	if count := s.received("DirectedPickupCall"); count != 1 {
+		t.Errorf("directed pickup commands = %d, want 1", count)
+	}
+	// перехват звонка в группу перехвата
+	result = new(pickupResult)
+	s.request("POST", "/calls/pickup", url.Values{}, http.StatusOK, result)
+	if result.Pickup == nil || result.Pickup.DeviceID != "3095" {
+		t.Errorf("group pickup = %+v", result.Pickup)
+	}
+	if count := s.received("GroupPickupCall"); count != 1 {
+		t.Errorf("group pickup commands = %d, want 1", count)
+	}
+	// перед перехватом на устройство оно ассоциируется с сессией
+	s.request("POST", "/calls/pickup", url.Values{"ext": {"3099"},
+		"device": {"sipPhone"}}, http.StatusOK, nil)
+	if count := s.received("AssignDevice"); count != 1 {
+		t.Errorf("assign device commands = %d, want 1", count)
+	}
+
+	for _, params := range []url.Values{
+		{"callId": {"1044"}},
+		{"ext": {"3099"}, "group": {"7"}},
+	} {
+		s.request("POST", "/calls/pickup", params, http.StatusBadRequest, nil)
+	}
+
+	// звонка для перехвата нет
+	s.mx.Handle("DirectedPickupCall", func(session *mxtest.Session, req *mxtest.Request) {
+		session.Error(req, "invalidCallID")
+	})
+	s.request("POST", "/calls/pickup", url.Values{"ext": {"3099"}},
+		http.StatusNotFound, nil)
+}
+
+func TestParkCall(t *testing.T) {
+	var s = newTestService(t)
+	s.login()
+	var events = s.events()
+	var callID = s.mx.Delivered("test", "79031234567")
+	s.mx.Established("test", callID, "79031234567")
+	nextEvent(t, events, "Established")
+	var path = "/calls/" + strconv.FormatInt(callID, 10) + "/park"
+
+	s.request("POST", path, url.Values{"orbit": {"1a"}},
+		http.StatusBadRequest, nil)
+	s.request("POST", "/calls/bad/park", url.Values{}, http.StatusNotFound, nil)
+
+	var park = new(struct {
+		Park struct {
+			CallID int64  `json:"callId"`
+			Orbit  string `json:"orbit"`
+		} `json:"park"`
+	})
+	s.request("POST", path, url.Values{"orbit": {"12"}}, http.StatusOK, park)
+	if park.Park.CallID != callID || park.Park.Orbit != "12" {
+		t.Errorf("park = %+v", park.Park)
+	}
+	// припаркованный звонок завершается на устройстве пользователя
+	nextEvent(t, events, "ConnectionCleared")
+	if calls := s.activeCalls(); len(calls) != 0 {
+		t.Errorf("active calls after park = %+v", calls)
+	}
+
+	// орбита назначается сервером MX, если не указана
+	callID = s.mx.Delivered("test", "79031234568")
+	s.mx.Established("test", callID, "79031234568")
+	nextEvent(t, events, "Established")
+	path = "/calls/" + strconv.FormatInt(callID, 10) + "/park"
+	s.request("POST", path, url.Values{}, http.StatusOK, park)
+	if park.Park.CallID != callID || !isParkOrbit(park.Park.Orbit) {
+		t.Errorf("park = %+v", park.Park)
+	}
+
+	var unpark = new(struct {
+		Unpark struct {
+			Orbit    string `json:"orbit"`
+			CallID   int64  `json:"callId"`
+			DeviceID string `json:"deviceId"`
+		} `json:"unpark"`
+	})
+	s.request("POST", "/calls/park/12", url.Values{}, http.StatusOK, unpark)
+	if unpark.Unpark.Orbit != "12" || unpark.Unpark.CallID == 0 ||
+		unpark.Unpark.DeviceID != "3095" {
+		t.Errorf("unpark = %+v", unpark.Unpark)
+	}
+	s.request("POST", "/calls/park/x", url.Values{}, http.StatusNotFound, nil)
+
+	// ошибки сервера MX
+	s.mx.Handle("ParkCall", func(session *mxtest.Session, req *mxtest.Request) {
+		session.Error(req, "invalidCallID")
+	})
+	s.mx.Handle("DirectedPickupCall", func(session *mxtest.Session, req *mxtest.Request) {
+		session.Error(req, "invalidCallID")
+	})
+	s.request("POST", path, url.Values{"orbit": {"12"}},
+		http.StatusBadRequest, nil)
+	s.request("POST", "/calls/park/13", url.Values{}, http.StatusNotFound, nil)
+}
+
+func TestIsParkOrbit(t *testing.T) {
+	for orbit, valid := range map[string]bool{
+		"12": true, "0": true, "": false, "1a": false, " 12": false, "*12": false,
+	} {
+		if isParkOrbit(orbit) != valid {
+			t.Errorf("isParkOrbit(%q) = %t", orbit, !valid)
+		}
+	}
+}
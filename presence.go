@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdigger/mx"
+	"github.com/mdigger/rest"
+)
+
+// presenceStatuses содержит допустимые состояния присутствия пользователя.
+var presenceStatuses = []string{"available", "away", "busy", "dnd", "offline"}
+
+// Presence описывает состояние присутствия пользователя.
+type Presence struct {
+	JID     mx.JID `xml:"jid" json:"jid,string"`
+	Ext     string `xml:"-" json:"ext,omitempty"`
+	Name    string `xml:"-" json:"name,omitempty"`
+	Status  string `xml:"status" json:"status"`
+	Note    string `xml:"note" json:"note,omitempty"`
+	Updated int64  `xml:"-" json:"updated,omitempty"` // время изменения
+}
+
+// PresenceEvent описывает событие об изменении присутствия пользователя.
+type PresenceEvent struct {
+	Type string `json:"type"`
+	*Presence
+}
+
+// presenceList описывает состояние присутствия контактов адресной книги,
+// сохраненное в соединении.
+type presenceList struct {
+	items map[mx.JID]*Presence
+	mu    sync.RWMutex
+}
+
+// PresenceSubscribe подписывается на изменения присутствия контактов
+// адресной книги и сохраняет их текущее состояние в соединении. Вызывается
+// повторно при изменении адресной книги: контакты, удаленные из нее,
+// удаляются и из списка присутствия.
+func (c *MXConn) PresenceSubscribe(contacts []*Contact) error {
+	var jids = make([]mx.JID, 0, len(contacts))
+	for _, contact := range contacts {
+		if contact.JID != c.JID {
+			jids = append(jids, contact.JID)
+		}
+	}
+	resp, err := c.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"PresenceSubscribe"`
+		JIDs    []mx.JID `xml:"jid"`
+	}{
+		JIDs: jids,
+	})
+	if err != nil {
+		return err
+	}
+	var result = new(struct {
+		List []*Presence `xml:"presence"`
+	})
+	if err = resp.Decode(result); err != nil {
+		return err
+	}
+	var list = &c.presence
+	list.mu.Lock()
+	// при повторной подписке сохраняем известное состояние контактов
+	var items = make(map[mx.JID]*Presence, len(contacts))
+	for _, contact := range contacts {
+		if contact.JID == c.JID {
+			continue
+		}
+		var presence = &Presence{
+			JID:    contact.JID,
+			Ext:    contact.Ext,
+			Name:   strings.TrimSpace(contact.FirstName + " " + contact.LastName),
+			Status: "offline",
+		}
+		if old, ok := list.items[contact.JID]; ok {
+			presence.Status = old.Status
+			presence.Note = old.Note
+			presence.Updated = old.Updated
+		}
+		items[contact.JID] = presence
+	}
+	list.items = items
+	var now = time.Now().Unix()
+	for _, item := range result.List {
+		if presence, ok := list.items[item.JID]; ok {
+			presence.Status = item.Status
+			presence.Note = item.Note
+			presence.Updated = now
+		}
+	}
+	list.mu.Unlock()
+	return nil
+}
+
+// updatePresence сохраняет изменение присутствия контакта и возвращает его
+// полное описание.
+func (c *MXConn) updatePresence(event *Presence) *Presence {
+	var list = &c.presence
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	if list.items == nil {
+		list.items = make(map[mx.JID]*Presence)
+	}
+	var presence, ok = list.items[event.JID]
+	if !ok {
+		presence = &Presence{JID: event.JID}
+		list.items[event.JID] = presence
+	}
+	presence.Status = event.Status
+	presence.Note = event.Note
+	presence.Updated = time.Now().Unix()
+	var result = *presence
+	return &result
+}
+
+// PresenceList возвращает копию состояния присутствия контактов,
+// упорядоченного по внутреннему номеру.
+func (c *MXConn) PresenceList() []*Presence {
+	var list = &c.presence
+	list.mu.RLock()
+	var result = make([]*Presence, 0, len(list.items))
+	for _, presence := range list.items {
+		var item = *presence
+		result = append(result, &item)
+	}
+	list.mu.RUnlock()
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Ext == result[j].Ext {
+			return result[i].JID < result[j].JID
+		}
+		return result[i].Ext < result[j].Ext
+	})
+	return result
+}
+
+// SetPresence изменяет состояние присутствия пользователя.
+func (c *MXConn) SetPresence(status, note string) error {
+	_, err := c.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"SetPresence"`
+		Status  string   `xml:"status"`
+		Note    string   `xml:"note"`
+	}{
+		Status: status,
+		Note:   note,
+	})
+	return err
+}
+
+// agentStates задает соответствие состояний агента в API и запрашиваемых
+// состояний в командах CSTA.
+var agentStates = map[string]string{
+	"ready":    "ready",
+	"notReady": "notReady",
+	"wrapUp":   "workingAfterCall",
+}
+
+// agentStateNames задает соответствие состояний агента, возвращаемых
+// сервером MX, и состояний в API.
+var agentStateNames = map[string]string{
+	"agentReady":            "ready",
+	"agentNotReady":         "notReady",
+	"agentWorkingAfterCall": "wrapUp",
+	"agentBusy":             "busy",
+	"agentNull":             "loggedOff",
+}
+
+// AgentGroup описывает группу ACD и состояние агента в ней.
+type AgentGroup struct {
+	ID    mx.JID `json:"id,string"`
+	Name  string `json:"name"`
+	Ext   string `json:"ext"`
+	State string `json:"state"`
+}
+
+// ACDServiceTypes задает типы сервисов MX (serviceType в списке сервисов),
+// которые являются группами ACD.
+var ACDServiceTypes = []string{"AdvancedACD"}
+
+// isACDService возвращает true, если сервис является группой ACD.
+func isACDService(service *MXServiceInfo) bool {
+	for _, serviceType := range ACDServiceTypes {
+		if service.Type == serviceType {
+			return true
+		}
+	}
+	return false
+}
+
+// AgentGroups возвращает группы ACD из списка сервисов сервера MX и
+// состояние агента в каждой из них.
+func (c *MXConn) AgentGroups() ([]*AgentGroup, error) {
+	services, err := c.GetServiceList()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"GetAgentState"`
+		Device  string   `xml:"device"`
+	}{
+		Device: c.Ext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result = new(struct {
+		List []struct {
+			Group string `xml:"acdGroup"`
+			State string `xml:"agentState"`
+		} `xml:"agentStateList>agentStateEntry"`
+	})
+	if err = resp.Decode(result); err != nil {
+		return nil, err
+	}
+	var states = make(map[string]string, len(result.List))
+	for _, item := range result.List {
+		states[item.Group] = item.State
+	}
+	var groups = make([]*AgentGroup, 0)
+	for _, service := range services {
+		if !isACDService(service) {
+			continue
+		}
+		var state = agentStateNames[states[service.Ext]]
+		if state == "" {
+			state = "loggedOff"
+		}
+		groups = append(groups, &AgentGroup{
+			ID:    service.ID,
+			Name:  service.Name,
+			Ext:   service.Ext,
+			State: state,
+		})
+	}
+	return groups, nil
+}
+
+// SetAgentState изменяет состояние агента во всех группах ACD, в которых он
+// зарегистрирован.
+func (c *MXConn) SetAgentState(state string) error {
+	cstaState, ok := agentStates[state]
+	if !ok {
+		return rest.NewError(http.StatusBadRequest,
+			"unknown agent state: "+state)
+	}
+	return c.setAgentState(cstaState, "")
+}
+
+// AgentLogin регистрирует или отменяет регистрацию агента в группе ACD с
+// указанным идентификатором сервиса.
+func (c *MXConn) AgentLogin(serviceID mx.JID, login bool) error {
+	services, err := c.GetServiceList()
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		if service.ID != serviceID || !isACDService(service) {
+			continue
+		}
+		var state = "loggedOff"
+		if login {
+			state = "loggedOn"
+		}
+		return c.setAgentState(state, service.Ext)
+	}
+	return rest.ErrNotFound
+}
+
+// setAgentState отсылает команду на изменение состояния агента.
+func (c *MXConn) setAgentState(state, group string) error {
+	_, err := c.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"SetAgentState"`
+		Device  string   `xml:"device"`
+		State   string   `xml:"requestedAgentState"`
+		AgentID string   `xml:"agentID"`
+		Group   string   `xml:"acdGroup,omitempty"`
+	}{
+		Device:  c.Ext,
+		State:   state,
+		AgentID: c.Ext,
+		Group:   group,
+	})
+	return err
+}
+
+// agentEvents задает соответствие событий CSTA о состоянии агента и
+// состояний в API.
+var agentEvents = map[string]string{
+	"AgentReadyEvent":            "ready",
+	"AgentNotReadyEvent":         "notReady",
+	"AgentWorkingAfterCallEvent": "wrapUp",
+	"AgentBusyEvent":             "busy",
+	"AgentLoggedOnEvent":         "loggedOn",
+	"AgentLoggedOffEvent":        "loggedOff",
+}
+
+// AgentStateEvent описывает событие об изменении состояния агента.
+type AgentStateEvent struct {
+	Type      string `xml:"-" json:"type"`
+	Device    string `xml:"agentDevice>deviceIdentifier" json:"device"`
+	Group     string `xml:"acdGroup>deviceIdentifier" json:"group,omitempty"`
+	State     string `xml:"-" json:"state"`
+	Timestamp int64  `xml:"-" json:"timestamp"`
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/mdigger/mxproxy/mxtest"
+)
+
+// presenceResponse описывает ответ на запрос присутствия.
+type presenceResponse struct {
+	Presence []*Presence `json:"presence"`
+	Agent    *struct {
+		Groups []*AgentGroup `json:"groups"`
+	} `json:"agent"`
+}
+
+// testPresenceService запускает сервис с контактами в адресной книге и
+// группой ACD в списке сервисов.
+func testPresenceService(t *testing.T, config ...string) *testService {
+	var s = newTestService(t, config...)
+	s.mx.AddContacts(
+		&mxtest.Contact{JID: 43884852, FirstName: "Test", Ext: "3095"},
+		&mxtest.Contact{JID: 43884853, FirstName: "Dmitry", LastName: "Sedykh",
+			Ext: "3096"},
+		&mxtest.Contact{JID: 43884854, FirstName: "Test", LastName: "User",
+			Ext: "3097"},
+	)
+	s.mx.AddServices(
+		&mxtest.Service{ID: 100, Name: "AAA_1", Type: "AdvancedACD", Ext: "3999"},
+		&mxtest.Service{ID: 101, Name: "Voice", Type: "VoiceMail", Ext: "3998"},
+	)
+	return s
+}
+
+// presenceSubscribed дожидается подписки соединения пользователя на
+// присутствие контактов.
+func (s *testService) presenceSubscribed() {
+	s.t.Helper()
+	waitFor(s.t, "presence subscribe", func() bool {
+		conn, ok := s.proxy.conns.Load("test")
+		return ok && len(conn.(*MXConn).PresenceList()) > 0
+	})
+}
+
+func TestPresence(t *testing.T) {
+	var webhook, pushed = webhookRecorder(t)
+	var s = testPresenceService(t, webhook)
+	s.mx.SetPresence(43884853, "busy", "на совещании")
+	s.login()
+	s.presenceSubscribed()
+	var events = s.events()
+	var result = new(presenceResponse)
+	s.request("GET", "/presence", nil, http.StatusOK, result)
+	if len(result.Presence) != 2 {
+		t.Fatalf("presence = %+v", result.Presence)
+	}
+	if item := result.Presence[0]; item.JID != 43884853 ||
+		item.Name != "Dmitry Sedykh" || item.Status != "busy" ||
+		item.Note != "на совещании" || item.Updated == 0 {
+		t.Errorf("presence = %+v", item)
+	}
+	if item := result.Presence[1]; item.JID != 43884854 ||
+		item.Status != "offline" {
+		t.Errorf("presence = %+v", item)
+	}
+	if result.Agent == nil || len(result.Agent.Groups) != 1 {
+		t.Fatalf("agent = %+v", result.Agent)
+	}
+	if group := result.Agent.Groups[0]; group.ID != 100 ||
+		group.Ext != "3999" || group.State != "loggedOff" {
+		t.Errorf("agent group = %+v", group)
+	}
+
+	s.mx.SetPresence(43884854, "away", "")
+	if event := nextEvent(t, events, "Presence"); event["jid"] != "43884854" ||
+		event["status"] != "away" || event["name"] != "Test User" {
+		t.Errorf("presence event = %v", event)
+	}
+
+	for _, params := range []url.Values{
+		{},
+		{"status": {"sleeping"}},
+	} {
+		s.request("PUT", "/presence", params, http.StatusBadRequest, nil)
+	}
+	s.request("PUT", "/presence", url.Values{"status": {"dnd"},
+		"note": {"не беспокоить"}}, http.StatusOK, nil)
+	if event := nextEvent(t, events, "Presence"); event["jid"] != "43884852" ||
+		event["status"] != "dnd" || event["note"] != "не беспокоить" {
+		t.Errorf("own presence event = %v", event)
+	}
+
+	// регистрация в группе ACD
+	var agent = new(presenceResponse)
+	s.request("POST", "/presence/groups/100", nil, http.StatusOK, agent)
+	if agent.Agent == nil || len(agent.Agent.Groups) != 1 ||
+		agent.Agent.Groups[0].State != "notReady" {
+		t.Fatalf("agent = %+v", agent.Agent)
+	}
+	if event := nextEvent(t, events, "AgentState"); event["group"] != "3999" ||
+		event["state"] != "loggedOn" {
+		t.Errorf("agent event = %v", event)
+	}
+	s.request("PUT", "/presence", url.Values{"state": {"ready"}},
+		http.StatusOK, nil)
+	if state := s.mx.AgentState("test")["3999"]; state != "agentReady" {
+		t.Errorf("mx agent state = %q", state)
+	}
+	nextEvent(t, events, "AgentState")
+	s.request("DELETE", "/presence/groups/100", nil, http.StatusOK, agent)
+	if agent.Agent.Groups[0].State != "loggedOff" {
+		t.Errorf("agent groups = %+v", agent.Agent.Groups)
+	}
+	nextEvent(t, events, "AgentState")
+	// сервис, не являющийся группой ACD
+	s.request("POST", "/presence/groups/101", nil, http.StatusNotFound, nil)
+	s.request("POST", "/presence/groups/bad", nil, http.StatusNotFound, nil)
+
+	// присутствие и состояние агента не отправляются на устройства и webhook
+	s.mx.Delivered("test", "79031234567")
+	if list := pushedBefore(t, pushed, "Delivered"); len(list) != 0 {
+		t.Errorf("pushed events = %v", list)
+	}
+}
+
+func TestPresenceAgentError(t *testing.T) {
+	var s = testPresenceService(t)
+	s.mx.Handle("GetAgentState", func(session *mxtest.Session, req *mxtest.Request) {
+		session.Error(req, "invalidDeviceID")
+	})
+	s.login()
+	s.presenceSubscribed()
+	// ошибка состояния агента не мешает отдать присутствие
+	var result = new(presenceResponse)
+	s.request("GET", "/presence", nil, http.StatusOK, result)
+	if len(result.Presence) != 2 {
+		t.Errorf("presence = %+v", result.Presence)
+	}
+	if result.Agent != nil {
+		t.Errorf("agent = %+v", result.Agent)
+	}
+}
+
+func TestPresenceServiceTypes(t *testing.T) {
+	var serviceTypes = ACDServiceTypes
+	defer func() { ACDServiceTypes = serviceTypes }()
+	var s = testPresenceService(t, "[agent]\nserviceTypes = [\"VoiceMail\"]")
+	s.login()
+	s.presenceSubscribed()
+	var result = new(presenceResponse)
+	s.request("GET", "/presence", nil, http.StatusOK, result)
+	if result.Agent == nil || len(result.Agent.Groups) != 1 ||
+		result.Agent.Groups[0].ID != 101 {
+		t.Errorf("agent = %+v", result.Agent)
+	}
+	s.request("POST", "/presence/groups/100", nil, http.StatusNotFound, nil)
+}
+
+func TestPresenceResubscribe(t *testing.T) {
+	var ttl = AddressBookTTL
+	defer func() { AddressBookTTL = ttl }()
+	var s = testPresenceService(t, "[contacts]\nttl = \"0s\"")
+	// событие об изменении присутствия отсылается до подключения
+	s.mx.SetPresence(43884855, "away", "")
+	s.login()
+	s.presenceSubscribed()
+	var result = new(presenceResponse)
+	s.request("GET", "/presence", nil, http.StatusOK, result)
+	if len(result.Presence) != 2 {
+		t.Fatalf("presence = %+v", result.Presence)
+	}
+	// контакт, добавленный в адресную книгу после подключения
+	s.mx.AddContacts(&mxtest.Contact{JID: 43884855, FirstName: "New",
+		LastName: "User", Ext: "3098"})
+	result = new(presenceResponse)
+	s.request("GET", "/presence", nil, http.StatusOK, result)
+	if len(result.Presence) != 3 {
+		t.Fatalf("presence = %+v", result.Presence)
+	}
+	if item := result.Presence[2]; item.JID != 43884855 ||
+		item.Name != "New User" || item.Status != "away" {
+		t.Errorf("new contact presence = %+v", item)
+	}
+	var subscribes int
+	for _, name := range s.mx.Received() {
+		if name == "PresenceSubscribe" {
+			subscribes++
+		}
+	}
+	if subscribes != 2 {
+		t.Errorf("presence subscribes = %d, want 2", subscribes)
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -28,7 +30,11 @@ type Proxy struct {
 	store           *Store            // хранилище данных
 	jwtGen          *JWTGenerator     // генератор авторизационных токенов
 	conns           sync.Map          // пользовательские соединения с MX
+	breakers        sync.Map          // состояния переподключения к MX
 	push            *Push             // отправитель уведомлений
+	events          *Events           // поток событий пользователей
+	cache           *MediaCache       // кеш файлов голосовой почты
+	refreshCleaner  *time.Timer       // удаление просроченных токенов
 	stopped         bool              // флаг остановки сервиса
 	mu              sync.RWMutex
 }
@@ -40,13 +46,54 @@ func InitProxy(configName, db string) (proxy *Proxy, err error) {
 		AppsAuth        map[string]string `toml:"apps"`
 		LogName         string            `toml:"logName"`
 		VoIP            struct {
-			APNTTL string            `toml:"apnTTL"`
-			APN    map[string]string `toml:"apn"`
-			FCM    map[string]string `toml:"fcm"`
+			APNTTL  string            `toml:"apnTTL"`
+			APN     map[string]string `toml:"apn"`
+			APNKeys map[string]struct {
+				KeyID  string   `toml:"keyId"`  // идентификатор ключа
+				TeamID string   `toml:"teamId"` // идентификатор команды
+				Topics []string `toml:"topics"` // поддерживаемые темы
+			} `toml:"apnKeys"`
+			FCM         map[string]string `toml:"fcm"`
+			FCMURL      string            `toml:"fcmURL"`
+			FCMTokenURL string            `toml:"fcmTokenURL"`
+			// очередь повторной отправки уведомлений
+			QueueWorkers int               `toml:"queueWorkers"`
+			MaxAge       map[string]string `toml:"maxAge"`
 		} `toml:"voip"`
+		Webhooks map[string]struct {
+			Secret string `toml:"secret"` // ключ для подписи уведомлений
+			URL    string `toml:"url"`    // адрес для всех пользователей
+		} `toml:"webhooks"`
+		Cache struct {
+			Dir     string `toml:"dir"`     // каталог для хранения
+			MaxSize int64  `toml:"maxSize"` // максимальный размер в Мб
+			MaxAge  string `toml:"maxAge"`  // время хранения файла
+		} `toml:"cache"`
+		Contacts struct {
+			TTL string `toml:"ttl"` // время хранения адресной книги
+		} `toml:"contacts"`
+		Agent struct {
+			ServiceTypes []string `toml:"serviceTypes"` // типы групп ACD
+		} `toml:"agent"`
+		CallLog struct {
+			Timeout      string `toml:"timeout"`      // ожидание блока лога звонков
+			SyncInterval string `toml:"syncInterval"` // интервал синхронизации
+		} `toml:"callLog"`
+		Calls struct {
+			AlertingTTL string `toml:"alertingTTL"` // ожидание ответа
+			ActiveTTL   string `toml:"activeTTL"`   // разговор без событий
+		} `toml:"calls"`
+		Reconnect struct {
+			MinDelay  string   `toml:"minDelay"`  // первая задержка
+			MaxDelay  string   `toml:"maxDelay"`  // максимальная задержка
+			Jitter    *float64 `toml:"jitter"`    // доля случайного разброса
+			Threshold int      `toml:"threshold"` // ошибок до размыкания
+		} `toml:"reconnect"`
 		JWT struct {
 			TokenTTL   string `toml:"tokenTTL"`   // время жизни токена
 			SingKeyTTL string `toml:"signKeyTTL"` // время жизни ключа
+			RefreshTTL string `toml:"refreshTTL"` // время жизни обновления
+			Secret     string `toml:"secret"`     // шифрование ключей
 		} `toml:"jwt"`
 	}{
 		ProvisioningURL: "https://config.connector73.net/config",
@@ -96,8 +143,53 @@ func InitProxy(configName, db string) (proxy *Proxy, err error) {
 		}
 		singKeyTTL = d
 	}
-	var jwtGen = NewJWTGenerator(tokenTTL, singKeyTTL)
-	log.Info("token generator", "tokenTTL", tokenTTL, "signKeyTTL", singKeyTTL)
+	if config.JWT.RefreshTTL != "" {
+		d, err := time.ParseDuration(config.JWT.RefreshTTL)
+		if err != nil {
+			return nil, err
+		}
+		RefreshTokenTTL = d
+	}
+
+	// время хранения адресной книги в кеше соединения
+	if config.Contacts.TTL != "" {
+		if AddressBookTTL, err = time.ParseDuration(config.Contacts.TTL); err != nil {
+			return nil, err
+		}
+	}
+
+	// типы сервисов MX, являющихся группами ACD
+	if len(config.Agent.ServiceTypes) > 0 {
+		ACDServiceTypes = config.Agent.ServiceTypes
+	}
+
+	// время ожидания очередного блока лога звонков
+	if config.CallLog.Timeout != "" {
+		if CallLogTimeout, err = time.ParseDuration(config.CallLog.Timeout); err != nil {
+			return nil, err
+		}
+	}
+	// минимальный интервал синхронизации лога звонков с сервером MX
+	if config.CallLog.SyncInterval != "" {
+		if CallLogSyncInterval, err = time.ParseDuration(
+			config.CallLog.SyncInterval); err != nil {
+			return nil, err
+		}
+	}
+
+	// время, после которого звонок без событий считается завершенным
+	if config.Calls.AlertingTTL != "" {
+		if ActiveCallAlertingTTL, err = time.ParseDuration(
+			config.Calls.AlertingTTL); err != nil {
+			return nil, err
+		}
+	}
+	if config.Calls.ActiveTTL != "" {
+		if ActiveCallTTL, err = time.ParseDuration(
+			config.Calls.ActiveTTL); err != nil {
+			return nil, err
+		}
+	}
 
 	// открываем хранилище
 	store, err := OpenStore(db)
@@ -105,12 +197,28 @@ func InitProxy(configName, db string) (proxy *Proxy, err error) {
 		log.Error("store error", "error", err)
 		return nil, err
 	}
+	// секретная строка для шифрования ключей подписи токенов в хранилище
+	var secret = []byte(config.JWT.Secret)
+	if len(secret) == 0 {
+		if secret, err = LoadJWTSecret(db + ".key"); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	jwtGen, err := NewJWTGenerator(tokenTTL, singKeyTTL, store, secret)
+	if err != nil {
+		log.Error("token sign keys error", "error", err)
+		store.Close()
+		return nil, err
+	}
+	log.Info("token generator", "tokenTTL", tokenTTL, "signKeyTTL", singKeyTTL)
 
 	// загружаем сертификаты для VoIP Apple Push
 	var push = &Push{
-		store: store,
-		apns:  make(map[string]*http.Client, len(config.VoIP.APN)),
-		fcm:   config.VoIP.FCM,
+		store:    store,
+		apns:     make(map[string]*http.Client, len(config.VoIP.APN)),
+		fcm:      make(map[string]*fcmAccount, len(config.VoIP.FCM)),
+		webhooks: make(map[string]*webhook, len(config.Webhooks)),
 	}
 	// изменяем время жизни пуш-клиентов для APNS, если они указаны в конфиге
 	if config.VoIP.APNTTL != "" {
@@ -127,9 +235,113 @@ func InitProxy(configName, db string) (proxy *Proxy, err error) {
 			log.Error("apn certificate error", "filename", filename, "error", err)
 		}
 	}
-	// выводим список поддерживаемых приложений для Firebase Cloud Messages
-	for appName := range config.VoIP.FCM {
-		log.Info("firebase cloud messaging", "app", appName)
+	// загружаем ключи для авторизации Apple Push по токену провайдера
+	for filename, key := range config.VoIP.APNKeys {
+		filename = filepath.Join(filepath.Dir(configName), filename)
+		if err := push.LoadProviderKey(filename, key.KeyID, key.TeamID,
+			key.Topics...); err != nil {
+			log.Error("apn key error", "filename", filename, "error", err)
+		}
+	}
+	// переопределяем адреса сервисов Firebase Cloud Messages
+	if config.VoIP.FCMURL != "" {
+		FCMURL = strings.TrimSuffix(config.VoIP.FCMURL, "/")
+	}
+	if config.VoIP.FCMTokenURL != "" {
+		FCMTokenURL = config.VoIP.FCMTokenURL
+	}
+	// загружаем сервисные аккаунты для Firebase Cloud Messages
+	for appName, filename := range config.VoIP.FCM {
+		// добавляем путь к файлу относительно конфигурационного файла
+		filename = filepath.Join(filepath.Dir(configName), filename)
+		account, err := LoadFCMAccount(filename)
+		if err != nil {
+			log.Error("fcm service account error", "app", appName,
+				"filename", filename, "error", err)
+			continue
+		}
+		push.fcm[appName] = account
+		log.Info("firebase cloud messaging", "app", appName,
+			"project", account.projectID)
+	}
+	// задаем время жизни уведомлений в очереди повторной отправки
+	for eventType, ttl := range config.VoIP.MaxAge {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, err
+		}
+		if eventType == "default" {
+			PushDefaultMaxAge = d
+		} else {
+			PushMaxAge[eventType] = d
+		}
+	}
+	if config.VoIP.QueueWorkers > 0 {
+		PushQueueWorkers = config.VoIP.QueueWorkers
+	}
+	push.StartQueue(PushQueueWorkers)
+	// настройки отправки уведомлений на webhook
+	for topic, hook := range config.Webhooks {
+		if hook.Secret == "" {
+			log.Error("webhook secret not defined", "topic", topic)
+			continue
+		}
+		if hook.URL != "" {
+			if _, err := url.Parse(hook.URL); err != nil {
+				log.Error("webhook url error", "topic", topic, "error", err)
+				continue
+			}
+		}
+		push.webhooks[topic] = &webhook{secret: hook.Secret, url: hook.URL}
+		log.Info("webhook", "topic", topic, "url", hook.URL)
+	}
+	// параметры переподключения к серверу MX
+	if config.Reconnect.MinDelay != "" {
+		if ReconnectMinDelay, err = time.ParseDuration(
+			config.Reconnect.MinDelay); err != nil {
+			return nil, err
+		}
+	}
+	if config.Reconnect.MaxDelay != "" {
+		if ReconnectMaxDelay, err = time.ParseDuration(
+			config.Reconnect.MaxDelay); err != nil {
+			return nil, err
+		}
+	}
+	// разброс задается указателем, чтобы можно было отличить явно заданный
+	// 0 (без разброса) от отсутствующего значения
+	if jitter := config.Reconnect.Jitter; jitter != nil {
+		if *jitter < 0 || *jitter > 1 {
+			return nil, fmt.Errorf("bad reconnect jitter %v: must be from 0 to 1",
+				*jitter)
+		}
+		ReconnectJitter = *jitter
+	}
+	if config.Reconnect.Threshold > 0 {
+		ReconnectThreshold = config.Reconnect.Threshold
+	}
+	log.Info("mx reconnect", "minDelay", ReconnectMinDelay,
+		"maxDelay", ReconnectMaxDelay, "jitter", ReconnectJitter)
+	// кеш файлов голосовой почты и записей звонков
+	var cache *MediaCache
+	if config.Cache.MaxSize >= 0 {
+		if config.Cache.MaxSize > 0 {
+			MediaCacheMaxSize = config.Cache.MaxSize << 20
+		}
+		if config.Cache.MaxAge != "" {
+			if MediaCacheMaxAge, err = time.ParseDuration(
+				config.Cache.MaxAge); err != nil {
+				return nil, err
+			}
+		}
+		var dir = config.Cache.Dir
+		if dir == "" {
+			dir = db + ".cache"
+		}
+		if cache, err = OpenMediaCache(dir, MediaCacheMaxSize,
+			MediaCacheMaxAge); err != nil {
+			log.Error("media cache error", "error", err)
+		}
 	}
 	// инициализируем прокси
 	proxy = &Proxy{
@@ -138,7 +350,14 @@ func InitProxy(configName, db string) (proxy *Proxy, err error) {
 		store:           store,
 		jwtGen:          jwtGen,
 		push:            push,
+		events:          NewEvents(),
+		cache:           cache,
+	}
+	// удаляем просроченные токены обновления
+	if count := store.RemoveRefreshTokens(""); count > 0 {
+		log.Info("expired refresh tokens removed", "count", count)
 	}
+	proxy.startRefreshCleanup()
 	// получаем список зарегистрированных пользователей и запускаем соединение
 	for _, login := range store.ListUsers() {
 		mxconf, _ := store.GetUser(login) // получаем конфигурацию
@@ -159,7 +378,15 @@ func (p *Proxy) Close() error {
 	p.mu.Lock()
 	p.stopped = true // флаг остановки сервиса
 	p.mu.Unlock()
-	p.jwtGen.Close() // останавливаем удаление старых ключей
+	p.jwtGen.Close()        // останавливаем удаление старых ключей
+	p.refreshCleaner.Stop() // останавливаем удаление токенов обновления
+	p.events.Close()        // отключаем подписчиков на события
+	p.push.StopQueue()      // останавливаем повторную отправку уведомлений
+	// прерываем ожидание переподключения
+	p.breakers.Range(func(_, b interface{}) bool {
+		b.(*breaker).Wake()
+		return true
+	})
 	p.conns.Range(func(login, conn interface{}) bool {
 		p.conns.Delete(login)  // удаляем из списка
 		conn.(*MXConn).Close() // останавливаем соединение
@@ -191,7 +418,12 @@ func (p *Proxy) connect(conf *MXConfig) error {
 		}
 		return rest.NewError(status, err.Error())
 	}
+	p.restoreRecordings(conn)       // восстанавливаем список записей
 	p.conns.Store(conf.Login, conn) // сохраняем соединение в списке
+	go p.subscribePresence(conn)    // подписываемся на присутствие
+	var login = conf.Login
+	var breaker = p.getBreaker(login)
+	breaker.Connected()
 	log.Info("mx user connected", "login", conf.Login)
 
 	go func(conn *MXConn) {
@@ -225,8 +457,9 @@ func (p *Proxy) connect(conf *MXConfig) error {
 				delivered.Type = "Delivered"
 				// сохраняем информацию о входящем звонке
 				conn.Calls.Store(delivered.CallID, delivered)
+				conn.callDelivered(delivered)
 				ctxlog.Debug("store call info", "id", delivered.CallID)
-				p.push.Send(conn.Login, delivered) // отсылаем уведомление
+				p.notify(conn.Login, delivered) // отсылаем уведомление
 				ctxlog.Info("incoming call", "id", delivered.CallID)
 			case "EstablishedEvent": // состоявшийся звонок
 				var established = new(EstablishedEvent)
@@ -237,8 +470,9 @@ func (p *Proxy) connect(conf *MXConfig) error {
 				established.Type = "Established"
 				// сохраняем информацию о звонке
 				conn.Calls.Store(established.CallID, established)
+				conn.callEstablished(established)
 				ctxlog.Debug("store call info", "id", established.CallID)
-				p.push.Send(conn.Login, established) // отсылаем уведомление
+				p.notify(conn.Login, established) // отсылаем уведомление
 				ctxlog.Info("established call", "id", established.CallID)
 			case "OriginatedEvent":
 				var originated = new(OriginatedEvent)
@@ -247,7 +481,8 @@ func (p *Proxy) connect(conf *MXConfig) error {
 				}
 				originated.Timestamp = time.Now().Unix()
 				originated.Type = "Originated"
-				p.push.Send(conn.Login, originated) // отсылаем уведомление
+				conn.callOriginated(originated)
+				p.notify(conn.Login, originated) // отсылаем уведомление
 				ctxlog.Info("originated call", "id", originated.CallID)
 			case "ConnectionClearedEvent": // окончание звонка
 				var cleared = new(ConnectionClearedEvent)
@@ -256,10 +491,11 @@ func (p *Proxy) connect(conf *MXConfig) error {
 				}
 				// удаляем информацию о входящем звонке
 				conn.Calls.Delete(cleared.CallID)
+				conn.removeCall(cleared.CallID)
 				ctxlog.Debug("delete call info", "id", cleared.CallID)
 				cleared.Timestamp = time.Now().Unix()
 				cleared.Type = "ConnectionCleared"
-				p.push.Send(conn.Login, cleared) // отсылаем уведомление
+				p.notify(conn.Login, cleared) // отсылаем уведомление
 				ctxlog.Info("connection cleared call", "id", cleared.CallID)
 			case "HeldEvent": // блокировка звонка
 				var held = new(HeldEvent)
@@ -268,7 +504,8 @@ func (p *Proxy) connect(conf *MXConfig) error {
 				}
 				held.Timestamp = time.Now().Unix()
 				held.Type = "HeldEvent"
-				p.push.Send(conn.Login, held) // отсылаем уведомление
+				conn.callHeld(held)
+				p.notify(conn.Login, held) // отсылаем уведомление
 				ctxlog.Info("held call", "id", held.CallID)
 			case "RetrievedEvent": // разблокировка звонка
 				var retrived = new(RetrievedEvent)
@@ -277,8 +514,136 @@ func (p *Proxy) connect(conf *MXConfig) error {
 				}
 				retrived.Timestamp = time.Now().Unix()
 				retrived.Type = "RetrievedEvent"
-				p.push.Send(conn.Login, retrived) // отсылаем уведомление
+				conn.callRetrieved(retrived)
+				p.notify(conn.Login, retrived) // отсылаем уведомление
 				ctxlog.Info("retrieved call", "id", retrived.CallID)
+			case "TransferedEvent": // перевод звонка
+				var transfered = new(TransferedEvent)
+				if err := resp.Decode(transfered); err != nil {
+					return err
+				}
+				// пользователь, переводивший звонок, больше в них не участвует
+				if transfered.TransferringDevice == conn.Ext {
+					for _, callID := range []int64{transfered.PrimaryCallID,
+						transfered.SecondaryCallID} {
+						conn.Calls.Delete(callID)
+						conn.removeCall(callID)
+					}
+				}
+				transfered.Timestamp = time.Now().Unix()
+				transfered.Type = "Transfered"
+				p.notify(conn.Login, transfered) // отсылаем уведомление
+				ctxlog.Info("transfered call", "id", transfered.PrimaryCallID)
+			case "ForwardingEvent": // изменение переадресации
+				var forwarding = new(ForwardingEvent)
+				if err := resp.Decode(forwarding); err != nil {
+					return err
+				}
+				if forwarding.Device != "" && forwarding.Device != conn.Ext {
+					return nil
+				}
+				forwarding.ForwardingType = forwardingType(
+					forwarding.ForwardingType)
+				forwarding.Timestamp = time.Now().Unix()
+				forwarding.Type = "Forwarding"
+				// изменения настроек отправляются только в поток событий,
+				// чтобы не рассылать уведомления на устройства
+				p.events.Publish(conn.Login, forwarding)
+				ctxlog.Info("forwarding", "type", forwarding.ForwardingType,
+					"active", forwarding.Active)
+			case "DoNotDisturbEvent": // изменение режима "не беспокоить"
+				var dnd = new(DoNotDisturbEvent)
+				if err := resp.Decode(dnd); err != nil {
+					return err
+				}
+				if dnd.Device != "" && dnd.Device != conn.Ext {
+					return nil
+				}
+				dnd.Timestamp = time.Now().Unix()
+				dnd.Type = "DoNotDisturb"
+				p.events.Publish(conn.Login, dnd) // только в поток событий
+				ctxlog.Info("do not disturb", "on", dnd.On)
+			case "PresenceEvent": // изменение присутствия контакта
+				var presence = new(Presence)
+				if err := resp.Decode(presence); err != nil {
+					return err
+				}
+				// изменения присутствия отправляются только в поток событий,
+				// чтобы не рассылать уведомления на устройства
+				p.events.Publish(conn.Login, &PresenceEvent{
+					Type:     "Presence",
+					Presence: conn.updatePresence(presence),
+				})
+				ctxlog.Debug("presence", "jid", presence.JID,
+					"status", presence.Status)
+			case "AgentReadyEvent", "AgentNotReadyEvent",
+				"AgentWorkingAfterCallEvent", "AgentBusyEvent",
+				"AgentLoggedOnEvent", "AgentLoggedOffEvent": // состояние агента
+				var agent = new(AgentStateEvent)
+				if err := resp.Decode(agent); err != nil {
+					return err
+				}
+				if agent.Device != "" && agent.Device != conn.Ext {
+					return nil
+				}
+				agent.State = agentEvents[resp.Name]
+				agent.Timestamp = time.Now().Unix()
+				agent.Type = "AgentState"
+				p.events.Publish(conn.Login, agent) // только в поток событий
+				ctxlog.Info("agent state", "state", agent.State,
+					"group", agent.Group)
+			case "ConfAddEvent", "ConfUpdEvent": // конференция создана или изменена
+				var conf = new(Conference)
+				if err := resp.Decode(conf); err != nil {
+					return err
+				}
+				conn.conferenceUpdated(conf)
+				ctxlog.Debug("conference", "id", conf.ID, "event", resp.Name)
+			case "ConfDelEvent": // конференция удалена
+				var conf = new(Conference)
+				if err := resp.Decode(conf); err != nil {
+					return err
+				}
+				conn.conferenceDeleted(conf.ID)
+				ctxlog.Debug("conference deleted", "id", conf.ID)
+			case "ConfPartyAddEvent", "ConfPartyUpdEvent",
+				"ConfPartyDelEvent": // изменение состава участников конференции
+				var party = new(struct {
+					ConfID string `xml:"confId"`
+					ConferenceParticipant
+				})
+				if err := resp.Decode(party); err != nil {
+					return err
+				}
+				var event = &ConferencePartyEvent{
+					ConfID: party.ConfID,
+					Participant: conn.conferenceParty(party.ConfID,
+						&party.ConferenceParticipant,
+						resp.Name == "ConfPartyDelEvent"),
+					Timestamp: time.Now().Unix(),
+				}
+				switch resp.Name {
+				case "ConfPartyAddEvent":
+					event.Type = "ConferenceJoined"
+				case "ConfPartyUpdEvent":
+					event.Type = "ConferenceParticipant"
+				case "ConfPartyDelEvent":
+					event.Type = "ConferenceLeft"
+				}
+				p.events.Publish(conn.Login, event) // только в поток событий
+				ctxlog.Info("conference participant", "id", party.ConfID,
+					"party", party.ID, "event", event.Type)
+			case "ConfLockEvent": // вход в конференцию закрыт или открыт
+				var lock = new(ConferenceLockEvent)
+				if err := resp.Decode(lock); err != nil {
+					return err
+				}
+				conn.conferenceLocked(lock.ConfID, lock.Locked)
+				lock.Timestamp = time.Now().Unix()
+				lock.Type = "ConferenceLock"
+				p.events.Publish(conn.Login, lock) // только в поток событий
+				ctxlog.Info("conference lock", "id", lock.ConfID,
+					"locked", lock.Locked)
 			case "MailIncomingReadyEvent": // новое голосовое сообщение
 				var vmail = new(MailIncomingReadyEvent)
 				if err := resp.Decode(vmail); err != nil {
@@ -288,7 +653,7 @@ func (p *Proxy) connect(conf *MXConfig) error {
 				// ctxlog.Debug("MailIncomingReadyEvent:", "data", vmail)
 				// Сохраняем список записанных звонков
 				if vmail.MediaType == "Recording" {
-					conn.Recs.Store(vmail.MailID, &VoiceMail{
+					var rec = &VoiceMail{
 						From:       vmail.From,
 						FromName:   vmail.FromName,
 						CallerName: vmail.CallerName,
@@ -300,7 +665,13 @@ func (p *Proxy) connect(conf *MXConfig) error {
 						Duration:   vmail.Duration,
 						Read:       vmail.Read,
 						Note:       vmail.Note,
-					})
+					}
+					conn.Recs.Store(vmail.MailID, rec)
+					// сохраняем в хранилище для восстановления после
+					// перезапуска сервиса или переподключения
+					if err := p.store.AddRecording(conn.Login, rec); err != nil {
+						ctxlog.Error("store recording error", "error", err)
+					}
 					ctxlog.Debug("store recording", "id", vmail.MailID)
 				}
 				// игнорируем прочитанные голосовые сообщения
@@ -310,7 +681,7 @@ func (p *Proxy) connect(conf *MXConfig) error {
 				}
 				vmail.Timestamp = time.Now().Unix()
 				vmail.Type = "MailIncoming"
-				p.push.Send(conn.Login, vmail) // отсылаем уведомление
+				p.notify(conn.Login, vmail) // отсылаем уведомление
 				ctxlog.Info("new voice mail", "id", vmail.MailID)
 			case "RecordingStateEvent":
 				var rec = new(struct {
@@ -326,13 +697,18 @@ func (p *Proxy) connect(conf *MXConfig) error {
 				}
 				rec.Timestamp = time.Now().Unix()
 				rec.Type = "RecordingState"
-				p.push.Send(conn.Login, rec) // отсылаем уведомление
+				p.notify(conn.Login, rec) // отсылаем уведомление
 				ctxlog.Info("recording state", "id", rec.CallID)
 			}
 			return nil
 		}, "DeliveredEvent", "MailIncomingReadyEvent", "EstablishedEvent",
 			"OriginatedEvent", "ConnectionClearedEvent", "HeldEvent",
-			"RetrievedEvent", "RecordingStateEvent")
+			"RetrievedEvent", "RecordingStateEvent", "TransferedEvent",
+			"ForwardingEvent", "DoNotDisturbEvent", "PresenceEvent",
+			"AgentReadyEvent", "AgentNotReadyEvent", "AgentWorkingAfterCallEvent",
+			"AgentBusyEvent", "AgentLoggedOnEvent", "AgentLoggedOffEvent",
+			"ConfAddEvent", "ConfUpdEvent", "ConfDelEvent", "ConfPartyAddEvent",
+			"ConfPartyUpdEvent", "ConfPartyDelEvent", "ConfLockEvent")
 		// проверяем, что сервис или соединение не остановлены
 		if _, ok := p.conns.Load(conf.Login); p.isStopped() || !ok {
 			return // сервис или соединение остановлены
@@ -345,28 +721,40 @@ func (p *Proxy) connect(conf *MXConfig) error {
 			ctxlog.Error("mx user connection error", "error", err)
 		}
 		p.conns.Delete(conf.Login) // удаляем из списка соединений
+		// первая попытка переподключения выполняется сразу
+		var delay = breaker.Failed(err)
 	reconnect:
-		conf, err = p.store.GetUser(conf.Login) // получаем конфигураию
+		conf, err = p.store.GetUser(login) // получаем конфигураию
 		if err != nil {
+			p.removeBreaker(login)
 			ctxlog.Error("mx user config error", "error", err)
 			return
 		}
-		ctxlog.Debug("mx user reconnecting", "delay", time.Minute)
-		time.Sleep(time.Minute) // задержка перед переподключением
+		if delay > 0 {
+			ctxlog.Debug("mx user reconnecting", "delay", delay)
+			breaker.Wait(delay) // задержка перед переподключением
+		}
 		if p.isStopped() {
 			return // сервис остановлен
 		}
+		metricReconnects.Inc(conf.Login)
 		conn, err = MXConnect(conf)
 		if err != nil {
+			metricReconnectFailures.Inc(conf.Login)
 			log.Error("mx user connection error", "error", err)
 			// в случае ошибки авторизации удаляем пользователя
 			if _, ok := err.(*mx.LoginError); ok {
+				p.removeBreaker(login)
 				p.store.RemoveUser(conf.Login)
 				return
 			}
+			delay = breaker.Failed(err)
 			goto reconnect
 		}
+		p.restoreRecordings(conn)       // восстанавливаем список записей
 		p.conns.Store(conf.Login, conn) // сохраняем соединение в списке
+		go p.subscribePresence(conn)    // подписываемся на присутствие
+		breaker.Connected()
 		ctxlog.Info("mx user connected")
 		goto monitoring
 	}(conn)
@@ -374,6 +762,35 @@ func (p *Proxy) connect(conf *MXConfig) error {
 	return nil
 }
 
+// restoreRecordings загружает в соединение сохраненный список записанных
+// звонков пользователя. Сервер MX не отдает список записей, поэтому без
+// хранилища он был бы пуст после перезапуска сервиса или переподключения.
+func (p *Proxy) restoreRecordings(conn *MXConn) {
+	for _, rec := range p.store.Recordings(conn.Login) {
+		conn.Recs.Store(rec.ID, rec)
+	}
+}
+
+// subscribePresence подписывает соединение на изменения присутствия
+// контактов адресной книги.
+func (p *Proxy) subscribePresence(conn *MXConn) {
+	contacts, _, err := conn.AddressBook()
+	if err == nil {
+		err = conn.PresenceSubscribe(contacts)
+	}
+	if err != nil {
+		log.Error("presence subscribe error", "login", conn.Login,
+			"error", err)
+	}
+}
+
+// notify отсылает уведомление о событии на все устройства пользователя и
+// всем его активным подписчикам на поток событий.
+func (p *Proxy) notify(login string, obj interface{}) {
+	p.events.Publish(login, obj)
+	p.push.Send(login, obj)
+}
+
 // DeliveredEvent описывает структуру события входящего звонка
 type DeliveredEvent struct {
 	Type                  string `xml:"-" json:"type"`
@@ -490,6 +907,8 @@ type MailIncomingReadyEvent struct {
 func (p *Proxy) Login(c *rest.Context) (err error) {
 	// получаем информацию об авторизации из заголовка запроса
 	var mxconf *MXConfig
+	var refreshClientID string // приложение для токена обновления
+	var usedRefresh string     // использованный токен обновления
 	switch auth := c.Header("Authorization"); {
 	case strings.HasPrefix(auth, "Bearer "):
 		var token = strings.TrimPrefix(auth, "Bearer ") // авторизационный токен
@@ -506,16 +925,32 @@ func (p *Proxy) Login(c *rest.Context) (err error) {
 			return c.Error(http.StatusForbidden, "bad client-id or app secret")
 		}
 		// проверяем, что тип запроса соответствует OAuth2 спецификации
-		if c.Form("grant_type") != "password" {
+		switch c.Form("grant_type") {
+		case "password":
+			// получаем логин и пароль пользователя из запроса
+			var login, password = c.Form("username"), c.Form("password")
+			// проверяем авторизацию на сервере провижининга
+			mxconf, err = p.GetProvisioning(login, password, "")
+			if err != nil {
+				return err
+			}
+		case "refresh_token":
+			// проверяем токен обновления: он заменяется новым только после
+			// успешного подключения и выдачи токена авторизации
+			usedRefresh = c.Form("refresh_token")
+			info, err := p.store.GetRefreshToken(usedRefresh, clientID)
+			if err != nil {
+				return c.Error(http.StatusBadRequest, "invalid refresh_token")
+			}
+			c.AddLogField("login", info.Login)
+			// пользователь должен быть зарегистрирован
+			if mxconf, err = p.store.GetUser(info.Login); err != nil {
+				return c.Error(http.StatusBadRequest, "invalid refresh_token")
+			}
+		default:
 			return c.Error(http.StatusForbidden, "bad grant_type")
 		}
-		// получаем логин и пароль пользователя из запроса
-		var login, password = c.Form("username"), c.Form("password")
-		// проверяем авторизацию на сервере провижининга
-		mxconf, err = p.GetProvisioning(login, password, "")
-		if err != nil {
-			return err
-		}
+		refreshClientID = clientID
 	default:
 		c.SetHeader("WWW-Authenticate",
 			fmt.Sprintf("Basic realm=%q", appName+" client application"))
@@ -537,7 +972,11 @@ func (p *Proxy) Login(c *rest.Context) (err error) {
 		return err
 	}
 	// создаем токен на основании предоставленной информации и отдаем его
-	tokenInfo, err := p.jwtGen.Token(mxconf.Login)
+	tokenInfo, err := p.issueToken(mxconf.Login, refreshClientID, usedRefresh)
+	if err == ErrNotFound {
+		// токен обновления уже использован параллельным запросом
+		return c.Error(http.StatusBadRequest, "invalid refresh_token")
+	}
 	if err != nil {
 		return err
 	}
@@ -560,11 +999,24 @@ func (p *Proxy) Logout(c *rest.Context) error {
 			fmt.Sprintf("invalid token: %s", err.Error()))
 	}
 	c.AddLogField("login", login) // добавляем в лог
+	// если указан токен обновления, то отзываем только его
+	if refresh := c.Form("refresh_token"); refresh != "" {
+		if err = p.store.RemoveRefreshToken(refresh, login); err != nil {
+			return err
+		}
+		log.Info("refresh token revoked", "login", login)
+		return c.Write(rest.JSON{"revoked": 1})
+	}
 	// останавливаем соединение
 	if conn, ok := p.conns.Load(login); ok {
 		p.conns.Delete(login)  // удаляем из списка
 		conn.(*MXConn).Close() // останавливаем соединение
 	}
+	p.removeBreaker(login)             // прерываем переподключение
+	p.store.RemoveRefreshTokens(login) // отзываем токены обновления
+	p.store.RemoveRecordings(login)    // удаляем список записей
+	p.store.RemoveCalls(login)         // удаляем лог звонков
+	p.events.Remove(login)             // отключаем подписчиков на события
 	// удаляем из хранилища
 	if err = p.store.RemoveUser(login); err != nil {
 		return err
@@ -624,42 +1076,210 @@ func (p *Proxy) LoginInfo(c *rest.Context) error {
 	})
 }
 
-// Contacts отдает адресную книгу сервера MX.
+// Contacts отдает адресную книгу сервера MX. Формат ответа (JSON, vCard или
+// CSV) выбирается по заголовку Accept.
 func (p *Proxy) Contacts(c *rest.Context) error {
 	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
 	if err != nil {
 		return err
 	}
 	// получаем список контактов
-	contacts, err := conn.Contacts()
+	contacts, version, err := conn.AddressBook()
+	if err != nil {
+		return err
+	}
+	var format = contactsFormat(c.Header("Accept"))
+	c.SetHeader("Vary", "Accept")
+	var etag = contactsETag(version, format+"\x00"+c.Request.URL.RawQuery)
+	c.SetHeader("ETag", etag)
+	if etagMatch(c.Header("If-None-Match"), etag) {
+		return c.Status(http.StatusNotModified).Write(nil)
+	}
+	// выбираем контакты, соответствующие поисковому запросу
+	if terms := searchTerms(c.Query("q")); len(terms) > 0 {
+		var found = make([]*Contact, 0)
+		for _, contact := range contacts {
+			if contactMatch(contact, terms) {
+				found = append(found, contact)
+			}
+		}
+		contacts = found
+	}
+	var fields []string // отдаваемые поля контакта
+	if value := c.Query("fields"); value != "" {
+		if fields, err = parseContactFields(value); err != nil {
+			return c.Error(http.StatusBadRequest, err.Error())
+		}
+	}
+	// для импорта отдается вся адресная книга без разбиения на страницы
+	if format != "json" {
+		return writeContacts(c, format, "contacts", contacts, fields)
+	}
+	var result = rest.JSON{"total": len(contacts)}
+	// постраничная отдача
+	if cursor := c.Query("cursor"); cursor != "" {
+		if contacts, err = contactsAfter(contacts, cursor); err != nil {
+			return c.Error(http.StatusBadRequest, err.Error())
+		}
+	}
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > ContactsMaxLimit {
+			return c.Error(http.StatusBadRequest, "bad limit")
+		}
+		if len(contacts) > limit {
+			contacts = contacts[:limit]
+			result["nextCursor"] = contactCursor(contacts[limit-1])
+		}
+	}
+	// отдаем только указанные поля
+	if fields != nil {
+		if result["contacts"], err = selectFields(contacts, fields); err != nil {
+			return err
+		}
+		return c.Write(result)
+	}
+	result["contacts"] = contacts
+	return c.Write(result)
+}
+
+// Contact отдает информацию о контакте из адресной книги по его
+// идентификатору в формате JSON, vCard или CSV.
+func (p *Proxy) Contact(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	jid, err := strconv.ParseUint(c.Param("jid"), 10, 64)
+	if err != nil {
+		return c.Error(http.StatusNotFound, err.Error())
+	}
+	contacts, version, err := conn.AddressBook()
 	if err != nil {
 		return err
 	}
-	return c.Write(rest.JSON{"contacts": contacts})
+	var contact *Contact
+	for _, item := range contacts {
+		if uint64(item.JID) == jid {
+			contact = item
+			break
+		}
+	}
+	if contact == nil {
+		return rest.ErrNotFound
+	}
+	var format = contactsFormat(c.Header("Accept"))
+	c.SetHeader("Vary", "Accept")
+	var etag = contactsETag(version, format+"\x00"+c.Param("jid"))
+	c.SetHeader("ETag", etag)
+	if etagMatch(c.Header("If-None-Match"), etag) {
+		return c.Status(http.StatusNotModified).Write(nil)
+	}
+	if format != "json" {
+		return writeContacts(c, format, c.Param("jid"),
+			[]*Contact{contact}, nil)
+	}
+	return c.Write(rest.JSON{"contact": contact})
+}
+
+// writeContacts отдает контакты в формате vCard или CSV в виде файла с
+// указанным именем.
+func writeContacts(c *rest.Context, format, name string, contacts []*Contact,
+	fields []string) error {
+	var data []byte
+	switch format {
+	case "vcard":
+		data = contactsVCard(contacts)
+		name += ".vcf"
+	case "csv":
+		var err error
+		if data, err = contactsCSV(contacts, fields); err != nil {
+			return err
+		}
+		name += ".csv"
+	}
+	c.SetHeader("Content-Type", contactsMimetypes[format])
+	c.SetHeader("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", name))
+	return c.Write(data)
 }
 
-// CallLog отдает лог звонков пользователя.
+// CallLog отдает лог звонков пользователя. Лог звонков хранится в хранилище
+// и перед отдачей дополняется новыми записями с сервера MX. Клиент может
+// передать syncToken из предыдущего ответа, чтобы получить только новые
+// записи.
 func (p *Proxy) CallLog(c *rest.Context) error {
 	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
 	if err != nil {
 		return err
 	}
-	var timestamp = c.Query("timestamp")
-	var ts time.Time
-	if timestamp != "" {
-		if t, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
-			ts = time.Unix(t, 0)
-		} else if t, err := time.Parse(time.RFC3339, timestamp); err == nil {
-			ts = t
-		} else {
-			return c.Error(http.StatusBadRequest, "bad timestamp format")
+	// разбираем условия выборки
+	var filter = new(callLogFilter)
+	if value := c.Query("timestamp"); value != "" {
+		ts, err := parseTimestamp(value)
+		if err != nil {
+			return c.Error(http.StatusBadRequest, err.Error())
 		}
+		filter.From = ts + 1 // звонки после указанного времени
 	}
-	calllog, err := conn.CallLog(ts) // получаем лог звонков
-	if err != nil {
+	if value := c.Query("from"); value != "" {
+		if filter.From, err = parseTimestamp(value); err != nil {
+			return c.Error(http.StatusBadRequest, err.Error())
+		}
+	}
+	if value := c.Query("to"); value != "" {
+		if filter.To, err = parseTimestamp(value); err != nil {
+			return c.Error(http.StatusBadRequest, err.Error())
+		}
+	}
+	switch filter.Direction = c.Query("direction"); filter.Direction {
+	case "", "incoming", "outgoing":
+	default:
+		return c.Error(http.StatusBadRequest, "bad direction")
+	}
+	if value := c.Query("missed"); value != "" {
+		missed, err := strconv.ParseBool(value)
+		if err != nil {
+			return c.Error(http.StatusBadRequest, "bad missed flag")
+		}
+		filter.Missed = &missed
+	}
+	var after int64 // номер записи, после которой отдаются записи
+	if value := c.Query("syncToken"); value != "" {
+		if after, err = strconv.ParseInt(value, 10, 64); err != nil || after < 0 {
+			return c.Error(http.StatusBadRequest, "bad syncToken")
+		}
+	}
+	var limit int
+	if value := c.Query("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > CallLogMaxLimit {
+			return c.Error(http.StatusBadRequest, "bad limit")
+		}
+	}
+	// формат экспорта лога звонков
+	var format = c.Query("format")
+	if _, ok := callLogExportMimetypes[format]; !ok && format != "" &&
+		format != "json" {
+		return c.Error(http.StatusBadRequest,
+			fmt.Sprintf("unsupported format %q", format))
+	}
+	// получаем новые записи с сервера MX
+	if err = p.syncCallLog(conn); err != nil {
 		return err
 	}
-	return c.Write(rest.JSON{"callLog": calllog})
+	if format == "csv" || format == "jsonl" {
+		return p.exportCallLog(c, conn, format, after, filter, limit)
+	}
+	calllog, last, more := p.store.Calls(conn.Login, after, filter.match, limit)
+	var result = rest.JSON{
+		"callLog":   calllog,
+		"syncToken": strconv.FormatInt(last, 10),
+	}
+	if more {
+		result["more"] = true
+	}
+	return c.Write(result)
 }
 
 // SetMode устанавливает режим звонка.
@@ -789,8 +1409,9 @@ func (p *Proxy) Transfer(c *rest.Context) error {
 	return c.Write(rest.JSON{"transfer": params})
 }
 
-// ClearConnection сбрасывает звонок.
-func (p *Proxy) ClearConnection(c *rest.Context) error {
+// SendDigits отправляет в установленный звонок тоновые сигналы DTMF. Паузы,
+// заданные в строке, выдерживаются сервисом между отправкой ее частей.
+func (p *Proxy) SendDigits(c *rest.Context) error {
 	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
 	if err != nil {
 		return err
@@ -799,15 +1420,50 @@ func (p *Proxy) ClearConnection(c *rest.Context) error {
 	if err != nil {
 		return c.Error(http.StatusNotFound, err.Error())
 	}
-	cleared, err := conn.ClearConnection(callID)
-	if err != nil {
+	var params = new(struct {
+		Digits string `json:"digits" form:"digits"`
+	})
+	if err = c.Bind(params); err != nil {
 		return err
 	}
-	return c.Write(rest.JSON{"connectionCleared": cleared})
+	parts, err := parseDTMF(params.Digits)
+	if err != nil {
+		return c.Error(http.StatusBadRequest, err.Error())
+	}
+	// сигналы можно отправить только в звонок в состоянии разговора
+	call, ok := conn.ActiveCall(callID)
+	if !ok {
+		return rest.ErrNotFound
+	}
+	if call.State != CallStateConnected {
+		return c.Error(http.StatusConflict,
+			fmt.Sprintf("call is %s, not connected", call.State))
+	}
+	var done = c.Request.Context().Done()
+	for i, part := range parts {
+		if i > 0 {
+			select {
+			case <-time.After(DTMFPause):
+			case <-done: // пользователь закрыл соединение
+				return nil
+			}
+		}
+		if part == "" {
+			continue // несколько пауз подряд
+		}
+		if err = conn.GenerateDigits(callID, part); err != nil {
+			return err
+		}
+	}
+	return c.Write(rest.JSON{"dtmf": rest.JSON{
+		"callId": callID,
+		"digits": strings.Join(parts, ","),
+	}})
 }
 
-// CallHold блокирует звонок.
-func (p *Proxy) CallHold(c *rest.Context) error {
+// ConsultationCall ставит звонок на удержание и звонит на указанный номер
+// для консультации перед переводом звонка.
+func (p *Proxy) ConsultationCall(c *rest.Context) error {
 	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
 	if err != nil {
 		return err
@@ -816,67 +1472,470 @@ func (p *Proxy) CallHold(c *rest.Context) error {
 	if err != nil {
 		return c.Error(http.StatusNotFound, err.Error())
 	}
-	held, err := conn.CallHold(callID)
+	var params = new(struct {
+		To string `json:"to" form:"to"`
+	})
+	if err = c.Bind(params); err != nil {
+		return err
+	}
+	if params.To == "" {
+		return c.Error(http.StatusBadRequest, "consulted number required")
+	}
+	consultation, err := conn.ConsultationCall(callID, params.To)
 	if err != nil {
 		return err
 	}
-	return c.Write(rest.JSON{"held": held})
+	return c.Write(rest.JSON{"consultation": rest.JSON{
+		"callId":     consultation.CallID,
+		"deviceId":   consultation.DeviceID,
+		"heldCallId": callID,
+		"to":         params.To,
+	}})
 }
 
-// CallUnHold разблокирует звонок.
-func (p *Proxy) CallUnHold(c *rest.Context) error {
+// callPair возвращает идентификаторы удерживаемого звонка, указанного в пути
+// запроса, и активного звонка из параметров запроса. Если активный звонок не
+// указан, то используется единственный другой текущий звонок пользователя.
+func callPair(c *rest.Context, conn *MXConn) (held, active int64, err error) {
+	if held, err = strconv.ParseInt(c.Param("id"), 10, 64); err != nil {
+		return 0, 0, c.Error(http.StatusNotFound, err.Error())
+	}
+	var params = new(struct {
+		ActiveCallID int64 `json:"activeCallId" form:"activeCallId"`
+	})
+	if err = c.Bind(params); err != nil {
+		return 0, 0, err
+	}
+	if active = params.ActiveCallID; active == 0 {
+		var ok bool
+		if active, ok = conn.otherCall(held); !ok {
+			return 0, 0, c.Error(http.StatusBadRequest,
+				"active call id required")
+		}
+	}
+	if active == held {
+		return 0, 0, c.Error(http.StatusBadRequest,
+			"active call must differ from held call")
+	}
+	return held, active, nil
+}
+
+// TransferComplete завершает перевод звонка после консультации: соединяет
+// удерживаемый звонок с активным.
+func (p *Proxy) TransferComplete(c *rest.Context) error {
 	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
 	if err != nil {
 		return err
 	}
-	callID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	held, active, err := callPair(c, conn)
 	if err != nil {
-		return c.Error(http.StatusNotFound, err.Error())
+		return err
 	}
-	retrieved, err := conn.CallUnHold(callID)
+	transfered, err := conn.TransferCall(held, active)
 	if err != nil {
 		return err
 	}
-	return c.Write(rest.JSON{"retrieved": retrieved})
+	transfered.Timestamp = time.Now().Unix()
+	transfered.Type = "Transfered"
+	return c.Write(rest.JSON{"transfered": transfered})
 }
 
-// CallInfo отдает информацию о звонке.
-func (p *Proxy) CallInfo(c *rest.Context) error {
+// AlternateCall ставит активный звонок на удержание и снимает с удержания
+// звонок, указанный в запросе.
+func (p *Proxy) AlternateCall(c *rest.Context) error {
 	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
 	if err != nil {
 		return err
 	}
-	callID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	held, active, err := callPair(c, conn)
 	if err != nil {
-		return c.Error(http.StatusNotFound, err.Error())
+		return err
 	}
-	callInfo, ok := conn.Calls.Load(callID)
-	if !ok {
-		return rest.ErrNotFound
+	if err = conn.AlternateCall(held, active); err != nil {
+		return err
 	}
-	return c.Write(rest.JSON{"callInfo": callInfo})
+	return c.Write(rest.JSON{"alternate": rest.JSON{
+		"heldCallId":   active,
+		"activeCallId": held,
+	}})
 }
 
-// Voicemails отдает список голосовых сообщений пользователя.
-func (p *Proxy) Voicemails(c *rest.Context) error {
-	conn, err := p.getConnection(c)
+// ReconnectCall сбрасывает активный звонок и возвращается к звонку,
+// указанному в запросе.
+func (p *Proxy) ReconnectCall(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
 	if err != nil {
 		return err
 	}
-	var mediaType = c.Query("media") // запрашиваем тип медиа
-	// возвращаем только записанные звонки
-	if mediaType == "Recording" {
-		return c.Write(rest.JSON{"voiceMails": conn.RecordsList()})
-	}
-	vmlist, err := conn.VoiceMailList( /*mediaType*/ )
+	held, active, err := callPair(c, conn)
 	if err != nil {
 		return err
 	}
-	// добавляем информацию о записанных звонках
-	if mediaType == "" {
-		vmlist = append(vmlist, conn.RecordsList()...)
-		sort.Slice(vmlist, func(i, j int) bool {
-			return vmlist[i].Received < vmlist[j].Received
+	if err = conn.ReconnectCall(held, active); err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"reconnect": rest.JSON{
+		"clearedCallId": active,
+		"activeCallId":  held,
+	}})
+}
+
+// PickupCall перехватывает звонок: звонок на указанный номер или, если номер
+// не указан, звонок в группу перехвата.
+func (p *Proxy) PickupCall(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	var params = new(struct {
+		Ext    string `json:"ext,omitempty" form:"ext"`
+		CallID int64  `json:"callId,omitempty" form:"callId"`
+		Group  string `json:"group,omitempty" form:"group"`
+		Device string `json:"device,omitempty" form:"device"`
+	})
+	if err = c.Bind(params); err != nil {
+		return err
+	}
+	var picked *PickupResponse
+	switch {
+	case params.Ext != "":
+		if params.Group != "" {
+			return c.Error(http.StatusBadRequest,
+				"ext and group are mutually exclusive")
+		}
+		picked, err = conn.DirectedPickupCall(params.CallID, params.Ext,
+			params.Device)
+	case params.CallID != 0:
+		return c.Error(http.StatusBadRequest, "ext required")
+	default:
+		picked, err = conn.GroupPickupCall(params.Group, params.Device)
+	}
+	if err != nil {
+		if _, ok := err.(*mx.CSTAError); ok {
+			return c.Error(http.StatusNotFound, err.Error())
+		}
+		return err
+	}
+	return c.Write(rest.JSON{"pickup": picked})
+}
+
+// isParkOrbit возвращает true, если строка является номером орбиты парковки.
+func isParkOrbit(orbit string) bool {
+	return orbit != "" && onlyDigits(orbit) == orbit
+}
+
+// ParkCall паркует звонок на орбиту.
+func (p *Proxy) ParkCall(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	callID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.Error(http.StatusNotFound, err.Error())
+	}
+	var params = new(struct {
+		Orbit string `json:"orbit,omitempty" form:"orbit"`
+	})
+	if err = c.Bind(params); err != nil {
+		return err
+	}
+	if params.Orbit != "" && !isParkOrbit(params.Orbit) {
+		return c.Error(http.StatusBadRequest, "bad park orbit")
+	}
+	orbit, err := conn.ParkCall(callID, params.Orbit)
+	if err != nil {
+		if _, ok := err.(*mx.CSTAError); ok {
+			return c.Error(http.StatusBadRequest, err.Error())
+		}
+		return err
+	}
+	return c.Write(rest.JSON{"park": rest.JSON{
+		"callId": callID,
+		"orbit":  orbit,
+	}})
+}
+
+// UnparkCall забирает звонок, припаркованный на орбите.
+func (p *Proxy) UnparkCall(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	var orbit = c.Param("orbit")
+	if !isParkOrbit(orbit) {
+		return c.Error(http.StatusNotFound, "bad park orbit")
+	}
+	var params = new(struct {
+		Device string `json:"device,omitempty" form:"device"`
+	})
+	if err = c.Bind(params); err != nil {
+		return err
+	}
+	picked, err := conn.UnparkCall(orbit, params.Device)
+	if err != nil {
+		if _, ok := err.(*mx.CSTAError); ok {
+			return c.Error(http.StatusNotFound, err.Error())
+		}
+		return err
+	}
+	return c.Write(rest.JSON{"unpark": rest.JSON{
+		"orbit":    orbit,
+		"callId":   picked.CallID,
+		"deviceId": picked.DeviceID,
+	}})
+}
+
+// ClearConnection сбрасывает звонок.
+func (p *Proxy) ClearConnection(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	callID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.Error(http.StatusNotFound, err.Error())
+	}
+	cleared, err := conn.ClearConnection(callID)
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"connectionCleared": cleared})
+}
+
+// CallHold блокирует звонок.
+func (p *Proxy) CallHold(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	callID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.Error(http.StatusNotFound, err.Error())
+	}
+	held, err := conn.CallHold(callID)
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"held": held})
+}
+
+// CallUnHold разблокирует звонок.
+func (p *Proxy) CallUnHold(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	callID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.Error(http.StatusNotFound, err.Error())
+	}
+	retrieved, err := conn.CallUnHold(callID)
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"retrieved": retrieved})
+}
+
+// CallInfo отдает информацию о звонке.
+func (p *Proxy) CallInfo(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	callID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.Error(http.StatusNotFound, err.Error())
+	}
+	callInfo, ok := conn.Calls.Load(callID)
+	if !ok {
+		return rest.ErrNotFound
+	}
+	return c.Write(rest.JSON{"callInfo": callInfo})
+}
+
+// ActiveCalls отдает список текущих звонков пользователя с их состоянием.
+// Позволяет клиенту после переподключения узнать о звонках, начавшихся до
+// его подключения.
+func (p *Proxy) ActiveCalls(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"calls": conn.ActiveCalls()})
+}
+
+// Forwarding отдает правила переадресации звонков пользователя.
+func (p *Proxy) Forwarding(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	list, err := conn.GetForwarding()
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"forwarding": list})
+}
+
+// SetForwarding включает или отключает правило переадресации звонков и
+// отдает измененный список правил.
+func (p *Proxy) SetForwarding(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	var params = new(Forwarding)
+	if err = c.Bind(params); err != nil {
+		return err
+	}
+	if err = conn.SetForwarding(params); err != nil {
+		return err
+	}
+	list, err := conn.GetForwarding()
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"forwarding": list})
+}
+
+// DoNotDisturb отдает состояние режима "не беспокоить".
+func (p *Proxy) DoNotDisturb(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	on, err := conn.GetDoNotDisturb()
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"dnd": on})
+}
+
+// SetDoNotDisturb включает или отключает режим "не беспокоить".
+func (p *Proxy) SetDoNotDisturb(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	var params = new(struct {
+		On bool `json:"dnd" form:"dnd"`
+	})
+	if err = c.Bind(params); err != nil {
+		return err
+	}
+	if err = conn.SetDoNotDisturb(params.On); err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"dnd": params.On})
+}
+
+// Presence отдает состояние присутствия контактов адресной книги и
+// состояние пользователя в группах ACD.
+func (p *Proxy) Presence(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	// обновляем адресную книгу, если она устарела: при ее изменении
+	// повторяется подписка на присутствие контактов
+	if _, _, err = conn.AddressBook(); err != nil {
+		log.Error("address book error", "login", conn.Login, "error", err)
+	}
+	var result = rest.JSON{"presence": conn.PresenceList()}
+	// ошибка получения состояния агента не мешает отдать присутствие
+	if groups, err := conn.AgentGroups(); err != nil {
+		log.Error("agent groups error", "login", conn.Login, "error", err)
+	} else {
+		result["agent"] = rest.JSON{"groups": groups}
+	}
+	return c.Write(result)
+}
+
+// SetPresence изменяет состояние присутствия пользователя и его состояние
+// как агента в группах ACD.
+func (p *Proxy) SetPresence(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	var params = new(struct {
+		Status string `json:"status,omitempty" form:"status"`
+		Note   string `json:"note,omitempty" form:"note"`
+		State  string `json:"state,omitempty" form:"state"`
+	})
+	if err = c.Bind(params); err != nil {
+		return err
+	}
+	if params.Status == "" && params.State == "" {
+		return c.Error(http.StatusBadRequest, "status or state required")
+	}
+	if params.Status != "" {
+		var known bool
+		for _, status := range presenceStatuses {
+			if params.Status == status {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return c.Error(http.StatusBadRequest,
+				fmt.Sprintf("unknown presence status %q", params.Status))
+		}
+		if err = conn.SetPresence(params.Status, params.Note); err != nil {
+			return err
+		}
+	}
+	if params.State != "" {
+		if err = conn.SetAgentState(params.State); err != nil {
+			return err
+		}
+	}
+	return c.Write(rest.JSON{"presence": params})
+}
+
+// AgentLogin регистрирует пользователя как агента в группе ACD или отменяет
+// регистрацию и отдает измененный список групп.
+func (p *Proxy) AgentLogin(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.Error(http.StatusNotFound, err.Error())
+	}
+	var login = c.Request.Method != "DELETE"
+	if err = conn.AgentLogin(mx.JID(id), login); err != nil {
+		return err
+	}
+	groups, err := conn.AgentGroups()
+	if err != nil {
+		return err
+	}
+	return c.Write(rest.JSON{"agent": rest.JSON{"groups": groups}})
+}
+
+// Voicemails отдает список голосовых сообщений пользователя.
+func (p *Proxy) Voicemails(c *rest.Context) error {
+	conn, err := p.getConnection(c)
+	if err != nil {
+		return err
+	}
+	var mediaType = c.Query("media") // запрашиваем тип медиа
+	// возвращаем только записанные звонки
+	if mediaType == "Recording" {
+		return c.Write(rest.JSON{"voiceMails": conn.RecordsList()})
+	}
+	vmlist, err := conn.VoiceMailList( /*mediaType*/ )
+	if err != nil {
+		return err
+	}
+	// добавляем информацию о записанных звонках
+	if mediaType == "" {
+		vmlist = append(vmlist, conn.RecordsList()...)
+		sort.Slice(vmlist, func(i, j int) bool {
+			return vmlist[i].Received < vmlist[j].Received
 		})
 	}
 	return c.Write(rest.JSON{"voiceMails": vmlist})
@@ -899,7 +1958,11 @@ func (p *Proxy) DeleteVoicemail(c *rest.Context) error {
 	// удаляем из списка записанных звонков
 	if mediaType == "Recording" {
 		conn.Recs.Delete(msgID)
+		if err := p.store.RemoveRecording(conn.Login, msgID); err != nil {
+			log.Error("store recording error", "error", err)
+		}
 	}
+	p.cache.Remove(conn.Login, mediaType, msgID) // удаляем из кеша
 	return nil
 }
 
@@ -932,11 +1995,9 @@ func (p *Proxy) PatchVoiceMail(c *rest.Context) error {
 			}
 			return err
 		}
-		if rec, ok := conn.Recs.Load(msgID); ok {
-			var vm = rec.(*VoiceMail)
+		p.updateRecording(conn, msgID, func(vm *VoiceMail) {
 			vm.Read = *params.Read
-			conn.Recs.Store(msgID, vm)
-		}
+		})
 	}
 	// изменяем отметку о прочтении, если она задана
 	if params.Note != nil {
@@ -946,21 +2007,50 @@ func (p *Proxy) PatchVoiceMail(c *rest.Context) error {
 			}
 			return err
 		}
-		if rec, ok := conn.Recs.Load(msgID); ok {
-			var vm = rec.(*VoiceMail)
+		p.updateRecording(conn, msgID, func(vm *VoiceMail) {
 			vm.Note = *params.Note
-			conn.Recs.Store(msgID, vm)
-		}
+		})
 	}
 	return c.Write(rest.JSON{"vm": params})
 }
 
+// updateRecording изменяет информацию о записанном звонке в соединении и в
+// хранилище. Информация копируется, чтобы не изменять объект, который может
+// в этот момент отдаваться в другом запросе.
+func (p *Proxy) updateRecording(conn *MXConn, id string, update func(*VoiceMail)) {
+	rec, ok := conn.Recs.Load(id)
+	if !ok {
+		return
+	}
+	var vm = *rec.(*VoiceMail)
+	update(&vm)
+	conn.Recs.Store(id, &vm)
+	if err := p.store.AddRecording(conn.Login, &vm); err != nil {
+		log.Error("store recording error", "error", err)
+	}
+}
+
 // GetVoiceMailFile отдает содержимое файла с голосовым сообщением.
 func (p *Proxy) GetVoiceMailFile(c *rest.Context) error {
 	conn, err := p.getConnection(c)
 	if err != nil {
 		return err
 	}
+	// запрошено преобразование формата файла
+	if format := c.Query("format"); format != "" {
+		return p.transcodeVoiceMail(c, conn, format)
+	}
+	// отдаем файл из кеша, если он там есть
+	if entry, file := p.cache.Open(conn.Login, c.Query("media"),
+		c.Param("id")); file != nil {
+		defer file.Close()
+		c.AddLogField("cache", true)
+		c.SetHeader("Content-Type", entry.Mimetype)
+		c.SetHeader("Content-Disposition",
+			fmt.Sprintf("attachment; filename=%q", entry.Name))
+		c.SetHeader("ETag", strconv.Quote("vm-"+entry.ID))
+		return c.ServeContent(entry.Name, entry.Created, file)
+	}
 	// получаем информацию о файле с голосовой почтой
 	vminfo, err := conn.VoiceMailFile(c.Param("id"), c.Query("media"))
 	if err != nil {
@@ -974,24 +2064,191 @@ func (p *Proxy) GetVoiceMailFile(c *rest.Context) error {
 	c.SetHeader("Content-Type", vminfo.Mimetype)
 	c.SetHeader("Content-Disposition",
 		fmt.Sprintf("attachment; filename=%q", vminfo.Name))
+	// содержимое голосового сообщения не меняется, поэтому в качестве
+	// ETag используется его идентификатор
+	var etag = strconv.Quote("vm-" + vminfo.ID)
+	c.SetHeader("ETag", etag)
+	c.SetHeader("Accept-Ranges", "bytes")
 	// разрешаем отдавать ответ кусочками
 	c.AllowMultiple = true
 	// отслеживаем закрытие соединения пользователем
 	var done = c.Request.Context().Done()
-	for data := range vminfo.Chunks() {
-		select {
-		case <-done: // пользователь закрыл соединение
-			vminfo.Cancel()                  // отменяем загрузку данных
-			return c.Request.Context().Err() // возвращаем ошибку
-		default: // отдаем кусочек данных пользователю
-			// log.Warn("chuck destination", "len", len(data), "chunk", data)
-			if err = c.Write(data); err != nil {
-				return err
+	var rangeHeader = c.Header("Range")
+	// запрос диапазона выполняется, только если файл не изменился
+	if ifRange := c.Header("If-Range"); ifRange != "" && ifRange != etag {
+		rangeHeader = ""
+	}
+	if rangeHeader == "" {
+		if vminfo.Size >= 0 {
+			c.SetHeader("Content-Length", strconv.FormatInt(vminfo.Size, 10))
+		}
+		// файл, полученный целиком, сохраняем в кеше
+		var cache = p.cache.Create(conn.Login, vminfo)
+		if cache == nil {
+			return vminfo.WriteRange(c, done, 0, -1)
+		}
+		vminfo.Tee(cache)
+		if err = vminfo.WriteRange(c, done, 0, -1); err != nil {
+			cache.Abort()
+			return err
+		}
+		if err := cache.Commit(); err != nil {
+			log.Error("media cache error", "error", err)
+		}
+		return nil
+	}
+	// если размер файла не удалось определить по первому куску, то для
+	// отдачи диапазона получаем файл целиком
+	var data []byte
+	if vminfo.Size < 0 {
+		var cache = p.cache.Create(conn.Login, vminfo)
+		if cache != nil {
+			vminfo.Tee(cache)
+		}
+		if data, err = vminfo.ReadAll(done); err != nil {
+			if cache != nil {
+				cache.Abort()
+			}
+			return err
+		}
+		if cache != nil {
+			if err := cache.Commit(); err != nil {
+				log.Error("media cache error", "error", err)
 			}
-			// c.Write([]byte("\n\n-----\n\n"))
 		}
+		vminfo.Size = int64(len(data))
 	}
-	return vminfo.Err() // все данные благополучно отосланы
+	start, end, ok, err := parseRange(rangeHeader, vminfo.Size)
+	if err != nil {
+		if data == nil {
+			vminfo.Cancel() // файл не нужен
+		}
+		c.SetHeader("Content-Range", fmt.Sprintf("bytes */%d", vminfo.Size))
+		return rest.NewError(http.StatusRequestedRangeNotSatisfiable,
+			err.Error())
+	}
+	if ok {
+		c.SetHeader("Content-Range",
+			fmt.Sprintf("bytes %d-%d/%d", start, end, vminfo.Size))
+		c.SetHeader("Content-Length", strconv.FormatInt(end-start+1, 10))
+		c.Status(http.StatusPartialContent)
+	} else {
+		// заголовок не поддерживается: отдаем файл целиком
+		start, end = 0, vminfo.Size-1
+		c.SetHeader("Content-Length", strconv.FormatInt(vminfo.Size, 10))
+	}
+	if data != nil {
+		return c.Write(data[start : end+1])
+	}
+	return vminfo.WriteRange(c, done, start, end)
+}
+
+// transcodeVoiceMail отдает файл голосового сообщения, преобразованный в
+// указанный формат. Преобразование выполняется по мере получения файла с
+// сервера MX, поэтому запросы диапазонов в этом случае не поддерживаются.
+func (p *Proxy) transcodeVoiceMail(c *rest.Context, conn *MXConn,
+	format string) error {
+	if _, ok := transcodeFormats[format]; !ok {
+		return c.Error(http.StatusBadRequest,
+			fmt.Sprintf("unsupported format %q", format))
+	}
+	var rate int // по умолчанию используется частота исходного файла
+	if value := c.Query("rate"); value != "" {
+		var err error
+		rate, err = strconv.Atoi(value)
+		if err != nil || rate < TranscodeMinRate || rate > TranscodeMaxRate {
+			return c.Error(http.StatusBadRequest, "bad sample rate")
+		}
+	}
+	var (
+		id        = c.Param("id")
+		mediaType = c.Query("media")
+		out       = responseWriter{c}
+	)
+	c.AddLogField("format", format)
+	// преобразуем файл из кеша, если он там есть
+	if entry, file := p.cache.Open(conn.Login, mediaType, id); file != nil {
+		defer file.Close()
+		c.AddLogField("cache", true)
+		var header = make([]byte, 4<<10)
+		n, err := io.ReadFull(file, header)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		tr, err := NewTranscoder(header[:n], entry.Size, format, rate, out)
+		if err != nil {
+			return c.Error(http.StatusNotAcceptable, err.Error())
+		}
+		setTranscodeHeaders(c, tr, entry.ID, entry.Name, format)
+		if _, err = tr.Write(header[:n]); err == nil {
+			_, err = io.Copy(tr, file)
+		}
+		if err != nil {
+			return err
+		}
+		return tr.Close()
+	}
+	vminfo, err := conn.VoiceMailFile(id, mediaType)
+	if err != nil {
+		if _, ok := err.(*mx.CSTAError); ok {
+			return rest.ErrNotFound
+		}
+		return err
+	}
+	// заголовок исходного файла содержится в первом куске
+	tr, err := NewTranscoder(vminfo.first, vminfo.Size, format, rate, out)
+	if err != nil {
+		vminfo.Cancel() // файл не нужен
+		return c.Error(http.StatusNotAcceptable, err.Error())
+	}
+	c.AddLogField("mime", vminfo.Mimetype)
+	setTranscodeHeaders(c, tr, vminfo.ID, vminfo.Name, format)
+	// исходный файл сохраняем в кеше
+	var cache = p.cache.Create(conn.Login, vminfo)
+	if cache != nil {
+		vminfo.Tee(cache)
+	}
+	if err = vminfo.Copy(tr, c.Request.Context().Done()); err != nil {
+		if cache != nil {
+			cache.Abort()
+		}
+		return err
+	}
+	if cache != nil {
+		if err := cache.Commit(); err != nil {
+			log.Error("media cache error", "error", err)
+		}
+	}
+	return tr.Close()
+}
+
+// setTranscodeHeaders устанавливает заголовки ответа для преобразованного
+// файла голосового сообщения.
+func setTranscodeHeaders(c *rest.Context, tr *Transcoder, id, name,
+	format string) {
+	c.SetHeader("Content-Type", tr.Mimetype())
+	c.SetHeader("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", transcodeName(name, format)))
+	c.SetHeader("ETag", strconv.Quote(
+		fmt.Sprintf("vm-%s-%s-%d", id, format, tr.Rate())))
+	if size := tr.Size(); size >= 0 {
+		c.SetHeader("Content-Length", strconv.FormatInt(size, 10))
+	}
+	// разрешаем отдавать ответ кусочками
+	c.AllowMultiple = true
+}
+
+// responseWriter позволяет записывать ответ на запрос как в io.Writer.
+type responseWriter struct {
+	c *rest.Context
+}
+
+// Write отдает данные в ответ на запрос.
+func (w responseWriter) Write(data []byte) (int, error) {
+	if err := w.c.Write(data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
 }
 
 // Token добавляет или удаляет токен из хранилища, в зависимости от метода
@@ -1002,7 +2259,7 @@ func (p *Proxy) Token(c *rest.Context) error {
 		return err
 	}
 	var (
-		tokenType = c.Param("type")  // тип токена: apn, fcm
+		tokenType = c.Param("type")  // тип токена: apn, fcm, webhook
 		topicID   = c.Param("topic") // идентификатор приложения
 		token     = c.Param("token") // токен устройства
 	)
@@ -1020,17 +2277,31 @@ func (p *Proxy) Token(c *rest.Context) error {
 		if !p.push.Support(tokenType, topicID) {
 			return c.Error(http.StatusNotFound, "unsupported FCM application ID")
 		}
+	case "webhook": // адрес для отправки уведомлений
+		if !p.push.Support(tokenType, topicID) {
+			return c.Error(http.StatusNotFound, "unsupported webhook topic")
+		}
+		// адрес передается в пути запроса в кодировке base64
+		if token, err = ParseWebhookURL(token); err != nil {
+			return c.Error(http.StatusBadRequest, err.Error())
+		}
 	default:
 		return c.Error(http.StatusNotFound,
 			fmt.Sprintf("unsupported push type %q", tokenType))
 	}
-	if len(token) < 20 {
+	if tokenType != "webhook" && len(token) < 20 {
 		return c.Error(http.StatusBadRequest, "bad push token")
 	}
 	switch c.Request.Method {
 	case "POST", "PUT":
+		if tokenType == "webhook" {
+			return p.store.AddWebhook(topicID, conn.Login, token)
+		}
 		return p.store.AddToken(tokenType, topicID, token, conn.Login)
 	case "DELETE":
+		if tokenType == "webhook" {
+			return p.store.RemoveWebhook(topicID, conn.Login, token)
+		}
 		return p.store.RemoveToken(tokenType, topicID, token)
 	default:
 		return rest.ErrMethodNotAllowed
@@ -1171,6 +2442,80 @@ func (p *Proxy) ConferenceCreateFromCall(c *rest.Context) error {
 	return conn.ConferenceCreateFromCall(callID, params.OwnerCallID)
 }
 
+// ConferenceParticipants отдает список участников конференции.
+func (p *Proxy) ConferenceParticipants(c *rest.Context) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	list, locked, err := conn.ConferenceParticipants(c.Param("id"))
+	if err != nil {
+		if _, ok := err.(*mx.CSTAError); ok {
+			return rest.ErrNotFound
+		}
+		return err
+	}
+	return c.Write(rest.JSON{"conference": rest.JSON{
+		"id":           c.Param("id"),
+		"locked":       locked,
+		"participants": list,
+	}})
+}
+
+// conferenceModerate проверяет, что пользователь является владельцем
+// конференции, и выполняет команду управления ей.
+func (p *Proxy) conferenceModerate(c *rest.Context,
+	moderate func(conn *MXConn, id string) error) error {
+	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
+	if err != nil {
+		return err
+	}
+	var id = c.Param("id")
+	owned, err := conn.ConferenceOwned(id)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return c.Error(http.StatusForbidden, "not a conference owner")
+	}
+	if err = moderate(conn, id); err != nil {
+		if _, ok := err.(*mx.CSTAError); ok {
+			return rest.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// ConferenceMute выключает микрофон участника конференции.
+func (p *Proxy) ConferenceMute(c *rest.Context) error {
+	return p.conferenceModerate(c, func(conn *MXConn, id string) error {
+		return conn.ConferenceMute(id, c.Param("party"), true)
+	})
+}
+
+// ConferenceUnmute включает микрофон участника конференции.
+func (p *Proxy) ConferenceUnmute(c *rest.Context) error {
+	return p.conferenceModerate(c, func(conn *MXConn, id string) error {
+		return conn.ConferenceMute(id, c.Param("party"), false)
+	})
+}
+
+// ConferenceKick отключает участника от конференции.
+func (p *Proxy) ConferenceKick(c *rest.Context) error {
+	return p.conferenceModerate(c, func(conn *MXConn, id string) error {
+		return conn.ConferenceKick(id, c.Param("party"))
+	})
+}
+
+// ConferenceLock закрывает или открывает вход в конференцию.
+func (p *Proxy) ConferenceLock(c *rest.Context) error {
+	var lock = c.Request.Method != "DELETE"
+	return p.conferenceModerate(c, func(conn *MXConn, id string) error {
+		return conn.ConferenceLock(id, lock)
+	})
+}
+
 // CallRecording инициализирует запись звонка.
 func (p *Proxy) CallRecording(c *rest.Context) error {
 	conn, err := p.getConnection(c) // проверяем токен и получаем соединение
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 
 	app "github.com/mdigger/app-info"
@@ -32,11 +33,15 @@ var (
 // }
 
 // Push описывает конфигурация для отправки уведомлений через сервисы
-// Apple Push Notification и Firebase Cloud Messaging.
+// Apple Push Notification, Firebase Cloud Messaging и webhook.
 type Push struct {
-	apns  map[string]*http.Client // сертификаты для Apple Push
-	fcm   map[string]string       // ключи для Firebase Cloud Messages
-	store *Store                  // хранилище токенов
+	apns         map[string]*http.Client    // сертификаты для Apple Push
+	apnKeys      map[string]*apnProviderKey // ключи провайдера для Apple Push
+	apnKeyClient *http.Client               // клиент для авторизации по ключу
+	fcm          map[string]*fcmAccount     // аккаунты для Firebase Cloud Messages
+	webhooks     map[string]*webhook        // настройки webhook уведомлений
+	store        *Store                     // хранилище токенов
+	queue        *pushQueue                 // очередь повторной отправки
 }
 
 // Send отсылает уведомление на все устройства пользователя.
@@ -52,6 +57,11 @@ func (p *Push) Send(login string, obj interface{}) {
 			log.Error("send Firebase Cloud Messages error", "error", err)
 		}
 	}()
+	go func() {
+		if err := p.sendWebhook(login, obj); err != nil {
+			log.Error("send webhook error", "error", err)
+		}
+	}()
 }
 
 // sendAPN отсылает уведомление на все Apple устройства пользователя.
@@ -73,160 +83,306 @@ func (p *Push) sendAPN(login string, obj interface{}) error {
 			return err
 		}
 	}
-	for topic, client := range p.apns {
-		// получаем список токенов пользователя для данного сертификата
-		var tokens = p.store.ListTokens("apn", topic, login)
-		if len(tokens) == 0 {
+	// темы с авторизацией по сертификату
+	for topic := range p.apns {
+		p.sendAPNTopic(login, topic, payload)
+	}
+	// темы с авторизацией по токену провайдера
+	for topic := range p.apnKeys {
+		if _, ok := p.apns[topic]; !ok {
+			p.sendAPNTopic(login, topic, payload)
+		}
+	}
+	return nil
+}
+
+// sendAPNTopic отсылает уведомление на все Apple устройства пользователя,
+// зарегистрированные для указанной темы. Уведомления, которые не удалось
+// отправить из-за временной ошибки, помещаются в очередь повторной отправки.
+func (p *Push) sendAPNTopic(login, topic string, payload []byte) {
+	// получаем список токенов пользователя для данного сертификата
+	var tokens = p.store.ListTokens("apn", topic, login)
+	if len(tokens) == 0 {
+		return
+	}
+	// для каждого токена устройства формируем отдельный запрос
+	var success, failure int // счетчики
+	for _, token := range tokens {
+		err := p.postAPN(topic, token, payload)
+		if err == nil {
+			success++
+			metricPushSent.Inc("apn", topic, "success")
 			continue
 		}
-		// задаем хост в зависимости от sandbox
-		var host string
-		if topic[len(topic)-1] != '~' {
-			host = "https://api.push.apple.com"
+		failure++
+		if retry, ok := err.(*pushRetryError); ok {
+			metricPushSent.Inc("apn", topic, "retry")
+			p.enqueue("apn", topic, token, login, payload, retry)
 		} else {
-			host = "https://api.development.push.apple.com"
+			metricPushSent.Inc("apn", topic, "failure")
+		}
+	}
+	log.Info("apple push",
+		"topic", topic,
+		"success", success,
+		"failure", failure)
+}
+
+// postAPN отсылает уведомление на одно Apple устройство. В случае временной
+// ошибки возвращается ошибка типа *pushRetryError.
+func (p *Push) postAPN(topic, token string, payload []byte) error {
+	// сертификат для темы имеет приоритет над ключом провайдера
+	var client, key = p.apns[topic], p.apnKeys[topic]
+	if client != nil {
+		key = nil
+	} else if key != nil {
+		client = p.apnKeyClient
+	} else {
+		return errors.New("unsupported apn topic")
+	}
+	// задаем хост в зависимости от sandbox
+	var host string
+	if topic[len(topic)-1] != '~' {
+		host = "https://api.push.apple.com"
+	} else {
+		host = "https://api.development.push.apple.com"
+	}
+	req, err := http.NewRequest("POST", host+"/3/device/"+token,
+		bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("user-agent", app.Agent)
+	req.Header.Set("Content-Type", "application/json")
+	if key != nil {
+		// при авторизации по токену тема указывается в запросе
+		var bundleID = strings.TrimSuffix(topic, "~")
+		providerToken, err := key.Token()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("authorization", "bearer "+providerToken)
+		req.Header.Set("apns-topic", bundleID)
+		if strings.HasSuffix(bundleID, ".voip") {
+			req.Header.Set("apns-push-type", "voip")
 		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Error("apple push send error", err)
+		return &pushRetryError{reason: err.Error()}
+	}
+	if resp.StatusCode == http.StatusOK {
+		resp.Body.Close()
+		return nil
+	}
+	// разбираем ответ сервера с описанием ошибки
+	var apnsError = new(struct {
+		Reason string `json:"reason"`
+	})
+	err = json.NewDecoder(resp.Body).Decode(apnsError)
+	resp.Body.Close()
+	if err != nil {
+		apnsError.Reason = http.StatusText(resp.StatusCode)
+	}
+	log.Debug("apple push error",
+		"topic", topic,
+		"token", token,
+		"reason", apnsError.Reason)
+	// в случае ошибки связанной с токеном устройства, удаляем его
+	switch apnsError.Reason {
+	case "MissingDeviceToken",
+		"BadDeviceToken",
+		"DeviceTokenNotForTopic",
+		"Unregistered":
+		p.store.RemoveToken("apn", topic, token)
+		metricTokensRemoved.Inc("apn", apnsError.Reason)
+	case "ExpiredProviderToken",
+		"InvalidProviderToken":
+		// токен провайдера будет создан заново при следующей отправке
+		if key != nil {
+			key.Reset()
+			return &pushRetryError{reason: apnsError.Reason}
+		}
+	default:
+		if isRetryStatus(resp.StatusCode) {
+			return &pushRetryError{
+				reason:     apnsError.Reason,
+				retryAfter: retryAfter(resp.Header),
+			}
+		}
+	}
+	return errors.New(apnsError.Reason)
+}
+
+var fcmClient = &http.Client{Timeout: PushTimeout}
+
+// sendFCM отсылает уведомление на все Google устройства пользователя.
+func (p *Push) sendFCM(login string, obj interface{}) error {
+	var payload []byte // данные уведомления
+	for appName := range p.fcm {
+		// получаем список токенов пользователя для данного приложения
+		var tokens = p.store.ListTokens("fcm", appName, login)
+		if len(tokens) == 0 {
+			continue
+		}
+		// преобразуем данные для пуша в формат JSON
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(obj); err != nil {
+				return err
+			}
+		}
+		// HTTP v1 API поддерживает только один токен в сообщении, поэтому
 		// для каждого токена устройства формируем отдельный запрос
 		var success, failure int // счетчики
 		for _, token := range tokens {
-			req, err := http.NewRequest("POST", host+"/3/device/"+token,
-				bytes.NewReader(payload))
-			if err != nil {
-				return err
-			}
-			req.Header.Set("user-agent", app.Agent)
-			req.Header.Set("Content-Type", "application/json")
-			resp, err := client.Do(req)
-			if err != nil {
-				log.Error("apple push send error", err)
-				failure++
-				continue
-			}
-			if resp.StatusCode == http.StatusOK {
-				resp.Body.Close()
+			err := p.postFCM(appName, token, payload)
+			if err == nil {
 				success++
+				metricPushSent.Inc("fcm", appName, "success")
 				continue
 			}
 			failure++
-			// разбираем ответ сервера с описанием ошибки
-			var apnsError = new(struct {
-				Reason string `json:"reason"`
-			})
-			err = json.NewDecoder(resp.Body).Decode(apnsError)
-			resp.Body.Close()
-			if err != nil {
-				continue
-			}
-			// в случае ошибки связанной с токеном устройства, удаляем его
-			switch apnsError.Reason {
-			case "MissingDeviceToken",
-				"BadDeviceToken",
-				"DeviceTokenNotForTopic",
-				"Unregistered":
-				p.store.RemoveToken("apn", topic, token)
-			default:
+			if retry, ok := err.(*pushRetryError); ok {
+				metricPushSent.Inc("fcm", appName, "retry")
+				p.enqueue("fcm", appName, token, login, payload, retry)
+			} else {
+				metricPushSent.Inc("fcm", appName, "failure")
 			}
-			log.Debug("apple push error",
-				"topic", topic,
-				"token", token,
-				"reason", apnsError.Reason)
 		}
-		log.Info("apple push",
-			"topic", topic,
+		log.Info("google push",
+			"app", appName,
 			"success", success,
 			"failure", failure)
 	}
 	return nil
 }
 
-var fcmClient = &http.Client{Timeout: PushTimeout}
-
-// sendFCM отсылает уведомление на все Google устройства пользователя.
-func (p *Push) sendFCM(login string, obj interface{}) error {
-	for appName, fcmKey := range p.fcm {
-		// получаем список токенов пользователя для данного сертификата
-		var tokens = p.store.ListTokens("fcm", appName, login)
-		if len(tokens) == 0 {
-			continue
-		}
-		// формируем данные для отправки (без визуальной составляющей пуша:
-		// только данные)
-		var gfcmMsg = &struct {
-			RegistrationIDs []string    `json:"registration_ids,omitempty"`
-			Data            interface{} `json:"data,omitempty"`
-			TTL             uint16      `json:"time_to_live"`
-		}{
-			// т.к. тут только устройства ОДНОГО пользователя, то
-			// ограничением на количество токенов можно пренебречь
-			RegistrationIDs: tokens,
-			Data:            obj, // добавляем уже сформированные ранее данные
+// postFCM отсылает уведомление на одно Google устройство. В случае временной
+// ошибки возвращается ошибка типа *pushRetryError.
+func (p *Push) postFCM(appName, token string, payload []byte) error {
+	var account = p.fcm[appName]
+	if account == nil {
+		return errors.New("unsupported fcm application")
+	}
+	// формируем данные для отправки (без визуальной составляющей пуша:
+	// только данные)
+	data, err := fcmData(json.RawMessage(payload))
+	if err != nil {
+		return err
+	}
+	accessToken, err := account.Token()
+	if err != nil {
+		return &pushRetryError{reason: err.Error()}
+	}
+	var fcmMsg = &struct {
+		Message fcmMessage `json:"message"`
+	}{
+		Message: fcmMessage{
+			Token: token,
+			Data:  data,
 			// время жизни сообщения TTL = 0, поэтому оно не кешируется
 			// на сервере, а сразу отправляется пользователю: для пушей
 			// оо звонках мне показалось это наиболее актуальным.
-		}
-		// приводим к формату JSON
-		data, err := json.Marshal(gfcmMsg)
-		if err != nil {
-			return err
-		}
-		req, err := http.NewRequest("POST",
-			"https://fcm.googleapis.com/fcm/send", bytes.NewReader(data))
-		if err != nil {
-			return err
-		}
-		req.Header.Set("User-Agent", app.Agent)
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "key="+fcmKey)
-		resp, err := fcmClient.Do(req)
-		if err != nil {
-			return err
-		}
-		// проверяем статус ответа
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			return err
-		}
-		// разбираем ответ сервера
-		var result = new(struct {
-			Success int `json:"success"`
-			Failure int `json:"failure"`
-			Results []struct {
-				RegistrationID string `json:"registration_id"`
-				Error          string `json:"error"`
-			} `json:"results"`
-		})
-		err = json.NewDecoder(resp.Body).Decode(result)
+			Android: &fcmAndroidConfig{
+				Priority: "high",
+				TTL:      "0s",
+			},
+		},
+	}
+	body, err := json.Marshal(fcmMsg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST",
+		FCMURL+"/v1/projects/"+account.projectID+"/messages:send",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", app.Agent)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := fcmClient.Do(req)
+	if err != nil {
+		log.Error("google push send error", err)
+		return &pushRetryError{reason: err.Error()}
+	}
+	if resp.StatusCode == http.StatusOK {
 		resp.Body.Close()
-		if err != nil {
-			return err
+		return nil
+	}
+	// разбираем ответ сервера с описанием ошибки
+	var fcmError = new(struct {
+		Error struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+			Details []struct {
+				Type            string `json:"@type"`
+				ErrorCode       string `json:"errorCode"`
+				FieldViolations []struct {
+					Field string `json:"field"`
+				} `json:"fieldViolations"`
+			} `json:"details"`
+		} `json:"error"`
+	})
+	err = json.NewDecoder(resp.Body).Decode(fcmError)
+	resp.Body.Close()
+	var errorCode = fcmError.Error.Status
+	var badToken bool // ошибка связана с токеном устройства
+	for _, detail := range fcmError.Error.Details {
+		if detail.ErrorCode != "" {
+			errorCode = detail.ErrorCode
+			badToken = badToken || errorCode == "UNREGISTERED" ||
+				errorCode == "SENDER_ID_MISMATCH"
 		}
-		// проходим по массиву результатов в ответе для каждого токена
-		for indx, result := range result.Results {
-			switch result.Error {
-			case "":
-				// нет ошибки - доставлено
-				// проверяем, что, возможно, токен устарел и его нужно
-				// заменить на более новый, который указан в ответе
-				if result.RegistrationID != "" {
-					token := gfcmMsg.RegistrationIDs[indx]
-					p.store.RemoveToken("fcm", appName, token)
-					p.store.AddToken("fcm", appName, result.RegistrationID, login)
-				}
-			case "Unavailable":
-				// устройство в данный момент не доступно
-			default:
-				// все остальное представляет из себя, так или иначе,
-				// ошибки, связанные с неверным токеном устройства
-				token := gfcmMsg.RegistrationIDs[indx]
-				p.store.RemoveToken("fcm", appName, token)
+		// INVALID_ARGUMENT возвращается и для неверных данных сообщения,
+		// поэтому токен считается неверным, только если на него указывает
+		// описание ошибки запроса
+		for _, violation := range detail.FieldViolations {
+			if violation.Field == "message.token" {
+				badToken = true
 			}
 		}
-		log.Info("google push",
-			"app", appName,
-			"success", result.Success,
-			"failure", result.Failure)
 	}
-	return nil
+	if err != nil || errorCode == "" {
+		errorCode = http.StatusText(resp.StatusCode)
+	}
+	log.Debug("google push error",
+		"app", appName,
+		"token", token,
+		"reason", errorCode,
+		"message", fcmError.Error.Message)
+	// в случае ошибки связанной с токеном устройства, удаляем его
+	switch {
+	case badToken:
+		p.store.RemoveToken("fcm", appName, token)
+		metricTokensRemoved.Inc("fcm", errorCode)
+	case resp.StatusCode == http.StatusUnauthorized:
+		// токен доступа будет запрошен заново при следующей отправке
+		account.Reset()
+		return &pushRetryError{reason: errorCode}
+	case isRetryStatus(resp.StatusCode):
+		return &pushRetryError{
+			reason:     errorCode,
+			retryAfter: retryAfter(resp.Header),
+		}
+	}
+	return errors.New(errorCode)
+}
+
+// fcmMessage описывает сообщение Firebase Cloud Messaging HTTP v1.
+type fcmMessage struct {
+	Token   string            `json:"token"`
+	Data    map[string]string `json:"data,omitempty"`
+	Android *fcmAndroidConfig `json:"android,omitempty"`
+}
+
+// fcmAndroidConfig описывает параметры доставки сообщения на Android.
+type fcmAndroidConfig struct {
+	Priority string `json:"priority,omitempty"`
+	TTL      string `json:"ttl,omitempty"`
 }
 
 // Support возвращает true, если данная тема поддерживается в качестве
@@ -234,11 +390,17 @@ func (p *Push) sendFCM(login string, obj interface{}) error {
 func (p *Push) Support(kind, topic string) bool {
 	switch kind {
 	case "apn":
-		_, ok := p.apns[topic]
+		if _, ok := p.apns[topic]; ok {
+			return true
+		}
+		_, ok := p.apnKeys[topic]
 		return ok
 	case "fcm":
 		_, ok := p.fcm[topic]
 		return ok
+	case "webhook":
+		_, ok := p.webhooks[topic]
+		return ok
 	default:
 		return false
 	}
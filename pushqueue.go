@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mdigger/log"
+)
+
+// Параметры очереди повторной отправки уведомлений.
+var (
+	PushQueueWorkers  = 4               // количество обработчиков очереди
+	PushQueueInterval = time.Second     // интервал проверки очереди
+	PushRetryMinDelay = time.Second * 5 // задержка перед первым повтором
+	PushRetryMaxDelay = time.Minute * 5 // максимальная задержка между повторами
+	PushDefaultMaxAge = time.Hour       // время жизни уведомления по умолчанию
+	PushMaxAge        = map[string]time.Duration{
+		// уведомления о звонках теряют смысл очень быстро
+		"Delivered":         time.Second * 30,
+		"Established":       time.Second * 30,
+		"Originated":        time.Second * 30,
+		"ConnectionCleared": time.Second * 30,
+		"HeldEvent":         time.Second * 30,
+		"RetrievedEvent":    time.Second * 30,
+		"RecordingState":    time.Second * 30,
+		"Transfered":        time.Second * 30,
+		// а о голосовых сообщениях - нет
+		"MailIncoming": time.Hour * 24,
+	}
+)
+
+// pushRetryError описывает временную ошибку отправки уведомления, после
+// которой отправку следует повторить.
+type pushRetryError struct {
+	reason     string        // описание ошибки
+	retryAfter time.Duration // задержка, запрошенная сервером
+}
+
+func (e *pushRetryError) Error() string {
+	return e.reason
+}
+
+// isRetryStatus возвращает true, если статус ответа сервиса уведомлений
+// говорит о временной ошибке.
+func isRetryStatus(status int) bool {
+	return status == http.StatusTooManyRequests ||
+		status == http.StatusRequestTimeout ||
+		status >= http.StatusInternalServerError
+}
+
+// retryAfter возвращает задержку, указанную в заголовке Retry-After ответа.
+func retryAfter(header http.Header) time.Duration {
+	var value = header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// pushItem описывает уведомление в очереди повторной отправки.
+type pushItem struct {
+	ID       uint64          `json:"-"`               // номер в очереди
+	key      []byte          `json:"-"`               // ключ в хранилище
+	Kind     string          `json:"kind"`            // apn, fcm, webhook
+	Topic    string          `json:"topic"`           // тема или приложение
+	Token    string          `json:"token"`           // токен или адрес webhook
+	Login    string          `json:"login"`           // логин пользователя
+	Type     string          `json:"type,omitempty"`  // тип события
+	Payload  json.RawMessage `json:"payload"`         // данные уведомления
+	Created  time.Time       `json:"created"`         // время события
+	Next     time.Time       `json:"next"`            // время следующей отправки
+	Attempts int             `json:"attempts"`        // количество попыток
+	Error    string          `json:"error,omitempty"` // последняя ошибка
+}
+
+// maxAge возвращает максимальное время жизни уведомления в очереди.
+func (i *pushItem) maxAge() time.Duration {
+	if age, ok := PushMaxAge[i.Type]; ok {
+		return age
+	}
+	return PushDefaultMaxAge
+}
+
+// delay возвращает задержку перед следующей попыткой отправки.
+func (i *pushItem) delay(retryAfter time.Duration) time.Duration {
+	var delay = PushRetryMinDelay
+	for n := 1; n < i.Attempts && delay < PushRetryMaxDelay; n++ {
+		delay *= 2
+	}
+	if delay > PushRetryMaxDelay {
+		delay = PushRetryMaxDelay
+	}
+	// сервер может запросить задержку больше вычисленной
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	return delay
+}
+
+// pushQueue описывает обработку очереди повторной отправки уведомлений.
+type pushQueue struct {
+	work     chan *pushItem  // уведомления для отправки
+	inFlight map[uint64]bool // уведомления в обработке
+	mu       sync.Mutex
+	stop     chan struct{} // сигнал остановки
+	wg       sync.WaitGroup
+}
+
+// enqueue добавляет уведомление, которое не удалось отправить из-за временной
+// ошибки, в очередь повторной отправки.
+func (p *Push) enqueue(kind, topic, token, login string, payload []byte,
+	retry *pushRetryError) {
+	var event = new(struct {
+		Type string `json:"type"`
+	})
+	json.Unmarshal(payload, event)
+	var now = time.Now()
+	var item = &pushItem{
+		Kind:     kind,
+		Topic:    topic,
+		Token:    token,
+		Login:    login,
+		Type:     event.Type,
+		Payload:  json.RawMessage(payload),
+		Created:  now,
+		Attempts: 1,
+		Error:    retry.reason,
+	}
+	item.Next = now.Add(item.delay(retry.retryAfter))
+	// нет смысла сохранять уведомление, если оно устареет до отправки
+	if item.Next.Sub(item.Created) > item.maxAge() {
+		log.Debug("push retry skipped", "kind", kind, "topic", topic,
+			"type", item.Type)
+		return
+	}
+	if err := p.store.QueueAdd(item); err != nil {
+		log.Error("push queue error", "error", err)
+		return
+	}
+	log.Debug("push queued", "kind", kind, "topic", topic, "type", item.Type,
+		"next", item.Next.Format(time.RFC3339))
+}
+
+// StartQueue запускает обработку очереди повторной отправки уведомлений с
+// указанным количеством обработчиков.
+func (p *Push) StartQueue(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	p.queue = &pushQueue{
+		work:     make(chan *pushItem),
+		inFlight: make(map[uint64]bool),
+		stop:     make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		p.queue.wg.Add(1)
+		go func() {
+			defer p.queue.wg.Done()
+			for item := range p.queue.work {
+				p.retry(item)
+				p.queue.mu.Lock()
+				delete(p.queue.inFlight, item.ID)
+				p.queue.mu.Unlock()
+			}
+		}()
+	}
+	// периодически выбираем из хранилища уведомления, время отправки которых
+	// уже подошло, и передаем их обработчикам
+	go func() {
+		defer close(p.queue.work)
+		var ticker = time.NewTicker(PushQueueInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.queue.stop:
+				return
+			case <-ticker.C:
+			}
+			for _, item := range p.store.QueueDue(time.Now()) {
+				p.queue.mu.Lock()
+				var busy = p.queue.inFlight[item.ID]
+				if !busy {
+					p.queue.inFlight[item.ID] = true
+				}
+				p.queue.mu.Unlock()
+				if busy {
+					continue
+				}
+				select {
+				case p.queue.work <- item:
+				case <-p.queue.stop:
+					return
+				}
+			}
+		}
+	}()
+	log.Info("push queue started", "workers", workers,
+		"queued", p.store.keys(bucketQueue))
+}
+
+// StopQueue останавливает обработку очереди и дожидается окончания отправки
+// уведомлений, которые уже обрабатываются. Не отправленные уведомления
+// остаются в хранилище и будут отправлены после перезапуска.
+func (p *Push) StopQueue() {
+	if p.queue == nil {
+		return
+	}
+	close(p.queue.stop)
+	p.queue.wg.Wait()
+	log.Info("push queue stopped")
+}
+
+// retry повторяет отправку уведомления из очереди.
+func (p *Push) retry(item *pushItem) {
+	// пока уведомление ожидало обработчика, оно могло быть уже отправлено или
+	// перенесено на более позднее время: используем его текущее состояние
+	if item = p.store.QueueGet(item.key); item == nil ||
+		item.Next.After(time.Now()) {
+		return
+	}
+	ctxlog := log.With("kind", item.Kind)
+	// удаляем устаревшие уведомления
+	if time.Since(item.Created) > item.maxAge() {
+		p.store.QueueRemove(item)
+		metricPushSent.Inc(item.Kind, item.Topic, "expired")
+		ctxlog.Info("push expired", "topic", item.Topic, "type", item.Type,
+			"attempts", item.Attempts)
+		return
+	}
+	var err error
+	switch item.Kind {
+	case "apn":
+		err = p.postAPN(item.Topic, item.Token, item.Payload)
+	case "fcm":
+		err = p.postFCM(item.Topic, item.Token, item.Payload)
+	case "webhook":
+		err = p.postWebhookURL(item.Topic, item.Login, item.Token, item.Payload)
+	default:
+		p.store.QueueRemove(item)
+		return
+	}
+	if err == nil {
+		p.store.QueueRemove(item)
+		metricPushSent.Inc(item.Kind, item.Topic, "success")
+		ctxlog.Info("push retry", "topic", item.Topic, "type", item.Type,
+			"attempts", item.Attempts+1)
+		return
+	}
+	retry, ok := err.(*pushRetryError)
+	if !ok {
+		// постоянная ошибка: повторная отправка не поможет
+		p.store.QueueRemove(item)
+		metricPushSent.Inc(item.Kind, item.Topic, "failure")
+		ctxlog.Error("push retry error", "topic", item.Topic, "error", err)
+		return
+	}
+	metricPushSent.Inc(item.Kind, item.Topic, "retry")
+	item.Attempts++
+	item.Error = retry.reason
+	item.Next = time.Now().Add(item.delay(retry.retryAfter))
+	if item.Next.Sub(item.Created) > item.maxAge() {
+		p.store.QueueRemove(item)
+		metricPushSent.Inc(item.Kind, item.Topic, "expired")
+		ctxlog.Info("push expired", "topic", item.Topic, "type", item.Type,
+			"attempts", item.Attempts)
+		return
+	}
+	// уведомление, удаленное из очереди за время отправки, не сохраняется
+	if err = p.store.QueueUpdate(item); err != nil && err != ErrNotFound {
+		ctxlog.Error("push queue error", "error", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := OpenStore(filepath.Join(t.TempDir(), "mxproxy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestQueueStaleItem(t *testing.T) {
+	var store = testStore(t)
+	var item = &pushItem{Kind: "webhook", Topic: "test", Type: "Delivered",
+		Created: time.Now(), Next: time.Now().Add(-time.Second), Attempts: 1}
+	if err := store.QueueAdd(item); err != nil {
+		t.Fatal(err)
+	}
+	var due = store.QueueDue(time.Now())
+	if len(due) != 1 || due[0].ID != item.ID {
+		t.Fatalf("due = %+v", due)
+	}
+	// уведомление переносится обработчиком, пока копия ожидает в списке
+	var stale = *due[0]
+	due[0].Next = time.Now().Add(time.Minute)
+	if err := store.QueueUpdate(due[0]); err != nil {
+		t.Fatal(err)
+	}
+	if current := store.QueueGet(stale.key); current != nil {
+		t.Errorf("stale item = %+v", current)
+	}
+	if current := store.QueueGet(due[0].key); current == nil ||
+		current.ID != item.ID || current.Next.Before(time.Now()) {
+		t.Errorf("current item = %+v", current)
+	}
+	// сохранение устаревшей копии не создает дубликат
+	stale.Next = time.Now().Add(time.Minute * 2)
+	if err := store.QueueUpdate(&stale); err != ErrNotFound {
+		t.Errorf("stale update error = %v", err)
+	}
+	if stats := store.QueueStats(); stats["webhook"] != 1 {
+		t.Errorf("queue stats = %v", stats)
+	}
+	// устаревшая копия не отправляется повторно
+	var push = &Push{store: store}
+	push.retry(&stale)
+	if stats := store.QueueStats(); stats["webhook"] != 1 {
+		t.Errorf("queue stats after retry = %v", stats)
+	}
+}
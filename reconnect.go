@@ -0,0 +1,204 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Параметры переподключения к серверу MX.
+var (
+	ReconnectMinDelay  = time.Second * 5 // задержка после первой неудачной попытки
+	ReconnectMaxDelay  = time.Minute * 5 // максимальная задержка между попытками
+	ReconnectJitter    = 0.5             // доля случайного разброса задержки
+	ReconnectThreshold = 5               // количество ошибок до размыкания
+)
+
+// Состояния переподключения пользователя к серверу MX.
+const (
+	breakerClosed   = "closed"    // соединение установлено
+	breakerHalfOpen = "half-open" // соединение потеряно, идет переподключение
+	breakerOpen     = "open"      // сервер недоступен, попытки редки
+)
+
+// reconnectDelay возвращает задержку перед следующей попыткой подключения
+// после указанного количества неудачных попыток подряд. Первая попытка
+// выполняется сразу, а следующие - с экспоненциально увеличивающейся задержкой
+// и случайным разбросом, чтобы при массовой недоступности сервера MX
+// пользователи не переподключались одновременно.
+func reconnectDelay(failures int) time.Duration {
+	if failures < 1 {
+		return 0
+	}
+	var delay = ReconnectMinDelay
+	for n := 1; n < failures && delay < ReconnectMaxDelay; n++ {
+		delay *= 2
+	}
+	if delay > ReconnectMaxDelay {
+		delay = ReconnectMaxDelay
+	}
+	if ReconnectJitter > 0 && delay > 0 {
+		var jitter = float64(delay) * ReconnectJitter
+		if jitter > float64(delay) {
+			jitter = float64(delay)
+		}
+		delay -= time.Duration(rand.Int63n(int64(jitter) + 1))
+	}
+	return delay
+}
+
+// breaker описывает состояние переподключения пользователя к серверу MX.
+type breaker struct {
+	state     string        // состояние подключения
+	failures  int           // количество неудачных попыток подряд
+	lastError string        // последняя ошибка
+	changed   time.Time     // время изменения состояния
+	next      time.Time     // время следующей попытки
+	wake      chan struct{} // сигнал немедленного переподключения
+	mu        sync.Mutex
+}
+
+// newBreaker возвращает новое состояние переподключения для установленного
+// соединения.
+func newBreaker() *breaker {
+	return &breaker{
+		state:   breakerClosed,
+		changed: time.Now(),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Connected отмечает успешное подключение к серверу MX.
+func (b *breaker) Connected() {
+	b.mu.Lock()
+	b.state = breakerClosed
+	b.failures = 0
+	b.lastError = ""
+	b.changed = time.Now()
+	b.next = time.Time{}
+	b.mu.Unlock()
+}
+
+// Failed отмечает ошибку соединения или подключения к серверу MX и возвращает
+// задержку перед следующей попыткой. После превышения порогового количества
+// ошибок подряд состояние переходит в "open".
+func (b *breaker) Failed(err error) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerClosed {
+		// соединение было установлено: первая попытка без задержки
+		b.failures = 0
+	} else {
+		b.failures++
+	}
+	var state = breakerHalfOpen
+	if b.failures >= ReconnectThreshold {
+		state = breakerOpen
+	}
+	if state != b.state {
+		b.state = state
+		b.changed = time.Now()
+	}
+	if err != nil {
+		b.lastError = err.Error()
+	}
+	var delay = reconnectDelay(b.failures)
+	b.next = time.Now().Add(delay)
+	return delay
+}
+
+// Wait ожидает окончания задержки или сигнала о немедленном переподключении.
+func (b *breaker) Wait(delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+	var timer = time.NewTimer(delay)
+	select {
+	case <-timer.C:
+	case <-b.wake:
+		timer.Stop()
+	}
+}
+
+// Wake прерывает ожидание следующей попытки подключения.
+func (b *breaker) Wake() {
+	select {
+	case b.wake <- struct{}{}:
+	default: // сигнал уже отправлен
+	}
+}
+
+// BreakerState описывает состояние переподключения пользователя для
+// административного веба.
+type BreakerState struct {
+	State     string     `json:"state"`
+	Failures  int        `json:"failures,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+	Changed   time.Time  `json:"changed"`
+	Next      *time.Time `json:"next,omitempty"`
+}
+
+// State возвращает текущее состояние переподключения.
+func (b *breaker) State() *BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var state = &BreakerState{
+		State:     b.state,
+		Failures:  b.failures,
+		LastError: b.lastError,
+		Changed:   b.changed,
+	}
+	if b.state != breakerClosed {
+		var next = b.next
+		state.Next = &next
+	}
+	return state
+}
+
+// getBreaker возвращает состояние переподключения пользователя.
+func (p *Proxy) getBreaker(login string) *breaker {
+	b, _ := p.breakers.LoadOrStore(login, newBreaker())
+	return b.(*breaker)
+}
+
+// removeBreaker удаляет состояние переподключения пользователя и прерывает
+// ожидание следующей попытки подключения.
+func (p *Proxy) removeBreaker(login string) {
+	if b, ok := p.breakers.Load(login); ok {
+		p.breakers.Delete(login)
+		b.(*breaker).Wake()
+	}
+}
+
+// Breakers возвращает состояния переподключения всех пользователей.
+func (p *Proxy) Breakers() map[string]*BreakerState {
+	var result = make(map[string]*BreakerState)
+	p.breakers.Range(func(login, b interface{}) bool {
+		result[login.(string)] = b.(*breaker).State()
+		return true
+	})
+	return result
+}
+
+// Reconnect принудительно переподключает пользователя к серверу MX: активное
+// соединение разрывается, а ожидание следующей попытки прерывается. Если
+// логин не указан, то переподключаются все пользователи. Возвращает список
+// переподключаемых пользователей.
+func (p *Proxy) Reconnect(login string) []string {
+	var list = make([]string, 0)
+	p.breakers.Range(func(key, b interface{}) bool {
+		if login != "" && key.(string) != login {
+			return true
+		}
+		if conn, ok := p.conns.Load(key); ok {
+			// соединение остается в списке, поэтому после закрытия
+			// будет сразу установлено заново
+			conn.(*MXConn).Close()
+		} else {
+			b.(*breaker).Wake()
+		}
+		list = append(list, key.(string))
+		return true
+	})
+	return list
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+
+	"github.com/mdigger/log"
+)
+
+// Время жизни токена обновления и интервал удаления просроченных токенов.
+var (
+	RefreshTokenTTL     = time.Hour * 24 * 30
+	RefreshTokenCleanup = time.Hour
+)
+
+// RefreshToken описывает информацию о выданном токене обновления.
+type RefreshToken struct {
+	Login    string    `json:"login"`    // логин пользователя
+	ClientID string    `json:"clientId"` // идентификатор приложения
+	Created  time.Time `json:"created"`  // время выдачи
+	Expires  time.Time `json:"expires"`  // время окончания действия
+}
+
+// newRefreshToken возвращает новый случайный токен обновления.
+func newRefreshToken() (string, error) {
+	var data = make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// issueToken возвращает авторизационный токен пользователя. Если задан
+// идентификатор приложения, то дополнительно выдается токен обновления,
+// который может быть использован только этим приложением. Если указан
+// использованный токен обновления, то он заменяется новым: это происходит
+// только после успешного создания токена авторизации, чтобы при ошибке
+// приложение могло повторить запрос с тем же токеном.
+func (p *Proxy) issueToken(login, clientID, used string) (*TokenDescription,
+	error) {
+	tokenInfo, err := p.jwtGen.Token(login)
+	if err != nil {
+		return nil, err
+	}
+	if clientID == "" || RefreshTokenTTL <= 0 {
+		if used != "" {
+			p.store.RemoveRefreshToken(used, login)
+		}
+		return tokenInfo, nil
+	}
+	refresh, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	var now = time.Now()
+	var info = &RefreshToken{
+		Login:    login,
+		ClientID: clientID,
+		Created:  now,
+		Expires:  now.Add(RefreshTokenTTL),
+	}
+	if used != "" {
+		err = p.store.RotateRefreshToken(used, refresh, info)
+	} else {
+		err = p.store.AddRefreshToken(refresh, info)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tokenInfo.Refresh = refresh
+	return tokenInfo, nil
+}
+
+// startRefreshCleanup запускает периодическое удаление просроченных токенов
+// обновления из хранилища.
+func (p *Proxy) startRefreshCleanup() {
+	p.refreshCleaner = time.AfterFunc(RefreshTokenCleanup, func() {
+		if count := p.store.RemoveRefreshTokens(""); count > 0 {
+			log.Info("expired refresh tokens removed", "count", count)
+		}
+		p.refreshCleaner.Reset(RefreshTokenCleanup)
+	})
+}
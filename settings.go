@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"sort"
+
+	"github.com/mdigger/rest"
+)
+
+// forwardingTypes задает соответствие названий типов переадресации в API и
+// в командах CSTA.
+var forwardingTypes = map[string]string{
+	"immediate": "forwardImmediate", // безусловная
+	"busy":      "forwardBusy",      // при занятости
+	"noAnswer":  "forwardNoAns",     // при отсутствии ответа
+	"dnd":       "forwardDND",       // в режиме "не беспокоить"
+}
+
+// ForwardingMaxRingCount задает максимальное количество гудков перед
+// переадресацией при отсутствии ответа.
+const ForwardingMaxRingCount = 15
+
+// forwardingType возвращает название типа переадресации в API по названию
+// в CSTA. Неизвестные типы возвращаются без изменений.
+func forwardingType(cstaType string) string {
+	for name, value := range forwardingTypes {
+		if value == cstaType {
+			return name
+		}
+	}
+	return cstaType
+}
+
+// Forwarding описывает правило переадресации звонков.
+type Forwarding struct {
+	Type      string `xml:"forwardingType" json:"type" form:"type"`
+	Active    bool   `xml:"forwardStatus" json:"active" form:"active"`
+	To        string `xml:"forwardDN" json:"to,omitempty" form:"to"`
+	RingCount int    `xml:"ringCount" json:"ringCount,omitempty" form:"ringCount"`
+}
+
+// validate проверяет правило переадресации и заменяет название типа на
+// название, используемое в CSTA.
+func (f *Forwarding) validate() error {
+	cstaType, ok := forwardingTypes[f.Type]
+	if !ok {
+		return rest.NewError(http.StatusBadRequest,
+			"unknown forwarding type: "+f.Type)
+	}
+	if f.Active && f.To == "" {
+		return rest.NewError(http.StatusBadRequest,
+			"forwarding number required")
+	}
+	if f.RingCount < 0 || f.RingCount > ForwardingMaxRingCount {
+		return rest.NewError(http.StatusBadRequest, "bad ring count")
+	}
+	f.Type = cstaType
+	return nil
+}
+
+// GetForwarding возвращает правила переадресации звонков пользователя,
+// упорядоченные по типу.
+func (c *MXConn) GetForwarding() ([]*Forwarding, error) {
+	resp, err := c.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"GetForwarding"`
+		Device  string   `xml:"device"`
+	}{
+		Device: c.Ext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result = new(struct {
+		List []*Forwarding `xml:"forwardingList>forwardListItem"`
+	})
+	if err = resp.Decode(result); err != nil {
+		return nil, err
+	}
+	for _, item := range result.List {
+		item.Type = forwardingType(item.Type)
+	}
+	sort.Slice(result.List, func(i, j int) bool {
+		return result.List[i].Type < result.List[j].Type
+	})
+	return result.List, nil
+}
+
+// SetForwarding включает или отключает правило переадресации звонков.
+func (c *MXConn) SetForwarding(forwarding *Forwarding) error {
+	var rule = *forwarding
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	_, err := c.SendWithResponse(&struct {
+		XMLName   xml.Name `xml:"SetForwarding"`
+		Device    string   `xml:"device"`
+		Type      string   `xml:"forwardingType"`
+		Active    bool     `xml:"activateForward"`
+		To        string   `xml:"forwardDN,omitempty"`
+		RingCount int      `xml:"ringCount,omitempty"`
+	}{
+		Device:    c.Ext,
+		Type:      rule.Type,
+		Active:    rule.Active,
+		To:        rule.To,
+		RingCount: rule.RingCount,
+	})
+	return err
+}
+
+// GetDoNotDisturb возвращает true, если включен режим "не беспокоить".
+func (c *MXConn) GetDoNotDisturb() (bool, error) {
+	resp, err := c.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"GetDoNotDisturb"`
+		Device  string   `xml:"device"`
+	}{
+		Device: c.Ext,
+	})
+	if err != nil {
+		return false, err
+	}
+	var result = new(struct {
+		On bool `xml:"doNotDisturbOn"`
+	})
+	if err = resp.Decode(result); err != nil {
+		return false, err
+	}
+	return result.On, nil
+}
+
+// SetDoNotDisturb включает или отключает режим "не беспокоить".
+func (c *MXConn) SetDoNotDisturb(on bool) error {
+	_, err := c.SendWithResponse(&struct {
+		XMLName xml.Name `xml:"SetDoNotDisturb"`
+		Device  string   `xml:"device"`
+		On      bool     `xml:"doNotDisturbOn"`
+	}{
+		Device: c.Ext,
+		On:     on,
+	})
+	return err
+}
+
+// ForwardingEvent описывает событие об изменении переадресации звонков.
+type ForwardingEvent struct {
+	Type           string `xml:"-" json:"type"`
+	Device         string `xml:"device>deviceIdentifier" json:"device"`
+	ForwardingType string `xml:"forwardingType" json:"forwardingType"`
+	Active         bool   `xml:"forwardStatus" json:"active"`
+	To             string `xml:"forwardTo" json:"to,omitempty"`
+	RingCount      int    `xml:"ringCount" json:"ringCount,omitempty"`
+	Timestamp      int64  `xml:"-" json:"timestamp"`
+}
+
+// DoNotDisturbEvent описывает событие об изменении режима "не беспокоить".
+type DoNotDisturbEvent struct {
+	Type      string `xml:"-" json:"type"`
+	Device    string `xml:"device>deviceIdentifier" json:"device"`
+	On        bool   `xml:"doNotDisturbOn" json:"dnd"`
+	Timestamp int64  `xml:"-" json:"timestamp"`
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestForwarding(t *testing.T) {
+	var webhook, pushed = webhookRecorder(t)
+	var s = newTestService(t, webhook)
+	s.login()
+	var events = s.events()
+	var result = new(struct {
+		Forwarding []*Forwarding `json:"forwarding"`
+	})
+	s.request("GET", "/settings/forwarding", nil, http.StatusOK, result)
+	if len(result.Forwarding) != 0 {
+		t.Fatalf("forwarding = %+v", result.Forwarding)
+	}
+
+	for _, params := range []url.Values{
+		{"type": {"unknown"}, "active": {"true"}, "to": {"3099"}},
+		{"type": {"busy"}, "active": {"true"}},
+		{"type": {"noAnswer"}, "active": {"true"}, "to": {"3099"},
+			"ringCount": {"16"}},
+	} {
+		s.request("PUT", "/settings/forwarding", params,
+			http.StatusBadRequest, nil)
+	}
+
+	s.request("PUT", "/settings/forwarding", url.Values{
+		"type": {"noAnswer"}, "active": {"true"}, "to": {"79031744437"},
+		"ringCount": {"4"}}, http.StatusOK, result)
+	if len(result.Forwarding) != 1 {
+		t.Fatalf("forwarding = %+v", result.Forwarding)
+	}
+	if rule := result.Forwarding[0]; rule.Type != "noAnswer" ||
+		!rule.Active || rule.To != "79031744437" || rule.RingCount != 4 {
+		t.Errorf("forwarding rule = %+v", rule)
+	}
+	if rules := s.mx.Forwarding("test"); len(rules) != 1 ||
+		rules[0].Type != "forwardNoAns" {
+		t.Errorf("mx forwarding = %+v", rules)
+	}
+	var event = nextEvent(t, events, "Forwarding")
+	if event["forwardingType"] != "noAnswer" || event["active"] != true ||
+		event["to"] != "79031744437" {
+		t.Errorf("forwarding event = %v", event)
+	}
+
+	s.request("PUT", "/settings/forwarding", url.Values{
+		"type": {"immediate"}, "active": {"false"}}, http.StatusOK, result)
+	if len(result.Forwarding) != 2 || result.Forwarding[0].Type != "immediate" ||
+		result.Forwarding[1].Type != "noAnswer" {
+		t.Errorf("forwarding = %+v", result.Forwarding)
+	}
+	nextEvent(t, events, "Forwarding")
+
+	// изменения настроек не отправляются на устройства и webhook
+	s.mx.Delivered("test", "79031234567")
+	if list := pushedBefore(t, pushed, "Delivered"); len(list) != 0 {
+		t.Errorf("pushed events = %v", list)
+	}
+}
+
+func TestDoNotDisturb(t *testing.T) {
+	var webhook, pushed = webhookRecorder(t)
+	var s = newTestService(t, webhook)
+	s.login()
+	var events = s.events()
+	var result = new(struct {
+		On bool `json:"dnd"`
+	})
+	s.request("GET", "/settings/dnd", nil, http.StatusOK, result)
+	if result.On {
+		t.Fatal("dnd on by default")
+	}
+	s.request("PUT", "/settings/dnd", url.Values{"dnd": {"true"}},
+		http.StatusOK, result)
+	if !result.On || !s.mx.DoNotDisturb("test") {
+		t.Fatal("dnd not set")
+	}
+	if event := nextEvent(t, events, "DoNotDisturb"); event["dnd"] != true {
+		t.Errorf("dnd event = %v", event)
+	}
+	result.On = false
+	s.request("GET", "/settings/dnd", nil, http.StatusOK, result)
+	if !result.On {
+		t.Error("dnd not returned")
+	}
+	s.request("PUT", "/settings/dnd", url.Values{"dnd": {"false"}},
+		http.StatusOK, result)
+	if event := nextEvent(t, events, "DoNotDisturb"); event["dnd"] != false {
+		t.Errorf("dnd event = %v", event)
+	}
+
+	s.mx.Delivered("test", "79031234567")
+	if list := pushedBefore(t, pushed, "Delivered"); len(list) != 0 {
+		t.Errorf("pushed events = %v", list)
+	}
+}
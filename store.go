@@ -2,6 +2,9 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -35,8 +38,14 @@ func (s *Store) Close() error {
 
 // Названия разделов в хранилище
 const (
-	bucketUsers  = "users"
-	bucketTokens = "tokens"
+	bucketUsers    = "users"
+	bucketTokens   = "tokens"
+	bucketQueue    = "queue"
+	bucketRefresh  = "refresh"
+	bucketJWTKeys  = "jwtkeys"
+	bucketRecords  = "recordings"
+	bucketCallLog  = "calllog"
+	bucketCallSync = "calllogsync"
 	// bucketApps   = "apps"
 )
 
@@ -96,6 +105,535 @@ func (s *Store) ListTokens(kind, topic, login string) []string {
 	return list
 }
 
+// webhookKey возвращает ключ для хранения адреса webhook пользователя. В
+// отличие от токенов устройств, один и тот же адрес может быть
+// зарегистрирован несколькими пользователями, поэтому логин входит в ключ.
+func webhookKey(topic, login, url string) string {
+	return "webhook:" + topic + ":" + login + ":" + url
+}
+
+// AddWebhook добавляет адрес webhook пользователя в хранилище.
+func (s *Store) AddWebhook(topic, login, url string) error {
+	return s.add(bucketTokens, webhookKey(topic, login, url), login)
+}
+
+// RemoveWebhook удаляет адрес webhook пользователя из хранилища. Адреса,
+// зарегистрированные другими пользователями, не затрагиваются.
+func (s *Store) RemoveWebhook(topic, login, url string) error {
+	return s.remove(bucketTokens, webhookKey(topic, login, url))
+}
+
+// ListWebhooks возвращает список адресов webhook пользователя.
+func (s *Store) ListWebhooks(topic, login string) []string {
+	var list []string
+	s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketTokens))
+		if bucket == nil {
+			return nil
+		}
+		var (
+			key    = []byte(webhookKey(topic, login, ""))
+			cursor = bucket.Cursor()
+		)
+		for k, v := cursor.Seek(key); k != nil && bytes.HasPrefix(k, key); k, v = cursor.Next() {
+			if bytes.Equal(v, []byte(login)) {
+				list = append(list, string(k[len(key):]))
+			}
+		}
+		return nil
+	})
+	return list
+}
+
+// QueueAdd добавляет уведомление в очередь повторной отправки.
+func (s *Store) QueueAdd(item *pushItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketQueue))
+		if err != nil {
+			return err
+		}
+		if item.ID, err = bucket.NextSequence(); err != nil {
+			return err
+		}
+		item.key = queueDueKey(item.Next, item.ID)
+		return bucket.Put(item.key, data)
+	})
+}
+
+// QueueUpdate сохраняет изменения уведомления в очереди повторной отправки.
+// Т.к. ключ уведомления зависит от времени следующей отправки, то запись со
+// старым ключом удаляется. Если записи со старым ключом уже нет, то
+// возвращается ErrNotFound.
+func (s *Store) QueueUpdate(item *pushItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketQueue))
+		if err != nil {
+			return err
+		}
+		// уведомление уже удалено или перенесено другим обработчиком:
+		// сохранение создало бы его копию
+		if item.key == nil || bucket.Get(item.key) == nil {
+			return ErrNotFound
+		}
+		if err = bucket.Delete(item.key); err != nil {
+			return err
+		}
+		item.key = queueDueKey(item.Next, item.ID)
+		return bucket.Put(item.key, data)
+	})
+}
+
+// QueueGet возвращает текущее состояние уведомления из очереди повторной
+// отправки по его ключу или nil, если уведомления с таким ключом уже нет.
+func (s *Store) QueueGet(key []byte) *pushItem {
+	var item *pushItem
+	s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketQueue))
+		if bucket == nil {
+			return nil
+		}
+		var data = bucket.Get(key)
+		if data == nil || len(key) != 16 {
+			return nil
+		}
+		item = new(pushItem)
+		if err := json.Unmarshal(data, item); err != nil {
+			item = nil
+			return nil
+		}
+		item.key = append([]byte(nil), key...)
+		item.ID = binary.BigEndian.Uint64(key[8:])
+		return nil
+	})
+	return item
+}
+
+// QueueRemove удаляет уведомление из очереди повторной отправки.
+func (s *Store) QueueRemove(item *pushItem) error {
+	return s.remove(bucketQueue, string(item.key))
+}
+
+// QueueDue возвращает список уведомлений из очереди, время отправки которых
+// уже наступило. Ключи упорядочены по времени отправки, поэтому просмотр
+// заканчивается на первом уведомлении, время которого еще не наступило.
+func (s *Store) QueueDue(now time.Time) []*pushItem {
+	var list []*pushItem
+	s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketQueue))
+		if bucket == nil {
+			return nil
+		}
+		var cursor = bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			if int64(binary.BigEndian.Uint64(k)) > now.UnixNano() {
+				break
+			}
+			var item = new(pushItem)
+			if err := json.Unmarshal(v, item); err != nil {
+				continue // пропускаем испорченные данные
+			}
+			item.key = append([]byte(nil), k...)
+			item.ID = binary.BigEndian.Uint64(k[8:])
+			list = append(list, item)
+		}
+		return nil
+	})
+	return list
+}
+
+// QueueStats возвращает количество уведомлений в очереди повторной отправки
+// по типу сервиса.
+func (s *Store) QueueStats() map[string]int {
+	var stats = make(map[string]int)
+	s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketQueue))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, v []byte) error {
+			var item = new(struct {
+				Kind string `json:"kind"`
+			})
+			if err := json.Unmarshal(v, item); err == nil {
+				stats[item.Kind]++
+			}
+			return nil
+		})
+	})
+	return stats
+}
+
+// AddRefreshToken сохраняет информацию о токене обновления в хранилище. Сам
+// токен не сохраняется: в качестве ключа используется его хеш.
+func (s *Store) AddRefreshToken(token string, info *RefreshToken) error {
+	return s.add(bucketRefresh, refreshKey(token), info)
+}
+
+// GetRefreshToken проверяет токен обновления и возвращает информацию о нем,
+// не удаляя его из хранилища. Токен должен быть выдан тому же приложению
+// clientID и не должен быть просрочен.
+func (s *Store) GetRefreshToken(token, clientID string) (*RefreshToken, error) {
+	var info = new(RefreshToken)
+	if err := s.get(bucketRefresh, refreshKey(token), info); err != nil {
+		return nil, ErrNotFound
+	}
+	// просроченные токены удаляются при периодической очистке
+	if info.ClientID != clientID || time.Now().After(info.Expires) {
+		return nil, ErrNotFound
+	}
+	return info, nil
+}
+
+// RotateRefreshToken заменяет использованный токен обновления новым в одной
+// транзакции, так что каждый токен может быть использован только один раз.
+// Если использованный токен уже был заменен или отозван, то возвращается
+// ошибка ErrNotFound.
+func (s *Store) RotateRefreshToken(used, token string, info *RefreshToken) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketRefresh))
+		if bucket == nil {
+			return ErrNotFound
+		}
+		var key = []byte(refreshKey(used))
+		if bucket.Get(key) == nil {
+			return ErrNotFound
+		}
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+		return bucket.Put([]byte(refreshKey(token)), data)
+	})
+}
+
+// RemoveRefreshToken удаляет токен обновления пользователя из хранилища.
+func (s *Store) RemoveRefreshToken(token, login string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketRefresh))
+		if bucket == nil {
+			return ErrNotFound
+		}
+		var key = []byte(refreshKey(token))
+		var info = new(RefreshToken)
+		if data := bucket.Get(key); data == nil ||
+			json.Unmarshal(data, info) != nil || info.Login != login {
+			return ErrNotFound
+		}
+		return bucket.Delete(key)
+	})
+}
+
+// RemoveRefreshTokens удаляет все токены обновления пользователя и
+// возвращает их количество. Если логин не указан, то удаляются только
+// просроченные токены всех пользователей.
+func (s *Store) RemoveRefreshTokens(login string) (count int) {
+	var now = time.Now()
+	s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketRefresh))
+		if bucket == nil {
+			return nil
+		}
+		var cursor = bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var info = new(RefreshToken)
+			if err := json.Unmarshal(v, info); err == nil {
+				if login != "" && info.Login != login {
+					continue
+				}
+				if login == "" && now.Before(info.Expires) {
+					continue
+				}
+			}
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+// ListRefreshTokens возвращает список выданных токенов обновления по
+// логинам пользователей.
+func (s *Store) ListRefreshTokens() map[string][]*RefreshToken {
+	var result = make(map[string][]*RefreshToken)
+	s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketRefresh))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, v []byte) error {
+			var info = new(RefreshToken)
+			if err := json.Unmarshal(v, info); err == nil {
+				result[info.Login] = append(result[info.Login], info)
+			}
+			return nil
+		})
+	})
+	return result
+}
+
+// AddJWTKey сохраняет зашифрованный ключ подписи токенов в хранилище.
+func (s *Store) AddJWTKey(id string, data []byte) error {
+	return s.add(bucketJWTKeys, id, data)
+}
+
+// RemoveJWTKey удаляет ключ подписи токенов из хранилища.
+func (s *Store) RemoveJWTKey(id string) error {
+	return s.remove(bucketJWTKeys, id)
+}
+
+// JWTKeys возвращает все сохраненные зашифрованные ключи подписи токенов.
+func (s *Store) JWTKeys() map[string][]byte {
+	var result = make(map[string][]byte)
+	s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketJWTKeys))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			result[string(k)] = append([]byte(nil), v...)
+			return nil
+		})
+	})
+	return result
+}
+
+// AddRecording сохраняет информацию о записанном звонке пользователя. Записи
+// каждого пользователя хранятся в отдельном вложенном разделе.
+func (s *Store) AddRecording(login string, rec *VoiceMail) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists([]byte(bucketRecords))
+		if err != nil {
+			return err
+		}
+		bucket, err := root.CreateBucketIfNotExists([]byte(login))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(rec.ID), data)
+	})
+}
+
+// RemoveRecording удаляет информацию о записанном звонке пользователя.
+func (s *Store) RemoveRecording(login, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if root := tx.Bucket([]byte(bucketRecords)); root != nil {
+			if bucket := root.Bucket([]byte(login)); bucket != nil {
+				return bucket.Delete([]byte(id))
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveRecordings удаляет информацию обо всех записанных звонках
+// пользователя.
+func (s *Store) RemoveRecordings(login string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if root := tx.Bucket([]byte(bucketRecords)); root != nil &&
+			root.Bucket([]byte(login)) != nil {
+			return root.DeleteBucket([]byte(login))
+		}
+		return nil
+	})
+}
+
+// Recordings возвращает сохраненный список записанных звонков пользователя.
+func (s *Store) Recordings(login string) []*VoiceMail {
+	var list []*VoiceMail
+	s.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(bucketRecords))
+		if root == nil {
+			return nil
+		}
+		bucket := root.Bucket([]byte(login))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, v []byte) error {
+			var rec = new(VoiceMail)
+			if err := json.Unmarshal(v, rec); err == nil {
+				list = append(list, rec)
+			}
+			return nil
+		})
+	})
+	return list
+}
+
+// AddCalls сохраняет записи лога звонков пользователя. Записи хранятся во
+// вложенном разделе пользователя и упорядочены по номеру записи, поэтому
+// повторное сохранение той же записи ее просто заменяет.
+func (s *Store) AddCalls(login string, calls []*CallInfo) error {
+	if len(calls) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists([]byte(bucketCallLog))
+		if err != nil {
+			return err
+		}
+		bucket, err := root.CreateBucketIfNotExists([]byte(login))
+		if err != nil {
+			return err
+		}
+		for _, call := range calls {
+			data, err := json.Marshal(call)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put(callLogKey(uint64(call.RecordID)), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Calls возвращает записи лога звонков пользователя с номером больше after,
+// для которых match возвращает true. Если limit больше нуля, то возвращается
+// не более limit записей. Так же возвращается номер последней просмотренной
+// записи и флаг, что подходящих записей больше, чем limit.
+func (s *Store) Calls(login string, after int64, match func(*CallInfo) bool,
+	limit int) (list []*CallInfo, last int64, more bool) {
+	list, last = make([]*CallInfo, 0), after
+	s.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(bucketCallLog))
+		if root == nil {
+			return nil
+		}
+		bucket := root.Bucket([]byte(login))
+		if bucket == nil {
+			return nil
+		}
+		var cursor = bucket.Cursor()
+		var k, v = cursor.Seek(callLogKey(uint64(after)))
+		if k != nil && int64(binary.BigEndian.Uint64(k)) == after {
+			k, v = cursor.Next() // запись с номером after уже была отдана
+		}
+		for ; k != nil; k, v = cursor.Next() {
+			var call = new(CallInfo)
+			if err := json.Unmarshal(v, call); err != nil {
+				continue
+			}
+			if match != nil && !match(call) {
+				last = call.RecordID
+				continue
+			}
+			if limit > 0 && len(list) == limit {
+				more = true
+				break
+			}
+			list = append(list, call)
+			last = call.RecordID
+		}
+		return nil
+	})
+	return list, last, more
+}
+
+// LastCallTime возвращает время последнего звонка из сохраненного лога
+// звонков пользователя или 0, если лог пуст. Номера записей возрастают вместе
+// со временем звонков, поэтому просматриваются только последние записи.
+func (s *Store) LastCallTime(login string) int64 {
+	var last int64
+	s.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(bucketCallLog))
+		if root == nil {
+			return nil
+		}
+		bucket := root.Bucket([]byte(login))
+		if bucket == nil {
+			return nil
+		}
+		var cursor = bucket.Cursor()
+		var k, v = cursor.Last()
+		for i := 0; k != nil && i < 100; i++ {
+			var call = new(CallInfo)
+			if err := json.Unmarshal(v, call); err == nil &&
+				call.Time() > last {
+				last = call.Time()
+			}
+			k, v = cursor.Prev()
+		}
+		return nil
+	})
+	return last
+}
+
+// CallLogSynced возвращает время последнего звонка, полученного при
+// последней полной синхронизации лога звонков пользователя с сервером MX, или
+// 0, если лог еще ни разу не был получен полностью.
+func (s *Store) CallLogSynced(login string) int64 {
+	var synced int64
+	s.get(bucketCallSync, login, &synced)
+	return synced
+}
+
+// SetCallLogSynced сохраняет время последнего звонка, полученного при полной
+// синхронизации лога звонков пользователя.
+func (s *Store) SetCallLogSynced(login string, synced int64) error {
+	return s.add(bucketCallSync, login, synced)
+}
+
+// RemoveCalls удаляет сохраненный лог звонков пользователя и время его
+// синхронизации.
+func (s *Store) RemoveCalls(login string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(bucketCallSync)); bucket != nil {
+			if err := bucket.Delete([]byte(login)); err != nil {
+				return err
+			}
+		}
+		if root := tx.Bucket([]byte(bucketCallLog)); root != nil &&
+			root.Bucket([]byte(login)) != nil {
+			return root.DeleteBucket([]byte(login))
+		}
+		return nil
+	})
+}
+
+// refreshKey возвращает ключ для хранения токена обновления.
+func refreshKey(token string) string {
+	var hash = sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// queueDueKey возвращает ключ уведомления в очереди повторной отправки:
+// время следующей отправки и номер уведомления. Ключи упорядочены по времени
+// отправки.
+func queueDueKey(next time.Time, id uint64) []byte {
+	var key = make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(next.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], id)
+	return key
+}
+
+// callLogKey возвращает ключ записи в сохраненном логе звонков по ее номеру.
+// Ключи упорядочены по возрастанию номеров.
+func callLogKey(id uint64) []byte {
+	var key = make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
 // add сохраняет объект в указанном разделе хранилище с заданным ключом.
 func (s *Store) add(section, key string, obj interface{}) error {
 	var data []byte
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strings"
+)
+
+// Форматы, в которые может быть преобразован файл голосовой почты, и их
+// MIME-типы.
+var transcodeFormats = map[string]string{
+	"wav":  "audio/wav",
+	"flac": "audio/flac",
+}
+
+// Допустимые значения частоты дискретизации при преобразовании.
+const (
+	TranscodeMinRate = 8000
+	TranscodeMaxRate = 48000
+)
+
+// Коды форматов данных в заголовке WAV.
+const (
+	waveFormatPCM        = 0x0001
+	waveFormatFloat      = 0x0003
+	waveFormatALaw       = 0x0006
+	waveFormatMuLaw      = 0x0007
+	waveFormatExtensible = 0xFFFE
+)
+
+// errWaveFormat возвращается, если формат исходного файла не поддерживается
+// для преобразования.
+var errWaveFormat = errors.New("unsupported source audio format")
+
+// waveFormat описывает формат данных файла WAV.
+type waveFormat struct {
+	Codec      uint16 // формат данных
+	Channels   int    // количество каналов
+	SampleRate int    // частота дискретизации
+	Bits       int    // количество бит на отсчет
+	BlockAlign int    // размер одного отсчета всех каналов в байтах
+	dataOffset int    // смещение данных от начала файла
+	dataSize   int64  // размер данных или -1, если не известен
+}
+
+// parseWave разбирает заголовок файла WAV. Заголовок должен полностью
+// находиться в переданных данных.
+func parseWave(data []byte) (*waveFormat, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" ||
+		string(data[8:12]) != "WAVE" {
+		return nil, errWaveFormat
+	}
+	var format *waveFormat
+	for offset := 12; offset+8 <= len(data); {
+		var id = string(data[offset : offset+4])
+		var size = int64(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		offset += 8
+		switch id {
+		case "fmt ":
+			if size < 16 || int64(offset)+size > int64(len(data)) {
+				return nil, errWaveFormat
+			}
+			var fmtData = data[offset : offset+int(size)]
+			format = &waveFormat{
+				Codec:      binary.LittleEndian.Uint16(fmtData[0:2]),
+				Channels:   int(binary.LittleEndian.Uint16(fmtData[2:4])),
+				SampleRate: int(binary.LittleEndian.Uint32(fmtData[4:8])),
+				BlockAlign: int(binary.LittleEndian.Uint16(fmtData[12:14])),
+				Bits:       int(binary.LittleEndian.Uint16(fmtData[14:16])),
+			}
+			// для расширенного формата код задан в начале GUID подформата
+			if format.Codec == waveFormatExtensible {
+				if size < 26 {
+					return nil, errWaveFormat
+				}
+				format.Codec = binary.LittleEndian.Uint16(fmtData[24:26])
+			}
+		case "data":
+			if format == nil {
+				return nil, errWaveFormat
+			}
+			format.dataOffset = offset
+			format.dataSize = size
+			// размер не задан при записи потоком
+			if size == 0 || size == 0xFFFFFFFF {
+				format.dataSize = -1
+			}
+			if err := format.check(); err != nil {
+				return nil, err
+			}
+			return format, nil
+		}
+		offset += int(size + size&1) // куски выравниваются по двум байтам
+	}
+	return nil, errWaveFormat
+}
+
+// check проверяет, что формат данных поддерживается для преобразования.
+func (f *waveFormat) check() error {
+	if f.Channels < 1 || f.Channels > 8 || f.SampleRate <= 0 {
+		return errWaveFormat
+	}
+	switch f.Codec {
+	case waveFormatPCM:
+		if f.Bits != 8 && f.Bits != 16 && f.Bits != 24 && f.Bits != 32 {
+			return errWaveFormat
+		}
+	case waveFormatFloat:
+		if f.Bits != 32 {
+			return errWaveFormat
+		}
+	case waveFormatALaw, waveFormatMuLaw:
+		if f.Bits != 8 {
+			return errWaveFormat
+		}
+	default:
+		return errWaveFormat
+	}
+	if size := f.Channels * f.Bits / 8; f.BlockAlign < size {
+		f.BlockAlign = size
+	}
+	return nil
+}
+
+// decode преобразует отсчет, начинающийся с начала data, в 16-битное
+// значение.
+func (f *waveFormat) decode(data []byte) int16 {
+	switch f.Codec {
+	case waveFormatALaw:
+		return alawTable[data[0]]
+	case waveFormatMuLaw:
+		return ulawTable[data[0]]
+	case waveFormatFloat:
+		var v = math.Float32frombits(binary.LittleEndian.Uint32(data))
+		switch {
+		case v >= 1:
+			return math.MaxInt16
+		case v <= -1:
+			return math.MinInt16
+		}
+		return int16(v * math.MaxInt16)
+	}
+	switch f.Bits {
+	case 8:
+		return int16(int(data[0])-128) << 8
+	case 16:
+		return int16(binary.LittleEndian.Uint16(data))
+	default: // 24 и 32: используем старшие 16 бит
+		var n = f.Bits / 8
+		return int16(binary.LittleEndian.Uint16(data[n-2 : n]))
+	}
+}
+
+// Таблицы декодирования G.711.
+var alawTable, ulawTable [256]int16
+
+func init() {
+	for i := range alawTable {
+		alawTable[i] = alawDecode(byte(i))
+		ulawTable[i] = ulawDecode(byte(i))
+	}
+}
+
+// alawDecode декодирует отсчет G.711 A-law.
+func alawDecode(a byte) int16 {
+	a ^= 0x55
+	var t = int(a&0x0f) << 4
+	switch seg := uint(a&0x70) >> 4; seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+	if a&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+// ulawDecode декодирует отсчет G.711 µ-law.
+func ulawDecode(u byte) int16 {
+	u = ^u
+	var t = int(u&0x0f)<<3 + 0x84
+	t <<= uint(u&0x70) >> 4
+	if u&0x80 != 0 {
+		return int16(0x84 - t)
+	}
+	return int16(t - 0x84)
+}
+
+// audioEncoder описывает кодировщик преобразованного файла.
+type audioEncoder interface {
+	// WriteSamples кодирует отсчеты, чередующиеся по каналам.
+	WriteSamples(samples []int16) error
+	// Close записывает оставшиеся данные.
+	Close() error
+}
+
+// Transcoder преобразует файл WAV по мере получения его содержимого в PCM WAV
+// или FLAC с заданной частотой дискретизации. Исходные данные передаются
+// вместе с заголовком с помощью Write, а по окончании должен быть вызван
+// Close.
+type Transcoder struct {
+	src      *waveFormat   // формат исходных данных
+	rate     int           // частота дискретизации результата
+	total    int64         // количество отсчетов результата или -1
+	written  int64         // количество отданных отсчетов
+	skip     int           // количество байт заголовка для пропуска
+	remain   int64         // количество байт данных или -1
+	buf      []byte        // неполный отсчет с предыдущей записи
+	samples  []int16       // декодированные отсчеты
+	last     []int16       // предыдущий отсчет для интерполяции
+	pos      int64         // позиция следующего отсчета после last
+	out      *bufio.Writer // буфер для отдачи результата
+	enc      audioEncoder  // кодировщик результата
+	mimetype string        // MIME-тип результата
+	err      error
+}
+
+// NewTranscoder возвращает преобразователь файла WAV в указанный формат.
+// Заголовок исходного файла должен полностью содержаться в header. Размер
+// файла size используется для проверки размера данных из заголовка; если он
+// не известен, то передается -1. Если частота rate не задана, то
+// используется частота исходного файла.
+func NewTranscoder(header []byte, size int64, format string, rate int,
+	w io.Writer) (*Transcoder, error) {
+	mimetype, ok := transcodeFormats[format]
+	if !ok {
+		return nil, errors.New("unsupported format")
+	}
+	src, err := parseWave(header)
+	if err != nil {
+		return nil, err
+	}
+	// размер данных не может превышать размер файла
+	if size >= 0 {
+		if max := size - int64(src.dataOffset); src.dataSize < 0 ||
+			src.dataSize > max {
+			src.dataSize = max
+		}
+	}
+	if rate == 0 {
+		rate = src.SampleRate
+	}
+	var t = &Transcoder{
+		src:      src,
+		rate:     rate,
+		total:    -1,
+		skip:     src.dataOffset,
+		remain:   src.dataSize,
+		out:      bufio.NewWriterSize(w, 32<<10),
+		mimetype: mimetype,
+	}
+	// при известном размере данных количество отсчетов результата
+	// вычисляется заранее, что позволяет указать его в заголовке
+	if src.dataSize >= 0 {
+		var n = src.dataSize / int64(src.BlockAlign)
+		if n > 0 {
+			t.total = (n-1)*int64(rate)/int64(src.SampleRate) + 1
+		} else {
+			t.total = 0
+		}
+	}
+	switch format {
+	case "wav":
+		t.enc = newWaveEncoder(t.out, src.Channels, rate, t.total)
+	case "flac":
+		t.enc = newFLACEncoder(t.out, src.Channels, rate, t.total)
+	}
+	return t, nil
+}
+
+// Mimetype возвращает MIME-тип результата.
+func (t *Transcoder) Mimetype() string {
+	return t.mimetype
+}
+
+// Rate возвращает частоту дискретизации результата.
+func (t *Transcoder) Rate() int {
+	return t.rate
+}
+
+// Size возвращает размер результата в байтах или -1, если он не известен
+// заранее.
+func (t *Transcoder) Size() int64 {
+	if enc, ok := t.enc.(*waveEncoder); ok && t.total >= 0 {
+		return enc.size()
+	}
+	return -1
+}
+
+// Write принимает очередную часть исходного файла.
+func (t *Transcoder) Write(data []byte) (int, error) {
+	if t.err != nil {
+		return 0, t.err
+	}
+	var n = len(data)
+	// пропускаем заголовок исходного файла
+	if t.skip > 0 {
+		if len(data) <= t.skip {
+			t.skip -= len(data)
+			return n, nil
+		}
+		data = data[t.skip:]
+		t.skip = 0
+	}
+	// игнорируем данные после окончания данных
+	if t.remain >= 0 {
+		if int64(len(data)) > t.remain {
+			data = data[:t.remain]
+		}
+		t.remain -= int64(len(data))
+	}
+	t.buf = append(t.buf, data...)
+	var align = t.src.BlockAlign
+	var frames = len(t.buf) / align
+	var bytesPerSample = t.src.Bits / 8
+	t.samples = t.samples[:0]
+	for i := 0; i < frames; i++ {
+		var frame = t.buf[i*align:]
+		for ch := 0; ch < t.src.Channels; ch++ {
+			t.samples = append(t.samples, t.src.decode(frame[ch*bytesPerSample:]))
+		}
+	}
+	t.buf = t.buf[:copy(t.buf, t.buf[frames*align:])]
+	t.err = t.resample(t.samples)
+	return n, t.err
+}
+
+// resample изменяет частоту дискретизации отсчетов с помощью линейной
+// интерполяции и передает их кодировщику. Позиция отсчетов результата
+// вычисляется в целых числах, поэтому ошибка не накапливается.
+func (t *Transcoder) resample(samples []int16) error {
+	var channels = t.src.Channels
+	if t.rate == t.src.SampleRate {
+		return t.emit(samples)
+	}
+	var (
+		inRate  = int64(t.src.SampleRate)
+		outRate = int64(t.rate)
+		result  = make([]int16, 0, int64(len(samples))*outRate/inRate+
+			int64(channels))
+	)
+	for i := 0; i+channels <= len(samples); i += channels {
+		var frame = samples[i : i+channels]
+		if t.last == nil {
+			t.last = append(make([]int16, 0, channels), frame...)
+			continue
+		}
+		// отсчеты результата между предыдущим и текущим отсчетом
+		for ; t.pos < outRate; t.pos += inRate {
+			for ch, prev := range t.last {
+				var delta = int64(frame[ch]) - int64(prev)
+				result = append(result, int16(int64(prev)+delta*t.pos/outRate))
+			}
+		}
+		t.pos -= outRate
+		copy(t.last, frame)
+	}
+	return t.emit(result)
+}
+
+// emit передает отсчеты кодировщику, ограничивая их количество заранее
+// вычисленным.
+func (t *Transcoder) emit(samples []int16) error {
+	var channels = int64(t.src.Channels)
+	if t.total >= 0 {
+		if max := (t.total - t.written) * channels; int64(len(samples)) > max {
+			samples = samples[:max]
+		}
+	}
+	if len(samples) == 0 {
+		return nil
+	}
+	t.written += int64(len(samples)) / channels
+	return t.enc.WriteSamples(samples)
+}
+
+// Close завершает преобразование и отдает оставшиеся данные. Если исходный
+// файл оказался короче, чем указано в заголовке, то результат дополняется
+// тишиной.
+func (t *Transcoder) Close() error {
+	if t.err != nil {
+		return t.err
+	}
+	// последний отсчет исходного файла совпадает с отсчетом результата
+	if t.rate != t.src.SampleRate && t.last != nil && t.pos == 0 {
+		if t.err = t.emit(t.last); t.err != nil {
+			return t.err
+		}
+	}
+	if t.total > t.written {
+		var silence = make([]int16, (t.total-t.written)*int64(t.src.Channels))
+		if t.err = t.emit(silence); t.err != nil {
+			return t.err
+		}
+	}
+	if t.err = t.enc.Close(); t.err != nil {
+		return t.err
+	}
+	t.err = t.out.Flush()
+	return t.err
+}
+
+// transcodeName возвращает имя файла с расширением, соответствующим формату.
+func transcodeName(name, format string) string {
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		name = name[:i]
+	}
+	return name + "." + format
+}
+
+// waveEncoder записывает отсчеты в формате PCM WAV с 16 битами на отсчет.
+type waveEncoder struct {
+	w        io.Writer
+	channels int
+	total    int64  // количество отсчетов или -1
+	buf      []byte // заголовок и данные для записи
+}
+
+// newWaveEncoder возвращает кодировщик в формат PCM WAV. Если количество
+// отсчетов не известно, то в заголовке указывается максимальный размер, как
+// это принято при записи потоком.
+func newWaveEncoder(w io.Writer, channels, rate int, total int64) *waveEncoder {
+	var e = &waveEncoder{w: w, channels: channels, total: total}
+	var dataSize, riffSize = uint32(0xFFFFFFFF), uint32(0xFFFFFFFF)
+	if total >= 0 {
+		dataSize = uint32(total * int64(channels) * 2)
+		riffSize = dataSize + 36
+	}
+	var header = make([]byte, 44)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], riffSize)
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], waveFormatPCM)
+	binary.LittleEndian.PutUint16(header[22:], uint16(channels))
+	binary.LittleEndian.PutUint32(header[24:], uint32(rate))
+	binary.LittleEndian.PutUint32(header[28:], uint32(rate*channels*2))
+	binary.LittleEndian.PutUint16(header[32:], uint16(channels*2))
+	binary.LittleEndian.PutUint16(header[34:], 16)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], dataSize)
+	e.buf = header
+	return e
+}
+
+// size возвращает размер файла в байтах.
+func (e *waveEncoder) size() int64 {
+	return 44 + e.total*int64(e.channels)*2
+}
+
+// WriteSamples записывает отсчеты.
+func (e *waveEncoder) WriteSamples(samples []int16) error {
+	for _, v := range samples {
+		e.buf = append(e.buf, byte(v), byte(uint16(v)>>8))
+	}
+	_, err := e.w.Write(e.buf)
+	e.buf = e.buf[:0]
+	return err
+}
+
+// Close записывает заголовок, если отсчетов не было.
+func (e *waveEncoder) Close() error {
+	if len(e.buf) == 0 {
+		return nil
+	}
+	_, err := e.w.Write(e.buf)
+	e.buf = e.buf[:0]
+	return err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"strings"
+)
+
+// Форматы отдачи адресной книги и их MIME-типы.
+var contactsMimetypes = map[string]string{
+	"vcard": "text/vcard; charset=utf-8",
+	"csv":   "text/csv; charset=utf-8",
+}
+
+// contactsFormat выбирает формат отдачи адресной книги по заголовку Accept с
+// учетом приоритета q. По умолчанию используется JSON.
+func contactsFormat(accept string) string {
+	var format, quality = "json", 0.0
+	for _, item := range strings.Split(accept, ",") {
+		var params = strings.Split(item, ";")
+		var q = 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		var name string
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case "application/json":
+			name = "json"
+		case "text/vcard", "text/x-vcard", "text/directory":
+			name = "vcard"
+		case "text/csv":
+			name = "csv"
+		default:
+			continue
+		}
+		if q > quality {
+			format, quality = name, q
+		}
+	}
+	return format
+}
+
+// contactValue возвращает значение поля контакта в виде строки.
+func contactValue(contact *Contact, field string) string {
+	switch field {
+	case "jid":
+		return strconv.FormatUint(uint64(contact.JID), 10)
+	case "firstName":
+		return contact.FirstName
+	case "lastName":
+		return contact.LastName
+	case "ext":
+		return contact.Ext
+	case "homePhone":
+		return contact.HomePhone
+	case "cellPhone":
+		return contact.CellPhone
+	case "email":
+		return contact.Email
+	case "homeSystem":
+		if contact.HomeSystem == 0 {
+			return ""
+		}
+		return strconv.FormatUint(uint64(contact.HomeSystem), 10)
+	case "did":
+		return contact.DID
+	case "exchangeId":
+		return contact.ExchangeID
+	}
+	return ""
+}
+
+// contactsCSV возвращает контакты в формате CSV. Первая строка содержит
+// названия полей. Если поля не указаны, то отдаются все поля контакта.
+func contactsCSV(contacts []*Contact, fields []string) ([]byte, error) {
+	if len(fields) == 0 {
+		fields = contactFieldNames
+	}
+	var buf bytes.Buffer
+	var w = csv.NewWriter(&buf)
+	w.UseCRLF = true
+	w.Write(fields)
+	var record = make([]string, len(fields))
+	for _, contact := range contacts {
+		for i, field := range fields {
+			record[i] = contactValue(contact, field)
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// contactsVCard возвращает контакты в формате vCard 4.0 (RFC 6350): по одной
+// карточке на каждый контакт.
+func contactsVCard(contacts []*Contact) []byte {
+	var buf bytes.Buffer
+	for _, contact := range contacts {
+		var card = vcardWriter{&buf}
+		card.line("BEGIN:VCARD")
+		card.line("VERSION:4.0")
+		card.line("UID:urn:x-mx:" + strconv.FormatUint(uint64(contact.JID), 10))
+		var name = strings.TrimSpace(contact.FirstName + " " + contact.LastName)
+		if name == "" {
+			name = contact.Ext
+		}
+		card.line("FN:" + vcardEscape(name))
+		card.line("N:" + vcardEscape(contact.LastName) + ";" +
+			vcardEscape(contact.FirstName) + ";;;")
+		card.tel(`work`, contact.Ext)
+		card.tel(`"work,voice"`, contact.DID)
+		card.tel(`"cell,voice"`, contact.CellPhone)
+		card.tel(`"home,voice"`, contact.HomePhone)
+		if contact.Email != "" {
+			card.line("EMAIL;TYPE=work:" + vcardEscape(contact.Email))
+		}
+		card.line("END:VCARD")
+	}
+	return buf.Bytes()
+}
+
+// vcardWriter формирует строки карточки vCard.
+type vcardWriter struct {
+	buf *bytes.Buffer
+}
+
+// tel добавляет телефонный номер указанного типа, если он задан. Номера
+// отдаются как текст, т.к. внутренние номера не являются URI tel.
+func (w vcardWriter) tel(kind, number string) {
+	if number != "" {
+		w.line("TEL;VALUE=text;TYPE=" + kind + ":" + vcardEscape(number))
+	}
+}
+
+// line добавляет строку, перенося ее части длиннее 75 байт на следующие
+// строки, как того требует формат. Перенос не разрывает символы UTF-8.
+func (w vcardWriter) line(s string) {
+	var limit = 75
+	for len(s) > limit {
+		var i = limit
+		for i > 0 && s[i]&0xC0 == 0x80 {
+			i-- // не разрываем многобайтовый символ
+		}
+		w.buf.WriteString(s[:i])
+		w.buf.WriteString("\r\n ")
+		s = s[i:]
+		limit = 74 // с учетом пробела в начале строки
+	}
+	w.buf.WriteString(s)
+	w.buf.WriteString("\r\n")
+}
+
+// vcardEscape экранирует специальные символы в текстовом значении vCard.
+var vcardEscape = strings.NewReplacer(
+	`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`,
+).Replace
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	app "github.com/mdigger/app-info"
+	"github.com/mdigger/log"
+)
+
+// WebhookTimeout задает время ожидания ответа при отправке уведомления на
+// webhook.
+var WebhookTimeout = time.Second * 10
+
+// webhook описывает настройки отправки уведомлений на webhook.
+type webhook struct {
+	secret string // ключ для подписи уведомлений HMAC-SHA256
+	url    string // адрес для уведомлений всех пользователей (не обязательно)
+}
+
+// webhookClient используется для отправки уведомлений на адреса, заданные в
+// конфигурации, и не ограничивает адреса серверов.
+var webhookClient = &http.Client{Timeout: WebhookTimeout}
+
+// webhookUserClient используется для отправки уведомлений на адреса,
+// зарегистрированные пользователями. Соединения с внутренними адресами
+// запрещены, в том числе если имя сервера было изменено в DNS после
+// регистрации адреса.
+var webhookUserClient = &http.Client{
+	Timeout: WebhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   WebhookTimeout,
+			KeepAlive: time.Second * 30,
+			Control:   webhookDialControl,
+		}).DialContext,
+		TLSHandshakeTimeout: WebhookTimeout,
+		IdleConnTimeout:     time.Second * 90,
+		MaxIdleConns:        100,
+	},
+}
+
+// errWebhookAddress возвращается при попытке отправить уведомление
+// пользователя на внутренний адрес.
+var errWebhookAddress = errors.New("webhook address not allowed")
+
+// webhookPrivateNets содержит диапазоны частных и служебных адресов, на
+// которые не отправляются уведомления пользователей.
+var webhookPrivateNets = func() []*net.IPNet {
+	var list []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16",
+		"198.18.0.0/15", "::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		list = append(list, ipnet)
+	}
+	return list
+}()
+
+// webhookAllowedIP возвращает true, если на указанный адрес можно отправлять
+// уведомления пользователей: адрес не должен быть локальным, частным или
+// служебным.
+func webhookAllowedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return false
+	}
+	for _, ipnet := range webhookPrivateNets {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookDialControl проверяет адрес, с которым устанавливается соединение
+// для отправки уведомления пользователя, после разрешения имени в DNS.
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !webhookAllowedIP(ip) {
+		return errWebhookAddress
+	}
+	return nil
+}
+
+// sendWebhook отсылает уведомление на все webhook пользователя, а так же на
+// общие webhook, заданные в конфигурации.
+func (p *Push) sendWebhook(login string, obj interface{}) error {
+	// преобразуем данные для уведомления в формат JSON
+	var payload []byte
+	switch obj := obj.(type) {
+	case []byte:
+		payload = obj
+	case string:
+		payload = []byte(obj)
+	case json.RawMessage:
+		payload = []byte(obj)
+	default:
+		var err error
+		payload, err = json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+	}
+	for topic, hook := range p.webhooks {
+		var urls = p.store.ListWebhooks(topic, login)
+		if hook.url != "" {
+			urls = append(urls, hook.url)
+		}
+		// каждый адрес обрабатывается независимо, чтобы недоступный адрес
+		// не задерживал отправку на остальные
+		for _, webhookURL := range urls {
+			go func(topic, webhookURL string) {
+				err := p.postWebhookURL(topic, login, webhookURL, payload)
+				if err == nil {
+					metricPushSent.Inc("webhook", topic, "success")
+					return
+				}
+				if retry, ok := err.(*pushRetryError); ok {
+					metricPushSent.Inc("webhook", topic, "retry")
+					p.enqueue("webhook", topic, webhookURL, login, payload, retry)
+					return
+				}
+				metricPushSent.Inc("webhook", topic, "failure")
+				log.Error("webhook error", "topic", topic, "url", webhookURL,
+					"error", err)
+			}(topic, webhookURL)
+		}
+	}
+	return nil
+}
+
+// postWebhookURL отсылает подписанное уведомление пользователя на указанный
+// адрес. В случае временной ошибки возвращается ошибка типа *pushRetryError,
+// и отправка повторяется через очередь повторной отправки уведомлений.
+func (p *Push) postWebhookURL(topic, login, webhookURL string,
+	payload []byte) error {
+	var hook = p.webhooks[topic]
+	if hook == nil {
+		return errors.New("unsupported webhook topic")
+	}
+	// подписываем содержимое уведомления
+	var mac = hmac.New(sha256.New, []byte(hook.secret))
+	mac.Write(payload)
+	var signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	var client = webhookUserClient
+	if webhookURL == hook.url {
+		client = webhookClient
+	}
+	status, retryAfter, err := postWebhook(client, webhookURL, login,
+		signature, payload)
+	switch {
+	case err != nil:
+		if isWebhookAddressError(err) {
+			return err
+		}
+		return &pushRetryError{reason: err.Error()}
+	case status >= 200 && status < 300:
+		log.Info("webhook", "topic", topic, "url", webhookURL)
+		return nil
+	case status == http.StatusGone && webhookURL != hook.url:
+		// адрес больше не принимает уведомления: удаляем его регистрацию
+		p.store.RemoveWebhook(topic, login, webhookURL)
+		metricTokensRemoved.Inc("webhook", "Gone")
+		log.Info("webhook gone", "topic", topic, "url", webhookURL)
+	case isRetryStatus(status):
+		return &pushRetryError{
+			reason:     http.StatusText(status),
+			retryAfter: retryAfter,
+		}
+	}
+	return errors.New(http.StatusText(status))
+}
+
+// isWebhookAddressError возвращает true, если ошибка вызвана попыткой
+// соединения с запрещенным адресом. Повторять отправку в этом случае нет
+// смысла.
+func isWebhookAddressError(err error) bool {
+	for err != nil {
+		if err == errWebhookAddress {
+			return true
+		}
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// postWebhook отсылает подписанное уведомление на указанный адрес и возвращает
+// статус ответа и задержку из заголовка Retry-After, если она указана.
+func postWebhook(client *http.Client, webhookURL, login, signature string,
+	payload []byte) (int, time.Duration, error) {
+	req, err := http.NewRequest("POST", webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("User-Agent", app.Agent)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-MXProxy-Login", login)
+	req.Header.Set("X-MXProxy-Signature", signature)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, retryAfter(resp.Header), nil
+}
+
+// ParseWebhookURL декодирует адрес webhook, переданный в пути запроса в виде
+// строки base64 (URL-safe), и проверяет его. Допускаются только адреса https,
+// имя сервера которых не разрешается в локальные, частные или служебные
+// адреса.
+func ParseWebhookURL(token string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		if data, err = base64.URLEncoding.DecodeString(token); err != nil {
+			return "", errors.New("webhook url must be base64url encoded")
+		}
+	}
+	u, err := url.Parse(string(data))
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" || u.Hostname() == "" {
+		return "", errors.New("webhook url must be absolute https url")
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		ips = []net.IP{ip}
+	} else if ips, err = net.LookupIP(u.Hostname()); err != nil {
+		return "", errors.New("webhook host not found")
+	}
+	for _, ip := range ips {
+		if !webhookAllowedIP(ip) {
+			return "", errWebhookAddress
+		}
+	}
+	return u.String(), nil
+}
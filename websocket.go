@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Типы сообщений WebSocket.
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// wsMaxMessageSize задает максимальный размер сообщения от клиента.
+const wsMaxMessageSize = 1 << 16
+
+// wsConn описывает минимальную серверную реализацию соединения WebSocket
+// (RFC 6455), достаточную для отдачи потока событий.
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	mu   sync.Mutex // блокировка записи
+}
+
+// wsUpgrade проверяет запрос на изменение протокола и переключает соединение
+// на WebSocket.
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("bad websocket upgrade request")
+	}
+	var key = r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("websocket key required")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("websocket unsupported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// сбрасываем ограничения времени, установленные HTTP сервером
+	conn.SetDeadline(time.Time{})
+	var hash = sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " +
+		base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n")
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, rw: rw}, nil
+}
+
+// WriteMessage отсылает сообщение клиенту.
+func (ws *wsConn) WriteMessage(opcode byte, data []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	// заголовок сообщения: сервер отправляет данные без маски
+	var header = []byte{0x80 | opcode, 0}
+	switch length := len(data); {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	ws.conn.SetWriteDeadline(time.Now().Add(EventsKeepAlive))
+	if _, err := ws.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := ws.rw.Write(data); err != nil {
+		return err
+	}
+	return ws.rw.Flush()
+}
+
+// ReadMessage возвращает следующее сообщение от клиента. На служебные
+// сообщения ping и close ответ отсылается автоматически.
+func (ws *wsConn) ReadMessage() (opcode byte, data []byte, err error) {
+	for {
+		var header [2]byte
+		if _, err = io.ReadFull(ws.rw, header[:]); err != nil {
+			return 0, nil, err
+		}
+		opcode = header[0] & 0x0F
+		var length = uint64(header[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err = io.ReadFull(ws.rw, ext[:]); err != nil {
+				return 0, nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err = io.ReadFull(ws.rw, ext[:]); err != nil {
+				return 0, nil, err
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		if length > wsMaxMessageSize {
+			return 0, nil, errors.New("websocket message too large")
+		}
+		// сообщения клиента всегда должны быть с маской
+		if header[1]&0x80 == 0 {
+			return 0, nil, errors.New("unmasked websocket message")
+		}
+		var mask [4]byte
+		if _, err = io.ReadFull(ws.rw, mask[:]); err != nil {
+			return 0, nil, err
+		}
+		data = make([]byte, length)
+		if _, err = io.ReadFull(ws.rw, data); err != nil {
+			return 0, nil, err
+		}
+		for i := range data {
+			data[i] ^= mask[i%4]
+		}
+		switch opcode {
+		case wsPing:
+			if err = ws.WriteMessage(wsPong, data); err != nil {
+				return 0, nil, err
+			}
+		case wsPong:
+		case wsClose:
+			ws.WriteMessage(wsClose, nil)
+			return opcode, data, io.EOF
+		default:
+			return opcode, data, nil
+		}
+	}
+}
+
+// Close закрывает соединение.
+func (ws *wsConn) Close() error {
+	return ws.conn.Close()
+}